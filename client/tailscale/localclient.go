@@ -827,6 +827,46 @@ func (lc *LocalClient) SetServeConfig(ctx context.Context, config *ipn.ServeConf
 	return nil
 }
 
+// ErrServeConfigChanged is returned (wrapped) by SetServeConfigIfMatch when
+// the serve config was changed after it was read. Callers may re-read the
+// config and try again.
+var ErrServeConfigChanged = errors.New("serve config changed since it was read")
+
+// SetServeConfigIfMatch is like SetServeConfig, but only replaces the serve
+// config if it still has the given etag, as returned by
+// GetServeConfigWithETag. If it doesn't, the returned error wraps
+// ErrServeConfigChanged. An empty etag replaces the config unconditionally.
+func (lc *LocalClient) SetServeConfigIfMatch(ctx context.Context, config *ipn.ServeConfig, etag string) error {
+	body := jsonBody(config)
+	if body.err != nil {
+		return body.err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/serve-config", body)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	slurp, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return fmt.Errorf("sending serve config: %w", ErrServeConfigChanged)
+	}
+	err = fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(slurp))
+	return fmt.Errorf("sending serve config: %w", bestError(err, slurp))
+}
+
 // NetworkLockDisable shuts down network-lock across the tailnet.
 func (lc *LocalClient) NetworkLockDisable(ctx context.Context, secret []byte) error {
 	if _, err := lc.send(ctx, "POST", "/localapi/v0/tka/disable", 200, bytes.NewReader(secret)); err != nil {
@@ -846,6 +886,90 @@ func (lc *LocalClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, er
 	return getServeConfigFromJSON(body)
 }
 
+// GetServeConfigWithETag is like GetServeConfig, but also returns the
+// config's ETag, for use with SetServeConfigIfMatch. The ETag is empty if
+// tailscaled doesn't support them.
+func (lc *LocalClient) GetServeConfigWithETag(ctx context.Context) (*ipn.ServeConfig, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/serve-config", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting serve config: %w", err)
+	}
+	defer res.Body.Close()
+	slurp, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting serve config: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(slurp))
+		return nil, "", fmt.Errorf("getting serve config: %w", bestError(err, slurp))
+	}
+	sc, err := getServeConfigFromJSON(slurp)
+	if err != nil {
+		return nil, "", err
+	}
+	return sc, res.Header.Get("Etag"), nil
+}
+
+// GetPeerServeConfig returns the serve config of the peer whose MagicDNS
+// name is peer. The peer must be owned by the same user as this node.
+//
+// If the peer's serve config is empty, it returns (nil, nil).
+func (lc *LocalClient) GetPeerServeConfig(ctx context.Context, peer string) (*ipn.ServeConfig, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-config-peer?peer="+url.QueryEscape(peer))
+	if err != nil {
+		return nil, fmt.Errorf("getting serve config of %s: %w", peer, err)
+	}
+	return getServeConfigFromJSON(body)
+}
+
+// NewProfile creates and switches to a new, empty profile. A subsequent
+// login populates and persists it.
+func (lc *LocalClient) NewProfile(ctx context.Context) error {
+	_, err := lc.send(ctx, "PUT", "/localapi/v0/profiles/", http.StatusCreated, nil)
+	return err
+}
+
+// CurrentProfile returns the current login profile.
+func (lc *LocalClient) CurrentProfile(ctx context.Context) (ipn.LoginProfile, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/profiles/current")
+	if err != nil {
+		return ipn.LoginProfile{}, err
+	}
+	return decodeJSON[ipn.LoginProfile](body)
+}
+
+// ListProfiles returns the login profiles of the current user.
+func (lc *LocalClient) ListProfiles(ctx context.Context) ([]ipn.LoginProfile, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/profiles/")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]ipn.LoginProfile](body)
+}
+
+// SwitchProfile switches to the profile with the given ID.
+func (lc *LocalClient) SwitchProfile(ctx context.Context, id ipn.ProfileID) error {
+	_, err := lc.send(ctx, "POST", "/localapi/v0/profiles/"+url.PathEscape(string(id)), http.StatusNoContent, nil)
+	return err
+}
+
+// RenameProfile sets the name of the profile with the given ID.
+func (lc *LocalClient) RenameProfile(ctx context.Context, id ipn.ProfileID, name string) error {
+	_, err := lc.send(ctx, "PATCH", "/localapi/v0/profiles/"+url.PathEscape(string(id))+"?name="+url.QueryEscape(name), http.StatusNoContent, nil)
+	return err
+}
+
+// DeleteProfile deletes the profile with the given ID. If it's the
+// current profile, tailscaled switches to a new, empty one.
+func (lc *LocalClient) DeleteProfile(ctx context.Context, id ipn.ProfileID) error {
+	_, err := lc.send(ctx, "DELETE", "/localapi/v0/profiles/"+url.PathEscape(string(id)), http.StatusNoContent, nil)
+	return err
+}
+
 func getServeConfigFromJSON(body []byte) (sc *ipn.ServeConfig, err error) {
 	if err := json.Unmarshal(body, &sc); err != nil {
 		return nil, err
@@ -158,6 +158,7 @@ func Run(args []string) (err error) {
 			upCmd,
 			downCmd,
 			setCmd,
+			loginCmd,
 			logoutCmd,
 			netcheckCmd,
 			ipCmd,
@@ -213,12 +214,36 @@ func Run(args []string) (err error) {
 	if tailscale.IsAccessDeniedError(err) && os.Getuid() != 0 && runtime.GOOS != "windows" {
 		return fmt.Errorf("%v\n\nUse 'sudo tailscale %s' or 'tailscale up --operator=$USER' to not require root.", err, strings.Join(args, " "))
 	}
-	if errors.Is(err, flag.ErrHelp) {
+	if errors.Is(err, flag.ErrHelp) && ExitCode(err) == 1 {
 		return nil
 	}
 	return err
 }
 
+// exitCodeError is an error from a subcommand that wants the tailscale
+// command to exit with a particular status. See ExitCode.
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string { return e.err.Error() }
+func (e *exitCodeError) Unwrap() error { return e.err }
+
+// ExitCode returns the process exit status for err, as returned by Run.
+// It's 0 if err is nil, the status asked for by the failing subcommand if
+// any, and 1 otherwise.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ece *exitCodeError
+	if errors.As(err, &ece) {
+		return ece.code
+	}
+	return 1
+}
+
 func fatalf(format string, a ...any) {
 	if Fatalf != nil {
 		Fatalf(format, a...)
@@ -0,0 +1,244 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+)
+
+var loginCmd = &ffcli.Command{
+	Name:       "login",
+	ShortUsage: "login [flags]",
+	ShortHelp:  "Log in to a Tailscale account in a new profile",
+
+	LongHelp: strings.TrimSpace(`
+"tailscale login" creates a new profile and logs this machine in to a
+Tailscale network with it, leaving any existing profiles in place. It
+takes the same flags as "tailscale up". If the login fails, the new
+profile is removed and the previous one is restored. Flags that have no
+effect on a new profile, such as --reset, are reported with a warning.
+`),
+	FlagSet: loginFlagSet,
+	Exec:    runLogin,
+}
+
+var loginArgs struct {
+	profileName  string
+	reuseCurrent bool
+	authKeyFile  string
+}
+
+var loginFlagSet = func() *flag.FlagSet {
+	fs := newUpFlagSet(effectiveGOOS(), &upArgs, "login")
+	fs.Lookup("timeout").Usage = "maximum amount of time to wait for the login to complete; default (0s) blocks forever"
+	fs.Func("profile", "name for the profile; defaults to the login name", func(v string) error {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return errors.New("must not be empty")
+		}
+		loginArgs.profileName = v
+		return nil
+	})
+	fs.BoolVar(&loginArgs.reuseCurrent, "reuse-current", false, "log in with the current profile instead of creating a new one; combine with -force-reauth to refresh its credentials")
+	fs.StringVar(&loginArgs.authKeyFile, "authkey-file", "", "path to a file containing the node authorization key; keeps the key out of shell history and process listings")
+	return fs
+}()
+
+// loginFreshProfileFlags are the flags that take part in a login with a
+// new profile: login's own flags, and the up flags that set prefs on the
+// new profile just as they would for "tailscale up". Any other flag,
+// including ones added to up later, gets a warning.
+var loginFreshProfileFlags = map[string]bool{
+	"profile":       true,
+	"reuse-current": true,
+	"authkey-file":  true,
+	"timeout":       true,
+
+	"auth-key":                   true,
+	"login-server":               true,
+	"hostname":                   true,
+	"advertise-tags":             true,
+	"accept-routes":              true,
+	"accept-dns":                 true,
+	"host-routes":                true,
+	"exit-node":                  true,
+	"exit-node-allow-lan-access": true,
+	"shields-up":                 true,
+	"ssh":                        true,
+	"advertise-routes":           true,
+	"advertise-exit-node":        true,
+	"operator":                   true,
+	"snat-subnet-routes":         true,
+	"netfilter-mode":             true,
+	"unattended":                 true,
+}
+
+// loginFreshProfileIgnored gives the reason some flags not in
+// loginFreshProfileFlags are ignored, for a more useful warning.
+var loginFreshProfileIgnored = map[string]string{
+	"reset":        "a new profile has no settings to reset",
+	"force-reauth": "a new profile always authenticates",
+}
+
+// warnIgnoredLoginFlags warns about any flags set in fs that aren't in
+// loginFreshProfileFlags.
+func warnIgnoredLoginFlags(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		if loginFreshProfileFlags[f.Name] {
+			return
+		}
+		why, ok := loginFreshProfileIgnored[f.Name]
+		if !ok {
+			why = "it isn't used when logging in with a new profile"
+		}
+		warnf("--%s is ignored: %s; use --reuse-current to apply it to the current profile", f.Name, why)
+	})
+}
+
+// profileClient is the part of *tailscale.LocalClient that login uses.
+type profileClient interface {
+	NewProfile(context.Context) error
+	ListProfiles(context.Context) ([]ipn.LoginProfile, error)
+	CurrentProfile(context.Context) (ipn.LoginProfile, error)
+	RenameProfile(context.Context, ipn.ProfileID, string) error
+	SwitchProfile(context.Context, ipn.ProfileID) error
+	DeleteProfile(context.Context, ipn.ProfileID) error
+}
+
+// Test hooks.
+var (
+	loginProfiles profileClient = &localClient
+	loginRunUp                  = runUp
+)
+
+func runLogin(ctx context.Context, args []string) error {
+	if loginArgs.authKeyFile != "" {
+		if upArgs.authKeyOrFile != "" {
+			return errors.New("--authkey-file and --auth-key are mutually exclusive")
+		}
+		key, err := readAuthKeyFile(loginArgs.authKeyFile)
+		if err != nil {
+			return err
+		}
+		upArgs.authKeyOrFile = key
+	}
+	timeout := upArgs.timeout
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		// The deadline above covers the whole login, so don't also
+		// let runUp time out on its own with a different message.
+		upArgs.timeout = 0
+	}
+	if !loginArgs.reuseCurrent {
+		warnIgnoredLoginFlags(loginFlagSet)
+	}
+	name := loginArgs.profileName
+	prev, err := loginProfiles.CurrentProfile(ctx)
+	if err != nil {
+		return fixTailscaledConnectError(err)
+	}
+	if name != "" {
+		profiles, err := loginProfiles.ListProfiles(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range profiles {
+			if p.Name == name && !(loginArgs.reuseCurrent && p.ID == prev.ID) {
+				return fmt.Errorf("a profile named %q already exists", name)
+			}
+		}
+	}
+	if loginArgs.reuseCurrent {
+		err = loginRunUp(ctx, args)
+	} else {
+		err = loginNewProfile(ctx, prev, args)
+	}
+	if err != nil {
+		return loginError(ctx, timeout, err)
+	}
+	if name == "" {
+		return nil
+	}
+	cur, err := loginProfiles.CurrentProfile(ctx)
+	if err != nil {
+		return err
+	}
+	if err := loginProfiles.RenameProfile(ctx, cur.ID, name); err != nil {
+		return fmt.Errorf("logged in, but naming the profile failed: %w", err)
+	}
+	return nil
+}
+
+// readAuthKeyFile returns the auth key stored in file, with surrounding
+// whitespace removed.
+func readAuthKeyFile(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading auth key: %w", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("auth key file %q is empty", file)
+	}
+	if strings.HasPrefix(key, "file:") {
+		// getAuthKey would treat this as another file name.
+		return "", fmt.Errorf("auth key file %q does not contain an auth key", file)
+	}
+	return key, nil
+}
+
+// loginNewProfile creates a new profile and runs up with it, rolling back
+// to prev if that fails.
+func loginNewProfile(ctx context.Context, prev ipn.LoginProfile, args []string) error {
+	if err := loginProfiles.NewProfile(ctx); err != nil {
+		return err
+	}
+	if err := loginRunUp(ctx, args); err != nil {
+		if rerr := rollbackLogin(prev); rerr != nil {
+			warnf("failed to remove the new profile: %v", rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// rollbackLogin deletes the profile created by a failed login, if it got
+// as far as being saved, and switches back to prev.
+func rollbackLogin(prev ipn.LoginProfile) error {
+	// ctx may have hit its deadline already, so use a fresh one.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := loginProfiles.CurrentProfile(ctx)
+	if err != nil {
+		return err
+	}
+	if cur.ID != "" && cur.ID != prev.ID {
+		if err := loginProfiles.DeleteProfile(ctx, cur.ID); err != nil {
+			return err
+		}
+	}
+	if prev.ID != "" {
+		return loginProfiles.SwitchProfile(ctx, prev.ID)
+	}
+	return nil
+}
+
+func loginError(ctx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %v waiting for login to complete", timeout)
+	}
+	return err
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// fakeProfiles is an in-memory profileClient. Like tailscaled, a new
+// profile has an empty ID until a login saves it.
+type fakeProfiles struct {
+	current ipn.ProfileID
+	known   map[ipn.ProfileID]string // ID to name
+	calls   []string
+}
+
+func (f *fakeProfiles) NewProfile(context.Context) error {
+	f.calls = append(f.calls, "new")
+	f.current = ""
+	return nil
+}
+
+func (f *fakeProfiles) ListProfiles(context.Context) ([]ipn.LoginProfile, error) {
+	var ps []ipn.LoginProfile
+	for id, name := range f.known {
+		ps = append(ps, ipn.LoginProfile{ID: id, Name: name})
+	}
+	return ps, nil
+}
+
+func (f *fakeProfiles) CurrentProfile(context.Context) (ipn.LoginProfile, error) {
+	return ipn.LoginProfile{ID: f.current, Name: f.known[f.current]}, nil
+}
+
+func (f *fakeProfiles) RenameProfile(_ context.Context, id ipn.ProfileID, name string) error {
+	f.calls = append(f.calls, "rename "+string(id)+" "+name)
+	f.known[id] = name
+	return nil
+}
+
+func (f *fakeProfiles) SwitchProfile(_ context.Context, id ipn.ProfileID) error {
+	f.calls = append(f.calls, "switch "+string(id))
+	f.current = id
+	return nil
+}
+
+func (f *fakeProfiles) DeleteProfile(_ context.Context, id ipn.ProfileID) error {
+	f.calls = append(f.calls, "delete "+string(id))
+	delete(f.known, id)
+	if f.current == id {
+		f.current = ""
+	}
+	return nil
+}
+
+func TestLoginRollback(t *testing.T) {
+	defer func(pc profileClient, ru func(context.Context, []string) error) {
+		loginProfiles, loginRunUp = pc, ru
+	}(loginProfiles, loginRunUp)
+
+	errUp := errors.New("up failed")
+	tests := []struct {
+		name      string
+		saveAs    ipn.ProfileID // profile ID the failing up saves, if any
+		wantCalls []string
+	}{
+		{
+			name:      "unsaved",
+			wantCalls: []string{"new", "switch a"},
+		},
+		{
+			name:      "saved",
+			saveAs:    "b",
+			wantCalls: []string{"new", "delete b", "switch a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fp := &fakeProfiles{current: "a", known: map[ipn.ProfileID]string{"a": "user@a.example.com"}}
+			loginProfiles = fp
+			loginRunUp = func(context.Context, []string) error {
+				if tt.saveAs != "" {
+					fp.current = tt.saveAs
+					fp.known[tt.saveAs] = "user@b.example.com"
+				}
+				return errUp
+			}
+			if err := runLogin(context.Background(), nil); err != errUp {
+				t.Fatalf("runLogin error = %v; want %v", err, errUp)
+			}
+			if !reflect.DeepEqual(fp.calls, tt.wantCalls) {
+				t.Errorf("calls = %q; want %q", fp.calls, tt.wantCalls)
+			}
+			if fp.current != "a" || len(fp.known) != 1 {
+				t.Errorf("after rollback: current = %q, known = %v; want only %q", fp.current, fp.known, "a")
+			}
+		})
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	defer func(pc profileClient, ru func(context.Context, []string) error) {
+		loginProfiles, loginRunUp = pc, ru
+	}(loginProfiles, loginRunUp)
+	defer func(d time.Duration) { upArgs.timeout = d }(upArgs.timeout)
+
+	upArgs.timeout = 50 * time.Millisecond
+	fp := &fakeProfiles{current: "a", known: map[ipn.ProfileID]string{"a": "user@a.example.com"}}
+	loginProfiles = fp
+	loginRunUp = func(ctx context.Context, _ []string) error {
+		// The new profile is saved, but the login never finishes.
+		fp.current = "b"
+		fp.known["b"] = "user@b.example.com"
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err := runLogin(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 50ms waiting for login") {
+		t.Fatalf("runLogin error = %v; want timeout error", err)
+	}
+	if want := []string{"new", "delete b", "switch a"}; !reflect.DeepEqual(fp.calls, want) {
+		t.Errorf("calls = %q; want %q", fp.calls, want)
+	}
+	if fp.current != "a" || len(fp.known) != 1 {
+		t.Errorf("after rollback: current = %q, known = %v; want only %q", fp.current, fp.known, "a")
+	}
+}
+
+func TestLoginProfileName(t *testing.T) {
+	defer func(pc profileClient, ru func(context.Context, []string) error) {
+		loginProfiles, loginRunUp = pc, ru
+	}(loginProfiles, loginRunUp)
+	defer func() { loginArgs.profileName, loginArgs.reuseCurrent = "", false }()
+
+	run := func(fp *fakeProfiles, args ...string) error {
+		t.Helper()
+		loginArgs.profileName, loginArgs.reuseCurrent = "", false
+		if err := loginFlagSet.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		loginProfiles = fp
+		loginRunUp = func(context.Context, []string) error {
+			fp.current = "b"
+			fp.known["b"] = "user@b.example.com"
+			return nil
+		}
+		return runLogin(context.Background(), nil)
+	}
+
+	fp := &fakeProfiles{current: "a", known: map[ipn.ProfileID]string{"a": "home"}}
+	if err := run(fp, "--profile=work"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"new", "rename b work"}; !reflect.DeepEqual(fp.calls, want) {
+		t.Errorf("calls = %q; want %q", fp.calls, want)
+	}
+
+	fp = &fakeProfiles{current: "a", known: map[ipn.ProfileID]string{"a": "home"}}
+	if err := run(fp, "--profile=home"); err == nil {
+		t.Error("duplicate profile name: got success")
+	}
+	if err := loginFlagSet.Lookup("profile").Value.Set(" "); err == nil {
+		t.Error("empty profile name: got success")
+	}
+	if len(fp.calls) != 0 {
+		t.Errorf("calls = %q after rejected names; want none", fp.calls)
+	}
+}
+
+func TestLoginReuseCurrent(t *testing.T) {
+	defer func(pc profileClient, ru func(context.Context, []string) error) {
+		loginProfiles, loginRunUp = pc, ru
+	}(loginProfiles, loginRunUp)
+	defer func() { loginArgs.profileName, loginArgs.reuseCurrent = "", false }()
+
+	errUp := errors.New("up failed")
+	for _, upErr := range []error{nil, errUp} {
+		loginArgs.profileName, loginArgs.reuseCurrent = "", false
+		if err := loginFlagSet.Parse([]string{"--reuse-current"}); err != nil {
+			t.Fatal(err)
+		}
+		fp := &fakeProfiles{current: "a", known: map[ipn.ProfileID]string{"a": "home"}}
+		loginProfiles = fp
+		var ranUp bool
+		loginRunUp = func(context.Context, []string) error {
+			ranUp = true
+			return upErr
+		}
+		if err := runLogin(context.Background(), nil); err != upErr {
+			t.Fatalf("runLogin error = %v; want %v", err, upErr)
+		}
+		if !ranUp {
+			t.Error("up not run")
+		}
+		// Neither NewProfile nor, on failure, any rollback.
+		if len(fp.calls) != 0 {
+			t.Errorf("up error %v: calls = %q; want none", upErr, fp.calls)
+		}
+		if fp.current != "a" {
+			t.Errorf("current profile = %q; want %q", fp.current, "a")
+		}
+	}
+}
+
+func TestLoginIgnoredFlagWarning(t *testing.T) {
+	defer func(w io.Writer) { Stdout = w }(Stdout)
+	var buf bytes.Buffer
+	Stdout = &buf
+
+	fs := newUpFlagSet("linux", new(upArgsT), "login")
+	if err := fs.Parse([]string{"--reset", "--qr", "--hostname=foo", "--auth-key=tskey-x", "--login-server=https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	warnIgnoredLoginFlags(fs)
+	got := buf.String()
+	if !strings.Contains(got, "Warning: --reset is ignored: a new profile has no settings to reset") {
+		t.Errorf("missing warning for --reset; got %q", got)
+	}
+	// Not on the list, and with no specific reason.
+	if !strings.Contains(got, "Warning: --qr is ignored") {
+		t.Errorf("missing warning for --qr; got %q", got)
+	}
+	for _, f := range []string{"hostname", "auth-key", "login-server"} {
+		if strings.Contains(got, "--"+f) {
+			t.Errorf("unexpected warning for --%s; got %q", f, got)
+		}
+	}
+	if n := strings.Count(got, "Warning:"); n != 2 {
+		t.Errorf("got %d warnings; want 2: %q", n, got)
+	}
+}
+
+func TestLoginFreshProfileFlagsKnown(t *testing.T) {
+	// Some up flags exist only on some platforms.
+	sets := []*flag.FlagSet{loginFlagSet, newUpFlagSet("linux", new(upArgsT), "login"), newUpFlagSet("windows", new(upArgsT), "login")}
+	for name := range loginFreshProfileFlags {
+		known := false
+		for _, fs := range sets {
+			known = known || fs.Lookup(name) != nil
+		}
+		if !known {
+			t.Errorf("loginFreshProfileFlags has unknown flag %q", name)
+		}
+		if _, ok := loginFreshProfileIgnored[name]; ok {
+			t.Errorf("flag %q is both used and ignored", name)
+		}
+	}
+}
+
+func TestLoginAuthKeyFile(t *testing.T) {
+	defer func(pc profileClient, ru func(context.Context, []string) error) {
+		loginProfiles, loginRunUp = pc, ru
+	}(loginProfiles, loginRunUp)
+	defer func() { loginArgs.authKeyFile, upArgs.authKeyOrFile = "", "" }()
+
+	td := t.TempDir()
+	writeKey := func(name, contents string) string {
+		t.Helper()
+		p := filepath.Join(td, name)
+		if err := os.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		authKey string // --auth-key
+		wantKey string // passed to up; empty means up isn't run
+		wantErr string
+	}{
+		{name: "trimmed", file: writeKey("key", "  tskey-abc\n"), wantKey: "tskey-abc"},
+		{name: "empty", file: writeKey("empty", " \n"), wantErr: "is empty"},
+		{name: "missing", file: filepath.Join(td, "nope"), wantErr: "reading auth key"},
+		{name: "file-prefix", file: writeKey("indirect", "file:/etc/key"), wantErr: "does not contain"},
+		{name: "both", file: writeKey("key2", "tskey-abc"), authKey: "tskey-def", wantErr: "mutually exclusive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loginArgs.authKeyFile, upArgs.authKeyOrFile = tt.file, tt.authKey
+			fp := &fakeProfiles{current: "a", known: map[ipn.ProfileID]string{"a": "home"}}
+			loginProfiles = fp
+			var gotKey string
+			loginRunUp = func(context.Context, []string) error {
+				gotKey = upArgs.authKeyOrFile
+				return nil
+			}
+			err := runLogin(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runLogin error = %v; want containing %q", err, tt.wantErr)
+				}
+				if len(fp.calls) != 0 {
+					t.Errorf("calls = %q; want none", fp.calls)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotKey != tt.wantKey {
+				t.Errorf("up got auth key %q; want %q", gotKey, tt.wantKey)
+			}
+		})
+	}
+}
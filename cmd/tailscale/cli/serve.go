@@ -5,15 +5,49 @@
 package cli
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slices"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 	"tailscale.com/util/mak"
 )
 
@@ -21,35 +55,532 @@
 
 // newServeCommand returns a new "serve" subcommand using e as its environmment.
 func newServeCommand(e *serveEnv) *ffcli.Command {
-	return &ffcli.Command{
+	ingressFlags := e.newFlags("serve-ingress", func(fs *flag.FlagSet) {
+		fs.BoolVar(&e.http, "http", false, "change ingress for the plaintext HTTP server on port 80 instead of HTTPS on port 443")
+		fs.DurationVar(&e.ingressExpire, "expire", 0, "with \"on\", turn ingress back off after this long, like 2h; 0 means never")
+	})
+	cmd := &ffcli.Command{
 		Name:       "serve",
 		ShortHelp:  "TODO",
-		ShortUsage: "serve {show-config|https|tcp|ingress} <args>",
-		LongHelp:   "", // TODO
-		Exec:       e.runServe,
-		FlagSet:    e.newFlags("serve", func(fs *flag.FlagSet) {}),
+		ShortUsage: "serve {show-config|tcp|ingress} <args>\n  serve [flags] <mount-point>... {proxy|path|text|redirect} <arg>\n  serve [flags] <mount-point>... off",
+		LongHelp: strings.TrimSpace(`
+For text handlers, an argument of @file serves the contents of that file
+(up to 64 KiB), stored in the serve config. Use @@ for a literal leading @.
+
+A path handler can instead serve several files, from anywhere, as one
+directory: "serve /downloads path a.zip=/x/a.zip b.zip=/y/b.zip".
+
+A path handler for a .zip, .tar.gz, or .tgz file serves the archive's
+contents as a directory. To serve an archive file itself, name it, as in
+"serve /downloads path site.zip=./site.zip".
+
+"serve <mount-point>... off" removes the handlers at those mount points.
+Removing the last handler on a port also stops serving HTTPS (or HTTP) on
+it, unless a TCP forward uses the port.
+
+-require-client-cert makes the web server on the port turn away TLS clients
+that don't present a certificate. With -client-ca, the certificate must
+chain to one of the CAs in that PEM file, which is stored in the serve
+config. Each -require-client-cert replaces the CAs set before.
+
+A proxy target of @name is looked up in the file given with -targets, which
+has a name and a target per line, like "myservice localhost:8080". The
+target it names is what's saved.
+
+Exit status: 0 on success, 2 for invalid arguments or configs, 3 if tailscaled
+can't be reached, 4 if -must-change was given but nothing changed, 5 if
+show-config, list, status, or backup found no serve config, 6 if the serve
+config kept changing while it was being updated, and 1 for any other failure.
+`),
+		Exec: func(ctx context.Context, args []string) error {
+			// set-raw reads its config from stdin, so can't be rerun.
+			if len(args) == 1 && args[0] == "set-raw" {
+				return e.runServe(ctx, args)
+			}
+			return e.retryIfChanged(e.runServe)(ctx, args)
+		},
+		FlagSet: e.newFlags("serve", func(fs *flag.FlagSet) {
+			fs.StringVar(&e.label, "label", "", "a description of what the handler is for, shown by \"serve list\" and \"serve show-config\"")
+			fs.StringVar(&e.maintenanceWindow, "maintenance-window", "", "weekly window during which the handler returns 503, like 'Sat 02:00-04:00'")
+			fs.StringVar(&e.rateLimit, "rate-limit", "", "for proxy and path handlers, the most requests to serve per second, minute, or hour, like 10/s, 600/m, or 5000/h")
+			fs.BoolVar(&e.verbose, "v", false, "log each step of the command, such as fetching and saving the serve config, to stderr")
+			fs.BoolVar(&e.validateOnly, "validate-only", false, "run all checks for the change, then exit without saving")
+			fs.BoolVar(&e.probe, "probe", false, "check that the proxy backend accepts connections before saving")
+			fs.StringVar(&e.sticky, "sticky", "", `for proxies with multiple backends, pin clients to one backend by "cookie" or "ip"`)
+			fs.BoolVar(&e.encryptSecrets, "encrypt-secrets", false, "ask tailscaled to store secret handler fields encrypted")
+			fs.Var(&e.bodyReplace, "body-replace", "for proxies, replace old with new in response bodies, as old=new; may be repeated")
+			fs.Var(&e.decodeUpstream, "decode-upstream", "for proxies, decompress gzipped responses to rewrite them; defaults to on with -body-replace")
+			fs.Var(&e.followRedirects, "follow-redirects", "for proxies, follow GET and HEAD redirects to the same backend instead of passing them to the client; default false")
+			fs.StringVar(&e.targetsFile, "targets", "", "file of \"name target\" lines, one per service, that @name proxy targets are looked up in")
+			fs.StringVar(&e.socket, "socket", "", "path to the tailscaled socket to use instead of the default")
+			fs.DurationVar(&e.timeout, "timeout", defaultServeTimeout, "how long to wait for each request to tailscaled before giving up; 0 means no limit")
+			fs.BoolVar(&e.compress, "compress", false, "gzip responses for clients that accept it")
+			fs.BoolVar(&e.http, "http", false, "serve plaintext HTTP on port 80 instead of HTTPS on port 443")
+			fs.IntVar(&e.port, "port", 0, "port to serve web handlers on, over HTTPS unless -http or -no-https is given; defaults to $"+servePortEnv+" if set, or else 443, or 80 with -http")
+			fs.BoolVar(&e.noHTTPS, "no-https", false, "serve plaintext HTTP on port 443 instead of HTTPS, for TLS terminated upstream; give it with every change to that port")
+			fs.IntVar(&e.statusCode, "status", 0, "for text handlers, the HTTP status code to respond with, default 200; for redirect handlers, one of 301, 302 (the default), 307, or 308")
+			fs.Var(&e.requireClientCert, "require-client-cert", "require TLS clients to present a certificate to reach the web server; =false to stop requiring one")
+			fs.StringVar(&e.clientCA, "client-ca", "", "with -require-client-cert, PEM file of the CA certificates that client certificates must chain to; default any certificate")
+			fs.IntVar(&e.hstsMaxAge, "hsts", 0, "if positive, send Strict-Transport-Security with this max-age in seconds")
+			fs.StringVar(&e.baseDir, "base-dir", "", "directory that relative path handler arguments resolve against; defaults to the current directory")
+			fs.StringVar(&e.allowRoot, "allow-root", "", "if set, only allow path handlers to serve files and directories within this directory, after resolving symlinks")
+			fs.BoolVar(&e.hstsSubdomains, "hsts-subdomains", false, "add includeSubDomains to the Strict-Transport-Security header; requires -hsts")
+			fs.BoolVar(&e.force, "force", false, "replace an existing handler at the mount point without asking")
+			fs.BoolVar(&e.expandEnv, "expand-env", false, "expand $VAR and ${VAR} environment variables in the proxy or path argument")
+			fs.BoolVar(&e.appendPath, "append", false, "for path, layer the directory beneath the existing path handler's directories at the mount point instead of replacing it")
+			fs.BoolVar(&e.spa, "spa", false, "for path directories, serve index.html for files that don't exist, for single-page apps")
+			fs.Var(&e.cacheMaxAge, "cache-max-age", "for path handlers, send Cache-Control: max-age with this many seconds; default no header")
+			fs.StringVar(&e.maxBody, "max-body", "", "for proxies, reject request bodies larger than this, like 10MB; KB, MB, and GB are powers of 1024")
+			fs.BoolVar(&e.outputURL, "output-url", false, "after a successful change, print only the URL of each mount point given, one per line")
+			fs.BoolVar(&e.mustChange, "must-change", false, "fail with exit status 4 if the command would leave the serve config unchanged")
+			fs.BoolVar(&e.dryRunDiff, "dry-run-diff", false, "print what the command would change in the serve config, in the format of \"serve diff\", without saving")
+			fs.BoolVar(&e.allowOffline, "allow-offline", false, "change the serve config even if this node isn't running yet, to set it up in advance; web handlers need the node to have logged in once")
+			fs.StringVar(&e.expectTailnet, "expect-tailnet", "", "fail without saving unless this node is connected to the tailnet with this name")
+			fs.StringVar(&e.onChange, "on-change", "", "program to run after the serve config is saved, with the new config as JSON on its stdin")
+			fs.DurationVar(&e.onChangeTimeout, "on-change-timeout", 30*time.Second, "how long to let the -on-change program run before killing it")
+		}),
 		Subcommands: []*ffcli.Command{
 			{
 				Name:      "show-config",
 				Exec:      e.runServeShowConfig,
 				ShortHelp: "show current serve config",
+				FlagSet: e.newFlags("serve-show-config", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.watch, "watch", false, "re-print the config whenever it changes, until interrupted")
+					fs.DurationVar(&e.watchInterval, "interval", time.Second, "how often to check for changes with -watch")
+					fs.StringVar(&e.showMount, "mount", "", "show only the handler at this mount point, with the port and ingress settings it's served with")
+					fs.BoolVar(&e.showSecrets, "show-secrets", false, "print secret handler fields, such as BasicAuthHash, instead of "+redactedSecret)
+					fs.BoolVar(&e.resolvePaths, "resolve-paths", false, "after the config, note on stderr whether each path handler's files exist")
+					fs.BoolVar(&e.ndjson, "ndjson", false, "print one JSON object per line for each web handler and TCP forward, instead of the whole config")
+				}),
+			},
+			{
+				Name:       "apply",
+				Exec:       e.runServeApply,
+				ShortUsage: "apply -f <file>",
+				ShortHelp:  "replace the serve config with one read from a file",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve apply" reads a complete serve config in the JSON format
+printed by "tailscale serve show-config", validates it, and replaces the
+current serve config with it. Unknown fields are rejected. Use "-f -" to
+read from stdin.
+
+Files named *.yaml, *.yml, or *.toml are read as YAML or TOML instead,
+with the same field names as the JSON format. Other files and stdin are
+read as JSON.
+`),
+				FlagSet: e.newFlags("serve-apply", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.file, "f", "", `file to read the serve config from, or "-" for stdin`)
+				}),
+			},
+			{
+				Name:       "edit",
+				Exec:       e.runServeEdit,
+				ShortUsage: "edit",
+				ShortHelp:  "edit the serve config in $EDITOR",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve edit" opens the current serve config, in the JSON format
+printed by "tailscale serve show-config", in $EDITOR (or vi, or notepad on
+Windows), then checks and saves it once the editor exits.
+
+If the edited file isn't a valid serve config in JSON, the editor is opened
+again to fix it; saving it unchanged then cancels the edit. Leaving the file
+unchanged, or emptying it, also cancels. If the edited config fails the
+checks run before saving, or the save fails, the file is kept so that the
+edits aren't lost.
+`),
+				FlagSet: e.newFlags("serve-edit", nil),
+			},
+			{
+				Name:       "validate",
+				Exec:       e.runServeValidate,
+				ShortUsage: "validate -f <file>",
+				ShortHelp:  "check a serve config file without applying it",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve validate" reads a serve config file, in any format read by
+"tailscale serve apply", and runs the same checks apply does, without
+contacting tailscaled. It prints every problem found and exits 2 if there
+are any.
+`),
+				FlagSet: e.newFlags("serve-validate", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.file, "f", "", `file to read the serve config from, or "-" for stdin`)
+				}),
+			},
+			{
+				Name:       "diff",
+				Exec:       e.runServeDiff,
+				ShortUsage: "diff -f <file>",
+				ShortHelp:  "show what applying a serve config file would change",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve diff" compares the serve config in a file, in any format
+read by "tailscale serve apply", to the current one. It prints a line per
+web handler, TCP or UDP forward, ingress setting, or other setting that
+applying the file would add (+), remove (-), or change (~).
+
+It exits 0 if there are no differences and 1 if there are.
+`),
+				FlagSet: e.newFlags("serve-diff", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.file, "f", "", `file to read the serve config from, or "-" for stdin`)
+				}),
+			},
+			{
+				Name:       "describe",
+				Exec:       e.runServeDescribe,
+				ShortUsage: "describe -f <file>",
+				ShortHelp:  "explain a serve config file in plain English",
+				FlagSet: e.newFlags("serve-describe", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.file, "f", "", `file to read the serve config from, or "-" for stdin`)
+				}),
+			},
+			{
+				Name:       "explain",
+				Exec:       e.runServeExplain,
+				ShortUsage: "explain <request-path>...",
+				ShortHelp:  "show which handler would serve a request path",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve explain /docs/a.html" prints, for each web server in the
+serve config, the mount point whose handler would serve a request for that
+path, and how it was matched.
+
+A request goes to the handler whose mount point equals its path. Otherwise
+its path is cleaned, and it goes to the first of these that has a handler:
+the path with a trailing slash, the path without one, and then the same for
+each parent directory in turn, up to /. So a mount point of /docs/ serves
+/docs too, and one of /docs serves /docs/ and everything under it.
+`),
+				FlagSet: e.newFlags("serve-explain", nil),
+			},
+			{
+				Name:       "export",
+				Exec:       e.runServeExport,
+				ShortUsage: "export [-split -dir <dir>]",
+				ShortHelp:  "write the serve config as JSON, optionally one file per host",
+				FlagSet: e.newFlags("serve-export", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.split, "split", false, "write one JSON file per host, plus "+serveGlobalFile+" for TCP and ingress settings, into -dir")
+					fs.StringVar(&e.dir, "dir", "", "directory to write files to with -split; other .json files in it are removed")
+				}),
+			},
+			{
+				Name:       "import",
+				Exec:       e.runServeImport,
+				ShortUsage: "import -dir <dir>\n  import -format caddyfile -f <file>",
+				ShortHelp:  "replace the serve config with one assembled from \"export -split\" files, or convert a Caddyfile",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve import -dir" replaces the serve config with one assembled
+from the files written by "tailscale serve export -split".
+
+With -format caddyfile, it instead converts the reverse_proxy and
+file_server directives in a Caddyfile, along with the root, handle, and
+handle_path directives around them, to a serve config for this node and
+prints it without changing anything. Other directives are skipped with a
+warning. Review the output, then apply it with "tailscale serve apply".
+`),
+				FlagSet: e.newFlags("serve-import", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.dir, "dir", "", "directory of JSON files to read")
+					fs.StringVar(&e.importFormat, "format", "", `format of the -f file to convert and print; only "caddyfile" is supported`)
+					fs.StringVar(&e.file, "f", "", `with -format, the file to convert, or "-" for stdin`)
+				}),
+			},
+			{
+				Name:       "backup",
+				Exec:       e.runServeBackup,
+				ShortUsage: "backup <dir>",
+				ShortHelp:  "save the serve config to a timestamped file in a directory",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve backup" writes the current serve config, secrets included,
+to a new file named serve-<timestamp>.json in <dir>, creating <dir> if
+needed, and prints the file's name. Restore it with "tailscale serve restore".
+`),
+			},
+			{
+				Name:       "restore",
+				Exec:       e.runServeRestore,
+				ShortUsage: "restore [-dry-run] <file>",
+				ShortHelp:  "replace the serve config with one saved by \"serve backup\"",
+				FlagSet: e.newFlags("serve-restore", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.restoreDryRun, "dry-run", false, "print what restoring would change, in the format of \"serve diff\", without saving")
+				}),
+			},
+			{
+				Name:       "merge",
+				Exec:       e.runServeMerge,
+				ShortUsage: "merge < fragment.json",
+				ShortHelp:  "merge a partial JSON serve config from stdin into the current one",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve merge" reads part of a serve config, in the JSON format
+printed by "tailscale serve show-config", from stdin and merges it into the
+current serve config. Web handlers, TCP and UDP ports, and ingress settings
+in the fragment are added, replacing any at the same mount point, port, or
+host:port; everything else is kept. EncryptedSecrets can be turned on but
+not off. The merged config is validated before it's saved.
+`),
+			},
+			{
+				Name:       "set",
+				Exec:       e.retryIfChanged(e.runServeSet),
+				ShortUsage: "set <mount-point>... {proxy|path|text|redirect} <arg> [<mount-point>... {proxy|path|text|redirect} <arg>]...",
+				ShortHelp:  "replace all web handlers with the ones given",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve set" takes one or more handlers, each in the same form as
+"tailscale serve" takes one, and makes them the only web handlers on port
+443, or port 80 with -http. Handlers not listed are removed. TCP and UDP
+forwards, ingress settings, and handlers on other ports are kept. Flags
+given before "set" apply to every handler.
+
+For example:
+
+  tailscale serve set / proxy 3000 /docs/ path /srv/docs
+`),
+			},
+			{
+				Name:       "clone-from",
+				Exec:       e.retryIfChanged(e.runServeCloneFrom),
+				ShortUsage: "clone-from [flags] <peer>",
+				ShortHelp:  "copy another of your nodes' serve config to this node",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve clone-from <peer>" fetches the serve config of <peer>, which
+must be owned by the same user, with neither node tagged. It saves it as
+this node's config with the peer's DNS name replaced by this node's. Every
+path handler's file or directory must also exist on this node. Peers don't
+share basic-auth passwords, so each handler that uses basic auth gets a new
+password, which is printed once.
+`),
+				FlagSet: e.newFlags("serve-clone-from", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.force, "force", false, "replace this node's serve config even if it's not empty")
+					fs.BoolVar(&e.validateOnly, "validate-only", false, "run all checks, then exit without saving")
+				}),
+			},
+			{
+				Name:       "move",
+				Exec:       e.retryIfChanged(e.runServeMove),
+				ShortUsage: "move [flags] <old-mount-point> <new-mount-point>",
+				ShortHelp:  "move a handler to a new mount point, keeping its settings",
+				FlagSet: e.newFlags("serve-move", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.force, "force", false, "replace any handler already at the new mount point")
+					fs.BoolVar(&e.http, "http", false, "move a handler of the plaintext HTTP server on port 80 instead of HTTPS on port 443")
+				}),
+			},
+			{
+				Name:       "rotate-auth",
+				Exec:       e.retryIfChanged(e.runServeRotateAuth),
+				ShortUsage: "rotate-auth [-user <name>] <mount-point>",
+				ShortHelp:  "generate a new basic-auth password for a handler",
+				FlagSet: e.newFlags("serve-rotate-auth", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.authUser, "user", "", "basic-auth user name to set; empty keeps the current one")
+				}),
+			},
+			{
+				Name:      "status",
+				Exec:      e.runServeStatus,
+				ShortHelp: "show a table of current serve handlers",
+				FlagSet: e.newFlags("serve-status", func(fs *flag.FlagSet) {
+					fs.StringVar(&e.statusFormat, "format", "", `output format; empty for the default, or "wide" for extra columns`)
+					fs.StringVar(&e.statusFormat, "o", "", "shorthand for -format")
+				}),
+			},
+			{
+				Name:       "doctor",
+				Exec:       e.runServeDoctor,
+				ShortUsage: "doctor",
+				ShortHelp:  "check the serve config for common problems",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve doctor" checks the current serve config for path handlers
+whose files are missing, proxy backends that aren't accepting connections,
+ingress turned on with nothing to serve, and ports claimed by both web
+handlers and TCP forwards. It prints each problem with a hint on how to fix
+it, and fails if it finds any.
+`),
+			},
+			{
+				Name:       "list",
+				Exec:       e.runServeList,
+				ShortUsage: "list",
+				ShortHelp:  "print one tab-separated line per handler, for scripts",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve list" prints the serve config as tab-separated lines:
+
+  https   <host:port>  <mount-point>  {proxy|path|text|redirect}  <target>
+  http    <host:port>  <mount-point>  {proxy|path|text|redirect}  <target>
+  tcp     <port>       forward        <address>                   [<tls-name>]
+  udp     <port>       forward        <address>
+  ingress <host:port>  on             [<expiry>]
+`),
+			},
+			{
+				Name:       "share-link",
+				Exec:       e.runServeShareLink,
+				ShortUsage: "share-link [<mount-point>]",
+				ShortHelp:  "print the URL to share for a web handler",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve share-link" prints the URL of the handler at the given
+mount point, or of the root of the web server, on this node; use "serve -http
+share-link" for the plaintext HTTP server. The URL only works outside the
+tailnet if ingress is on for it; a warning says so if not.
+`),
 			},
 			{
-				Name:      "tcp",
-				Exec:      e.runServeTCP,
-				ShortHelp: "add or remove a TCP port forward",
+				Name:       "tcp",
+				Exec:       e.retryIfChanged(e.runServeTCP),
+				ShortUsage: "tcp [flags] <port>\n  tcp [flags] <lo>-<hi>\n  tcp [flags] -forward-to <host:port>\n  tcp off {<port>|<lo>-<hi>}\n  tcp [show]",
+				ShortHelp:  "add, remove, or list TCP port forwards",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve tcp <port>" forwards TCP connections arriving on port 443
+of this node's Tailscale IPs to <port> on -target-host, 127.0.0.1 by
+default. To forward to an exact address instead, such as a backend bound
+to a LAN IP, give it with -forward-to in place of <port> and -target-host.
+
+A range of up to 100 ports, like 50000-50010, forwards each port in it to
+the same port on -target-host, for services such as passive FTP that use
+several ports.
+
+With -udp-too, each port also forwards UDP datagrams to the same target, as
+"tailscale serve udp" does. Remove them with "tailscale serve udp off".
+
+With -proxy-protocol, the backend is sent a PROXY protocol header at the
+start of each connection, so that it sees the client's Tailscale address
+instead of tailscaled's. The backend must expect the header.
+`),
 				FlagSet: e.newFlags("serve-tcp", func(fs *flag.FlagSet) {
-					fs.BoolVar(&e.terminateTLS, "terminate-tls", false, "terminate TLS before forwarding TCP connection")
+					fs.Var(&e.terminateTLS, "terminate-tls", "terminate TLS before forwarding TCP connection; use -terminate-tls=<name> to use a cert name other than this node's")
+					fs.BoolVar(&e.validateOnly, "validate-only", false, "run all checks for the change, then exit without saving")
+					fs.BoolVar(&e.probe, "probe", false, "check that the forward target accepts connections before saving")
+					fs.StringVar(&e.targetHost, "target-host", "", "host or IP address to forward TCP connections to; defaults to 127.0.0.1")
+					fs.StringVar(&e.forwardTo, "forward-to", "", "address to forward TCP connections to, as host:port, instead of <port> on -target-host")
+					fs.StringVar(&e.label, "label", "", "a description of what the forward is for, shown by \"serve list\" and \"serve show-config\"")
+					fs.BoolVar(&e.udpToo, "udp-too", false, "also forward UDP datagrams arriving on the same ports to the same targets, for services like DNS that use both")
+					fs.IntVar(&e.proxyProtocol, "proxy-protocol", 0, "send the backend a PROXY protocol header of this version, 1 or 2, with the client's address at the start of each connection")
 				}),
 			},
 			{
-				Name:      "ingress",
-				Exec:      e.runServeIngress,
-				ShortHelp: "enable or disable ingress",
-				FlagSet:   e.newFlags("serve-ingress", func(fs *flag.FlagSet) {}),
+				Name:       "udp",
+				Exec:       e.retryIfChanged(e.runServeUDP),
+				ShortUsage: "udp [flags] <port>\n  udp off <port>",
+				ShortHelp:  "add or remove UDP port forwards",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve udp <port>" forwards UDP datagrams arriving on <port> of
+this node's Tailscale IPs to the same port on -target-host. Unlike "serve
+tcp", which always listens on 443, the listening port is <port> itself.
+`),
+				FlagSet: e.newFlags("serve-udp", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.validateOnly, "validate-only", false, "run all checks for the change, then exit without saving")
+					fs.StringVar(&e.targetHost, "target-host", "", "host or IP address to forward UDP datagrams to; defaults to 127.0.0.1")
+				}),
+			},
+			{
+				Name: "ingress",
+				Exec: e.retryIfChanged(func(ctx context.Context, args []string) error {
+					return e.runServeIngress(ctx, ingressFlags, args)
+				}),
+				ShortUsage: "ingress [flags] {on|off|status} [flags]",
+				ShortHelp:  "enable, disable, or check ingress",
+				LongHelp: strings.TrimSpace(`
+"tailscale serve ingress on" allows the web server on port 443 (or 80, with
+-http) to be reached from the public internet with Funnel. "off" disallows
+it again.
+
+"tailscale serve ingress status" reports whether ingress is on, and if so
+whether it's active: the tailnet must have granted this node the ingress
+capability, and the ingress must not have expired or be left with nothing
+to serve.
+`),
+				FlagSet: ingressFlags,
 			},
 		},
 	}
+	setServeExitCodes(cmd)
+	return cmd
+}
+
+// Exit codes of the serve commands, for scripts. Any other failure exits 1.
+const (
+	serveExitInvalid  = 2 // invalid arguments or config
+	serveExitNoDaemon = 3 // couldn't connect to tailscaled
+	serveExitNoChange = 4 // -must-change was given, but nothing changed
+	serveExitNoConfig = 5 // show-config, list, status, or backup found no serve config
+	serveExitChanged  = 6 // the serve config kept changing underneath us
+)
+
+// setServeExitCodes wraps the Exec funcs of cmd and its subcommands so
+// that usage errors (flag.ErrHelp) exit with serveExitInvalid. Other
+// errors are tagged with their exit codes where they're returned; see
+// serveInvalid and daemonError.
+func setServeExitCodes(cmd *ffcli.Command) {
+	if exec := cmd.Exec; exec != nil {
+		cmd.Exec = func(ctx context.Context, args []string) error {
+			err := exec(ctx, args)
+			if errors.Is(err, flag.ErrHelp) && ExitCode(err) == 1 {
+				return &exitCodeError{serveExitInvalid, err}
+			}
+			return err
+		}
+	}
+	for _, sub := range cmd.Subcommands {
+		setServeExitCodes(sub)
+	}
+}
+
+// serveInvalid tags err, a problem with the user's arguments or config,
+// to exit with serveExitInvalid. It returns nil if err is nil.
+func serveInvalid(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitCodeError{serveExitInvalid, err}
+}
+
+// daemonError tags err, as returned by a LocalAPI call, to exit with
+// serveExitNoDaemon if it's a failure to connect to tailscaled.
+func daemonError(err error) error {
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return &exitCodeError{serveExitNoDaemon, err}
+	}
+	return err
+}
+
+// maxServeConfigAttempts is how many times retryIfChanged runs a command
+// whose save keeps failing because the serve config changed after it was
+// read.
+const maxServeConfigAttempts = 3
+
+// retryIfChanged wraps exec, a command that reads, modifies, and saves the
+// serve config, to run it again from the start if its save fails because
+// another client changed the config in the meantime.
+//
+// Commands that consume stdin can't be rerun, so aren't wrapped.
+func (e *serveEnv) retryIfChanged(exec func(context.Context, []string) error) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		for attempt := 1; ; attempt++ {
+			err := exec(ctx, args)
+			if !errors.Is(err, tailscale.ErrServeConfigChanged) {
+				return err
+			}
+			if attempt == maxServeConfigAttempts {
+				return fmt.Errorf("%w; gave up after %d attempts", err, attempt)
+			}
+			e.verbosef("serve config changed while updating it; retrying")
+		}
+	}
+}
+
+// errNoChange is returned, with exit status serveExitNoChange, by commands
+// run with -must-change that would leave the serve config as it is.
+var errNoChange = errors.New("nothing to change: the serve config already has the requested state")
+
+// errNoServeConfig is returned, with exit status serveExitNoConfig, by the
+// commands that print the serve config when none is set.
+var errNoServeConfig = errors.New("no serve config is set")
+
+// noChange returns the error for a command that found nothing to change:
+// nil, unless -must-change was given.
+func (e *serveEnv) noChange() error {
+	e.verbosef("new serve config is the same as the current one; not saving")
+	if e.dryRunDiff {
+		fmt.Fprintln(e.stdout(), "No changes.")
+	}
+	if !e.mustChange {
+		return nil
+	}
+	return &exitCodeError{serveExitNoChange, errNoChange}
 }
 
 // serveEnv is the environment the serve command runs within. All I/O should be
@@ -58,13 +589,78 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
 // It also contains the flags, as registered with newServeCommand.
 type serveEnv struct {
 	// flags
-	terminateTLS bool
+	terminateTLS      terminateTLSFlag
+	label             string // Comment for the handler or TCP forward
+	maintenanceWindow string // "Sat 02:00-04:00"
+	rateLimit         string // for proxy and path; "10/s"
+	allowOffline      bool   // don't require the node to be running
+	hstsMaxAge        int    // seconds; 0 means no HSTS header
+	statusCode        int    // for text; 0 means 200
+	http              bool   // use plaintext HTTP on port 80 instead of HTTPS on 443
+	port              int    // web port; 0 means the default (see webPort)
+	noHTTPS           bool   // use plaintext HTTP on the web port, for TLS terminated upstream
+	compress          bool
+	socket            string        // tailscaled socket; "" means the CLI's default
+	timeout           time.Duration // for each LocalAPI call; 0 means none
+
+	lc                *tailscale.LocalClient // lazily set by localClient
+	etag              string                 // of the config last fetched by getServeConfig
+	hstsSubdomains    bool
+	baseDir           string // for path; "" means the current directory
+	allowRoot         string // for path; "" means anywhere
+	sticky            string // "", "cookie", or "ip"
+	encryptSecrets    bool
+	bodyReplace       bodyReplaceFlag
+	decodeUpstream    setBoolFlag
+	followRedirects   setBoolFlag // for proxy
+	requireClientCert setBoolFlag
+	clientCA          string // PEM file of CAs for -require-client-cert
+	targetsFile       string // for proxy; resolves @name targets
+	validateOnly      bool   // run checks but don't save
+	verbose           bool   // log each step to stderr
+	probe             bool   // dial the backend before saving
+	statusFormat      string // "" or "wide"
+	file              string // for apply; "-" means stdin
+	split             bool   // for export
+	dir               string // for export -split and import
+	importFormat      string // for import -f; "caddyfile"
+	restoreDryRun     bool   // for restore
+	watch             bool   // for show-config
+	watchInterval     time.Duration
+	showMount         string // for show-config; "" means all
+	showSecrets       bool   // for show-config; don't redact secrets
+	resolvePaths      bool   // for show-config; stat path handlers' files
+	ndjson            bool   // for show-config; a line per handler
+	authUser          string // for rotate-auth
+	targetHost        string // for tcp and udp; host to forward to
+	forwardTo         string // for tcp; host:port to forward to
+	udpToo            bool   // for tcp; add matching UDP forwards
+	proxyProtocol     int    // for tcp; PROXY protocol version, 0 for none
+	ingressExpire     time.Duration
+	force             bool       // don't ask before replacing a handler
+	appendPath        bool       // for path; add to the existing handler's ExtraPaths
+	spa               bool       // for path; fall back to index.html
+	expandEnv         bool       // expand env vars in proxy and path arguments
+	mustChange        bool       // make no-op mutations an error
+	outputURL         bool       // print the URLs of the mount points changed
+	maxBody           string     // for proxy; like "10MB"
+	cacheMaxAge       setIntFlag // for path; seconds
+	onChange          string     // program to run after saving
+	expectTailnet     string     // tailnet name that mutations must apply to
+	dryRunDiff        bool       // print the change instead of saving it
+	onChangeTimeout   time.Duration
 
 	// optional stuff for tests:
-	testFlagOut        io.Writer
-	testGetServeConfig func(context.Context) (*ipn.ServeConfig, error)
-	testSetServeConfig func(context.Context, *ipn.ServeConfig) error
-	testStdout         io.Writer
+	testFlagOut              io.Writer
+	testGetServeConfig       func(context.Context) (*ipn.ServeConfig, error)
+	testSetServeConfig       func(context.Context, *ipn.ServeConfig) error
+	testGetLocalClientStatus func(context.Context) (*ipnstate.Status, error)
+	testStdout               io.Writer
+	testStderr               io.Writer
+	testNow                  func() time.Time
+	testGetPeerServeConfig   func(_ context.Context, peer string) (*ipn.ServeConfig, error)
+	testStdin                io.Reader
+	testStdinIsTerminal      bool // with testStdin, whether to treat it as a terminal
 }
 
 func (e *serveEnv) newFlags(name string, setup func(fs *flag.FlagSet)) *flag.FlagSet {
@@ -80,90 +676,4347 @@ func (e *serveEnv) newFlags(name string, setup func(fs *flag.FlagSet)) *flag.Fla
 	return fs
 }
 
+// localClient returns the client for talking to tailscaled: the CLI's
+// default one, or one for -socket if that was given.
+func (e *serveEnv) localClient() *tailscale.LocalClient {
+	if e.lc != nil {
+		return e.lc
+	}
+	if e.socket == "" {
+		return &localClient
+	}
+	e.lc = &tailscale.LocalClient{Socket: e.socket, UseSocketOnly: true}
+	return e.lc
+}
+
+// defaultServeTimeout is the default -timeout.
+const defaultServeTimeout = 10 * time.Second
+
+// withTimeout calls f, which makes a LocalAPI request described by what,
+// with ctx limited by -timeout. If the limit is hit, the error says so
+// and exits with serveExitNoDaemon, rather than leaving the caller to
+// make sense of a canceled request.
+func (e *serveEnv) withTimeout(ctx context.Context, what string, f func(context.Context) error) error {
+	if e.timeout <= 0 {
+		return f(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	err := f(callCtx)
+	if err != nil && callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &exitCodeError{serveExitNoDaemon, fmt.Errorf("timed out after %v %s; tailscaled may be stuck (see -timeout)", e.timeout, what)}
+	}
+	return err
+}
+
 func (e *serveEnv) getServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
-	if e.testGetServeConfig != nil {
-		return e.testGetServeConfig(ctx)
+	var sc *ipn.ServeConfig
+	err := e.withTimeout(ctx, "getting the serve config", func(ctx context.Context) (err error) {
+		if e.testGetServeConfig != nil {
+			sc, err = e.testGetServeConfig(ctx)
+			return err
+		}
+		sc, e.etag, err = e.localClient().GetServeConfigWithETag(ctx)
+		return daemonError(err)
+	})
+	if err != nil {
+		e.verbosef("fetching current serve config failed: %v", err)
+		return nil, err
 	}
-	return localClient.GetServeConfig(ctx)
+	e.verbosef("fetched current serve config: %s", verboseConfig(sc))
+	return sc, nil
 }
 
 func (e *serveEnv) setServeConfig(ctx context.Context, c *ipn.ServeConfig) error {
-	if e.testSetServeConfig != nil {
-		return e.testSetServeConfig(ctx, c)
+	e.verbosef("computed new serve config: %s", verboseConfig(c))
+	if e.dryRunDiff {
+		e.verbosef("-dry-run-diff given; not saving")
+		return e.printDryRunDiff(ctx, c)
+	}
+	if err := e.checkTailnet(ctx); err != nil {
+		return err
+	}
+	err := e.withTimeout(ctx, "saving the serve config", func(ctx context.Context) error {
+		if e.testSetServeConfig != nil {
+			return e.testSetServeConfig(ctx, c)
+		}
+		// Only replace the config getServeConfig returned, so a change
+		// made by someone else in the meantime isn't lost.
+		err := daemonError(e.localClient().SetServeConfigIfMatch(ctx, c, e.etag))
+		if errors.Is(err, tailscale.ErrServeConfigChanged) {
+			err = &exitCodeError{serveExitChanged, err}
+		}
+		return err
+	})
+	if err != nil {
+		e.verbosef("saving serve config failed: %v", err)
+		return err
+	}
+	e.verbosef("saved serve config")
+	if e.onChange != "" {
+		if err := e.runOnChange(ctx, c); err != nil {
+			fmt.Fprintf(e.stderr(), "Warning: serve config saved, but -on-change failed: %v\n", err)
+		}
 	}
-	return localClient.SetServeConfig(ctx, c)
+	return nil
 }
 
-func (e *serveEnv) stdout() io.Writer {
-	if e.testStdout != nil {
-		return e.testStdout
+// printDryRunDiff prints, for -dry-run-diff, how saving c would change the
+// current serve config.
+func (e *serveEnv) printDryRunDiff(ctx context.Context, c *ipn.ServeConfig) error {
+	cur, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
 	}
-	return os.Stdout
+	lines := diffServeConfigs(cur, c)
+	if len(lines) == 0 {
+		fmt.Fprintln(e.stdout(), "No changes.")
+		return nil
+	}
+	fmt.Fprintln(e.stdout(), strings.Join(lines, "\n"))
+	fmt.Fprintln(e.stdout(), "Dry run; not saving.")
+	return nil
 }
 
-func (e *serveEnv) runServe(ctx context.Context, args []string) error {
-	// Undocumented debug command (not using ffcli subcommands) to set raw
-	// configs from stdin for now (2022-11-13).
-	if len(args) == 1 && args[0] == "set-raw" {
-		valb, err := io.ReadAll(os.Stdin)
-		if err != nil {
+// checkTailnet reports, on stderr, which tailnet a change is about to be
+// saved to, and fails if that isn't the one named by -expect-tailnet.
+// Without -expect-tailnet, failing to look up the tailnet isn't an error;
+// the save reports any problem reaching tailscaled.
+func (e *serveEnv) checkTailnet(ctx context.Context) error {
+	var st *ipnstate.Status
+	err := e.withTimeout(ctx, "getting the current tailnet", func(ctx context.Context) (err error) {
+		if e.testGetLocalClientStatus != nil {
+			st, err = e.testGetLocalClientStatus(ctx)
 			return err
 		}
-		sc := new(ipn.ServeConfig)
-		if err := json.Unmarshal(valb, sc); err != nil {
-			return fmt.Errorf("invalid JSON: %w", err)
+		st, err = e.localClient().StatusWithoutPeers(ctx)
+		return daemonError(err)
+	})
+	if err != nil {
+		if e.expectTailnet == "" {
+			return nil
+		}
+		return fmt.Errorf("checking -expect-tailnet: %w", err)
+	}
+	var name string
+	if st.CurrentTailnet != nil {
+		name = st.CurrentTailnet.Name
+	}
+	if e.expectTailnet != "" && name != e.expectTailnet {
+		if name == "" {
+			return fmt.Errorf("not saving: -expect-tailnet is %q, but the current tailnet is unknown", e.expectTailnet)
 		}
-		return localClient.SetServeConfig(ctx, sc)
+		return fmt.Errorf("not saving: this node is on tailnet %q, not %q", name, e.expectTailnet)
+	}
+	if name != "" {
+		fmt.Fprintf(e.stderr(), "Changing the serve config for tailnet %q.\n", name)
 	}
-	panic("TODO")
+	return nil
 }
 
-func (e *serveEnv) runServeShowConfig(ctx context.Context, args []string) error {
-	sc, err := e.getServeConfig(ctx)
+// runOnChange runs the -on-change program with the saved config c as
+// JSON on its stdin. Its output goes to stderr, so that it doesn't mix
+// with anything the serve command prints.
+func (e *serveEnv) runOnChange(ctx context.Context, c *ipn.ServeConfig) error {
+	if c == nil {
+		c = new(ipn.ServeConfig)
+	}
+	j, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		return err
 	}
-	j, err := json.MarshalIndent(sc, "", "  ")
+	if e.onChangeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.onChangeTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, e.onChange)
+	cmd.Stdin = bytes.NewReader(append(j, '\n'))
+	cmd.Stdout = e.stderr()
+	cmd.Stderr = e.stderr()
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s: timed out after %v", e.onChange, e.onChangeTimeout)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %w", e.onChange, err)
 	}
-	j = append(j, '\n')
-	e.stdout().Write(j)
 	return nil
 }
 
-func (e *serveEnv) runServeTCP(ctx context.Context, args []string) error {
-	panic("TODO")
+func (e *serveEnv) getPeerServeConfig(ctx context.Context, peer string) (*ipn.ServeConfig, error) {
+	var sc *ipn.ServeConfig
+	err := e.withTimeout(ctx, "getting the serve config of "+peer, func(ctx context.Context) (err error) {
+		if e.testGetPeerServeConfig != nil {
+			sc, err = e.testGetPeerServeConfig(ctx, peer)
+			return err
+		}
+		sc, err = e.localClient().GetPeerServeConfig(ctx, peer)
+		return daemonError(err)
+	})
+	return sc, err
 }
 
-func (e *serveEnv) runServeIngress(ctx context.Context, args []string) error {
-	if len(args) != 1 {
-		return flag.ErrHelp
+func (e *serveEnv) getSelfDNSName(ctx context.Context) (string, error) {
+	st, err := e.getLocalClientStatus(ctx)
+	if err != nil {
+		return "", fmt.Errorf("getting client status: %w", err)
 	}
-	var on bool
-	switch args[0] {
-	case "on", "off":
-		on = args[0] == "on"
-	default:
-		return flag.ErrHelp
+	if st.Self.DNSName == "" {
+		// Only possible with -allow-offline.
+		return "", errors.New("this node has no DNS name yet, so web handlers can't be set up while it's offline; log in first")
 	}
-	sc, err := e.getServeConfig(ctx)
+	return strings.TrimSuffix(st.Self.DNSName, "."), nil
+}
+
+// notRunningError is returned by getLocalClientStatus if the node isn't
+// running or starting. Its message describes the node's state, like
+// "Tailscale is stopped.".
+type notRunningError struct {
+	description string
+}
+
+func (e notRunningError) Error() string { return e.description }
+
+// getLocalClientStatus returns the status of this node, which must be
+// running or starting unless -allow-offline was given.
+func (e *serveEnv) getLocalClientStatus(ctx context.Context) (*ipnstate.Status, error) {
+	var st *ipnstate.Status
+	err := e.withTimeout(ctx, "getting this node's status", func(ctx context.Context) (err error) {
+		if e.testGetLocalClientStatus != nil {
+			st, err = e.testGetLocalClientStatus(ctx)
+			return err
+		}
+		if st, err = e.localClient().Status(ctx); err != nil {
+			return &exitCodeError{serveExitNoDaemon, fixTailscaledConnectError(err)}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var key ipn.HostPort = "foo:123" // TODO(bradfitz,shayne): fix
-	if on && sc != nil && sc.AllowIngress[key] ||
-		!on && (sc == nil || !sc.AllowIngress[key]) {
-		// Nothing to do.
-		return nil
+	if description, ok := isRunningOrStarting(st); !ok && !e.allowOffline {
+		return nil, notRunningError{description}
+	}
+	if st.Self == nil {
+		if e.allowOffline {
+			// A node that has never logged in has no self node.
+			st.Self = new(ipnstate.PeerStatus)
+			return st, nil
+		}
+		return nil, errors.New("no self node")
+	}
+	return st, nil
+}
+
+// checkSelfCapability returns an error if the node doesn't have the
+// capability c.
+func (e *serveEnv) checkSelfCapability(ctx context.Context, c string) error {
+	st, err := e.getLocalClientStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("getting client status: %w", err)
+	}
+	for _, have := range st.Self.Capabilities {
+		if have == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("this node does not support %s", c)
+}
+
+func (e *serveEnv) stdout() io.Writer {
+	if e.testStdout != nil {
+		return e.testStdout
+	}
+	return os.Stdout
+}
+
+// verbosef logs, with -v, a step the command takes, to stderr.
+func (e *serveEnv) verbosef(format string, args ...any) {
+	if e.verbose {
+		fmt.Fprintf(e.stderr(), "serve: "+format+"\n", args...)
 	}
+}
+
+// verboseConfig returns sc as one line of JSON for verbosef, with secrets
+// redacted, or "none" if sc is nil.
+func verboseConfig(sc *ipn.ServeConfig) string {
 	if sc == nil {
-		sc = &ipn.ServeConfig{}
+		return "none"
 	}
-	if on {
-		mak.Set(&sc.AllowIngress, "foo:123", true)
+	j, err := json.Marshal(redactServeConfig(sc))
+	if err != nil {
+		return err.Error()
+	}
+	return string(j)
+}
+
+func (e *serveEnv) stderr() io.Writer {
+	if e.testStderr != nil {
+		return e.testStderr
+	}
+	return Stderr
+}
+
+func (e *serveEnv) now() time.Time {
+	if e.testNow != nil {
+		return e.testNow()
+	}
+	return time.Now()
+}
+
+func (e *serveEnv) stdin() io.Reader {
+	if e.testStdin != nil {
+		return e.testStdin
+	}
+	return os.Stdin
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal that
+// the user can answer prompts on.
+func (e *serveEnv) stdinIsTerminal() bool {
+	if e.testStdin != nil {
+		return e.testStdinIsTerminal
+	}
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// confirmReplace asks the user whether to replace old, the handler
+// currently at mount point mp, with h. It doesn't ask, and reports true,
+// if stdin isn't a terminal.
+func (e *serveEnv) confirmReplace(mp string, old, h *ipn.HTTPHandler) bool {
+	if !e.stdinIsTerminal() {
+		return true
+	}
+	fmt.Fprintf(e.stderr(), "%s is already serving %s; overwrite with %s? [y/N] ", mp, handlerType(old), handlerType(h))
+	answer, _ := bufio.NewReader(e.stdin()).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// handlerType returns the serve type of h: "proxy", "path", "redirect", or
+// "text". Named files are "path" handlers too.
+func handlerType(h *ipn.HTTPHandler) string {
+	switch {
+	case h.Proxy != "":
+		return "proxy"
+	case h.Path != "" || len(h.Files) > 0:
+		return "path"
+	case h.Redirect != "":
+		return "redirect"
+	}
+	return "text"
+}
+
+// handlerArg returns the argument that h was made with, for its
+// handlerType: the proxy target, path, named files, redirect target, or
+// quoted text.
+func handlerArg(h *ipn.HTTPHandler) string {
+	switch {
+	case h.Proxy != "":
+		return h.Proxy
+	case h.Path != "":
+		return h.Path
+	case len(h.Files) > 0:
+		return namedFilesArg(h.Files)
+	case h.Redirect != "":
+		return h.Redirect
+	}
+	return strconv.Quote(h.Text)
+}
+
+// maxTextFileSize is the largest file that "text @file" will read. The text
+// is stored in the serve config, so it's meant for small pages.
+const maxTextFileSize = 64 << 10
+
+// readTextArg returns the text for a text handler argument. An argument of
+// "@file" means the contents of that file, up to maxTextFileSize bytes,
+// and a leading "@@" stands for a literal "@".
+func readTextArg(arg string) (string, error) {
+	if strings.HasPrefix(arg, "@@") || !strings.HasPrefix(arg, "@") {
+		return strings.TrimPrefix(arg, "@"), nil
+	}
+	name := arg[1:]
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("reading text from file: %w", err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, maxTextFileSize+1))
+	if err != nil {
+		return "", fmt.Errorf("reading text from file: %w", err)
+	}
+	if len(b) > maxTextFileSize {
+		return "", fmt.Errorf("text file %s is larger than %d KiB; use a path handler instead", name, maxTextFileSize>>10)
+	}
+	if len(b) == 0 {
+		return "", fmt.Errorf("text file %s is empty", name)
+	}
+	return string(b), nil
+}
+
+// isServeType reports whether a is one of the handler types that follow
+// the mount points in "tailscale serve" arguments.
+func isServeType(a string) bool {
+	return a == "proxy" || a == "path" || a == "text" || a == "redirect"
+}
+
+// isNamedFileArg reports whether a is a "name=file" argument of a path
+// handler, serving file under name. The name can't contain a slash, which
+// keeps plain paths with an "=" in them unambiguous.
+func isNamedFileArg(a string) bool {
+	name, _, ok := strings.Cut(a, "=")
+	return ok && name != "" && !strings.ContainsAny(name, `/\`)
+}
+
+// validateFileName returns an error if name can't be a file name in a
+// path handler's Files.
+func validateFileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// namedFilesArg returns files as the "name=file" arguments that set them,
+// in name order.
+func namedFilesArg(files map[string]string) string {
+	var args []string
+	for _, name := range sortedKeys(files, nil) {
+		args = append(args, name+"="+files[name])
+	}
+	return strings.Join(args, " ")
+}
+
+// parseServeArgs parses the "<mount-point>... {proxy|path|text|redirect} <arg>"
+// arguments of runServe and the flags that apply to the handler, without
+// talking to tailscaled. It returns the mount points in the order given,
+// without duplicates. A path handler may instead take several
+// "name=file" arguments, serving those files as a directory.
+func (e *serveEnv) parseServeArgs(args []string) (mps []string, h *ipn.HTTPHandler, err error) {
+	// The mount points are everything before the type.
+	i := slices.IndexFunc(args, isServeType)
+	if i < 0 && len(args) == 3 {
+		fmt.Fprintf(e.stderr(), "error: unknown serve type %q\n\n", args[1])
+		return nil, nil, flag.ErrHelp
+	}
+	if i < 1 || len(args) < i+2 || len(args) > i+2 && !(args[i] == "path" && isNamedFileArg(args[i+1])) {
+		fmt.Fprintf(e.stderr(), "error: invalid number of arguments\n\n")
+		return nil, nil, flag.ErrHelp
+	}
+	typ, rawArg := args[i], args[i+1]
+	for _, m := range args[:i] {
+		mp, err := cleanMountPoint(m)
+		if err != nil {
+			return nil, nil, err
+		}
+		mps = append(mps, mp)
+	}
+
+	arg := rawArg
+	if e.expandEnv && (typ == "path" || typ == "proxy" || typ == "redirect") {
+		arg = os.ExpandEnv(arg)
+		if arg == "" {
+			return nil, nil, fmt.Errorf("%s argument %q expanded to the empty string", typ, rawArg)
+		}
+	}
+
+	h = new(ipn.HTTPHandler)
+	switch {
+	case typ == "path" && isNamedFileArg(rawArg):
+		if e.appendPath {
+			return nil, nil, errors.New("-append is not valid with name=file arguments")
+		}
+		h.Files, err = e.parseNamedFiles(args[i+1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, mp := range mps {
+			if !strings.HasSuffix(mp, "/") {
+				mps[i] = mp + "/"
+			}
+		}
+	case typ == "path":
+		p, err := resolveServePath(e.baseDir, arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			fmt.Fprintf(e.stderr(), "error: invalid path: %v\n\n", err)
+			return nil, nil, flag.ErrHelp
+		}
+		if err := checkAllowRoot(e.allowRoot, p); err != nil {
+			return nil, nil, err
+		}
+		if w := pathReadWarning(p, fi); w != "" {
+			fmt.Fprintf(e.stderr(), "Warning: %s\n", w)
+		}
+		if e.appendPath && !fi.IsDir() {
+			return nil, nil, errors.New("-append requires a directory")
+		}
+		if e.spa && !fi.IsDir() {
+			return nil, nil, errors.New("-spa requires a directory")
+		}
+		if format := archiveFormat(p); format != "" && fi.Mode().IsRegular() {
+			if err := checkArchive(p, format); err != nil {
+				return nil, nil, err
+			}
+			h.Archive = format
+		}
+		if fi.IsDir() || h.Archive != "" {
+			// Directory mount points must end in a slash
+			// for relative file links to work.
+			for i, mp := range mps {
+				if !strings.HasSuffix(mp, "/") {
+					mps[i] = mp + "/"
+				}
+			}
+		}
+		h.Path = p
+	case typ == "proxy":
+		// Multiple comma-separated targets balance across backends.
+		for i, target := range strings.Split(arg, ",") {
+			t, err := e.resolveProxyTarget(target)
+			if err != nil {
+				return nil, nil, err
+			}
+			if i == 0 {
+				h.Proxy = t
+			} else {
+				h.ExtraProxies = append(h.ExtraProxies, t)
+			}
+		}
+	case typ == "text":
+		h.Text, err = readTextArg(rawArg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if e.statusCode != 0 {
+			if err := validateStatusCode(e.statusCode); err != nil {
+				return nil, nil, err
+			}
+			h.StatusCode = e.statusCode
+		}
+	case typ == "redirect":
+		if err := validateRedirectTarget(arg); err != nil {
+			return nil, nil, err
+		}
+		h.Redirect = arg
+		if e.statusCode != 0 {
+			if err := validateRedirectStatus(e.statusCode); err != nil {
+				return nil, nil, err
+			}
+			h.StatusCode = e.statusCode
+		}
+	}
+	if e.statusCode != 0 && h.Text == "" && h.Redirect == "" {
+		return nil, nil, errors.New("-status is only valid for text and redirect handlers")
+	}
+	if e.appendPath && h.Path == "" {
+		return nil, nil, errors.New("-append is only valid for path handlers")
+	}
+	if e.spa && h.Path == "" {
+		return nil, nil, errors.New("-spa is only valid for path directory handlers")
+	}
+	h.SPAFallback = e.spa
+	h.Comment = e.label
+	if e.sticky != "" {
+		if err := validateStickySessions(e.sticky); err != nil {
+			return nil, nil, err
+		}
+		if len(h.ExtraProxies) == 0 {
+			return nil, nil, errors.New("-sticky requires multiple comma-separated proxy backends")
+		}
+		h.StickySessions = e.sticky
+	}
+	if len(e.bodyReplace) > 0 || e.decodeUpstream.v {
+		if h.Proxy == "" {
+			return nil, nil, errors.New("-body-replace and -decode-upstream are only valid for proxy handlers")
+		}
+	}
+	if len(e.bodyReplace) > 0 {
+		h.BodyReplace = e.bodyReplace
+		// Rewriting gzipped bodies requires decoding them, so imply
+		// -decode-upstream unless it was explicitly turned off.
+		h.DecodeUpstream = true
+	}
+	if e.decodeUpstream.set {
+		h.DecodeUpstream = e.decodeUpstream.v
+	}
+	if e.followRedirects.set {
+		if h.Proxy == "" {
+			return nil, nil, errors.New("-follow-redirects is only valid for proxy handlers")
+		}
+		follow := e.followRedirects.v
+		h.FollowRedirects = &follow
+	}
+	if e.cacheMaxAge.set {
+		if h.Path == "" && len(h.Files) == 0 {
+			return nil, nil, errors.New("-cache-max-age is only valid for path handlers")
+		}
+		if e.cacheMaxAge.v < 0 {
+			return nil, nil, fmt.Errorf("invalid -cache-max-age %d: must not be negative", e.cacheMaxAge.v)
+		}
+		age := e.cacheMaxAge.v
+		h.CacheMaxAge = &age
+	}
+	if e.maxBody != "" {
+		if h.Proxy == "" {
+			return nil, nil, errors.New("-max-body is only valid for proxy handlers")
+		}
+		n, err := parseByteSize(e.maxBody)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid -max-body: %w", err)
+		}
+		h.MaxRequestBytes = n
+	}
+	if e.hstsMaxAge < 0 {
+		return nil, nil, fmt.Errorf("invalid -hsts %d: must not be negative", e.hstsMaxAge)
+	}
+	if e.hstsMaxAge > 0 && (e.http || e.noHTTPS) {
+		return nil, nil, errors.New("-hsts has no effect over plaintext HTTP")
+	}
+	if e.hstsSubdomains && e.hstsMaxAge == 0 {
+		return nil, nil, errors.New("-hsts-subdomains requires -hsts")
+	}
+	h.HSTSMaxAge = e.hstsMaxAge
+	h.Compress = e.compress
+	h.HSTSIncludeSubdomains = e.hstsSubdomains
+	if e.maintenanceWindow != "" {
+		mw, err := parseMaintenanceWindow(e.maintenanceWindow)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.MaintenanceWindow = mw
+	}
+	if e.rateLimit != "" {
+		if h.Proxy == "" && h.Path == "" {
+			return nil, nil, errors.New("-rate-limit is only valid for proxy and path handlers")
+		}
+		rl, err := parseRateLimit(e.rateLimit)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.RateLimit = rl
+	}
+
+	mps, err = dedupMountPoints(mps)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mps, h, nil
+}
+
+// parseNamedFiles parses the "name=file" arguments of a path handler into
+// its Files. Each file must be a regular file.
+func (e *serveEnv) parseNamedFiles(args []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, a := range args {
+		if !isNamedFileArg(a) {
+			return nil, fmt.Errorf("invalid argument %q: all path arguments must be name=file when serving several files", a)
+		}
+		name, raw, _ := strings.Cut(a, "=")
+		if err := validateFileName(name); err != nil {
+			return nil, err
+		}
+		if _, dup := files[name]; dup {
+			return nil, fmt.Errorf("file name %q given more than once", name)
+		}
+		file := raw
+		if e.expandEnv {
+			file = os.ExpandEnv(file)
+		}
+		if file == "" {
+			return nil, fmt.Errorf("no file given for %q", name)
+		}
+		p, err := resolveServePath(e.baseDir, file)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file for %q: %w", name, err)
+		}
+		if err := checkAllowRoot(e.allowRoot, p); err != nil {
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file; serve a directory with a separate path handler", p)
+		}
+		if w := pathReadWarning(p, fi); w != "" {
+			fmt.Fprintf(e.stderr(), "Warning: %s\n", w)
+		}
+		files[name] = p
+	}
+	return files, nil
+}
+
+// dedupMountPoints returns mps without repeats. Two different mount points
+// that differ only by a trailing slash are an error, as setting one would
+// replace the other; see reconcileMountPoints.
+func dedupMountPoints(mps []string) ([]string, error) {
+	var out []string
+	for _, mp := range mps {
+		if slices.Contains(out, mp) {
+			continue
+		}
+		for _, prev := range out {
+			if strings.TrimSuffix(prev, "/") == strings.TrimSuffix(mp, "/") {
+				return nil, fmt.Errorf("mount points %s and %s conflict; use one or the other", prev, mp)
+			}
+		}
+		out = append(out, mp)
+	}
+	return out, nil
+}
+
+// AddWebHandler sets h as the handler at mount on the web server for
+// hostPort (as made by net.JoinHostPort) in sc, the way "tailscale serve"
+// does, for programs that build serve configs themselves:
+//
+//   - mount is cleaned and checked like a mount point argument;
+//   - a handler at the same mount point with the opposite trailing slash
+//     is removed, as tailscaled treats the two as one; and
+//   - unless the port already serves web, its TCP entry is set to serve
+//     HTTPS. It's an error if the port is used by a TCP forward.
+//
+// It replaces any handler already at mount. h is stored as given, not
+// copied. The caller should check the result with ValidateServeConfig.
+func AddWebHandler(sc *ipn.ServeConfig, hostPort ipn.HostPort, mount string, h *ipn.HTTPHandler) error {
+	if h == nil {
+		return errors.New("nil handler")
+	}
+	_, portStr, err := net.SplitHostPort(string(hostPort))
+	if err != nil {
+		return fmt.Errorf("invalid host:port %q: %w", hostPort, err)
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid host:port %q: %w", hostPort, err)
+	}
+	mp, err := cleanMountPoint(mount)
+	if err != nil {
+		return err
+	}
+	if sc.IsTCPForwardingOnPort(port) {
+		return fmt.Errorf("cannot serve web on port %d: it's used by a TCP forward", port)
+	}
+	if th := sc.TCP[port]; th == nil || !(th.HTTP || th.HTTPS) {
+		mak.Set(&sc.TCP, port, &ipn.TCPPortHandler{HTTPS: true})
+	}
+	if sc.Web[hostPort] == nil {
+		mak.Set(&sc.Web, hostPort, new(ipn.WebServerConfig))
+	}
+	mak.Set(&sc.Web[hostPort].Handlers, mp, h)
+	reconcileMountPoints(sc.Web[hostPort].Handlers, mp)
+	return nil
+}
+
+// RemoveWebHandler removes the handler at mount from the web server for
+// hostPort in sc. If that was the server's last handler, the server is
+// removed too, and so is the TCP entry that served web on its port if no
+// other server is left on the port.
+func RemoveWebHandler(sc *ipn.ServeConfig, hostPort ipn.HostPort, mount string) error {
+	mp, err := cleanMountPoint(mount)
+	if err != nil {
+		return err
+	}
+	wsc := sc.Web[hostPort]
+	if wsc == nil || wsc.Handlers[mp] == nil {
+		return fmt.Errorf("no handler at mount point %q", mp)
+	}
+	delete(wsc.Handlers, mp)
+	if len(wsc.Handlers) > 0 {
+		return nil
+	}
+	delete(sc.Web, hostPort)
+	_, port, err := net.SplitHostPort(string(hostPort))
+	if err != nil {
+		return nil
+	}
+	for hp := range sc.Web {
+		if _, p, err := net.SplitHostPort(string(hp)); err == nil && p == port {
+			return nil
+		}
+	}
+	if p, err := parsePort(port); err == nil {
+		if th := sc.TCP[p]; th != nil && th.TCPForward == "" && (th.HTTP || th.HTTPS) {
+			delete(sc.TCP, p)
+		}
+	}
+	return nil
+}
+
+// ValidateServeConfig returns an error if tailscaled would reject sc or
+// serve it in a way it probably wasn't meant to be, with the same checks
+// that the serve commands run before saving.
+func ValidateServeConfig(sc *ipn.ServeConfig) error {
+	return validateServeConfig(sc)
+}
+
+func (e *serveEnv) runServe(ctx context.Context, args []string) error {
+	// Undocumented alias for "apply -f -", kept for existing scripts.
+	if len(args) == 1 && args[0] == "set-raw" {
+		sc, err := decodeServeConfig(e.stdin())
+		if err != nil {
+			return err
+		}
+		return e.setServeConfig(ctx, sc)
+	}
+	if len(args) >= 2 && args[len(args)-1] == "off" && slices.IndexFunc(args, isServeType) < 0 {
+		return e.removeWebHandlers(ctx, args[:len(args)-1])
+	}
+	if err := e.checkOutputURL(); err != nil {
+		return err
+	}
+	mps, h, err := e.parseServeArgs(args)
+	if err != nil {
+		return serveInvalid(err)
+	}
+
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+
+	if e.encryptSecrets {
+		if err := e.checkSelfCapability(ctx, tailcfg.CapabilityServeEncryptedSecrets); err != nil {
+			return fmt.Errorf("-encrypt-secrets: %w", err)
+		}
+		sc.EncryptedSecrets = true
+	}
+
+	if sc.IsTCPForwardingOnPort(port) {
+		return fmt.Errorf("cannot serve web on port %d: it's already used by a TCP forward (see \"tailscale serve tcp off\"); remove the forward or pick a different port", port)
+	}
+	if err := e.setWebPortHandler(sc, hp, port); err != nil {
+		return err
+	}
+
+	if _, ok := sc.Web[hp]; !ok {
+		mak.Set(&sc.Web, hp, new(ipn.WebServerConfig))
+	}
+	for _, mp := range mps {
+		mh := h.Clone()
+		if e.appendPath {
+			// Layer h's directory beneath the existing handler, keeping the
+			// rest of that handler's settings.
+			old := sc.Web[hp].Handlers[mp]
+			if old == nil || old.Path == "" {
+				return fmt.Errorf("-append requires an existing path handler at %s", mp)
+			}
+			mh = old.Clone()
+			if mh.Path != h.Path && !slices.Contains(mh.ExtraPaths, h.Path) {
+				mh.ExtraPaths = append(mh.ExtraPaths, h.Path)
+			}
+			if h.Comment != "" {
+				mh.Comment = h.Comment
+			}
+		} else if old := sc.Web[hp].Handlers[mp]; old != nil && !e.force && !reflect.DeepEqual(old, mh) {
+			if !e.confirmReplace(mp, old, mh) {
+				return fmt.Errorf("not replacing the handler at %s; use -force to replace it without asking", mp)
+			}
+		}
+		if err := AddWebHandler(sc, hp, mp, mh); err != nil {
+			return err
+		}
+	}
+	if err := e.applyClientCertFlags(sc.Web[hp]); err != nil {
+		return serveInvalid(err)
+	}
+
+	if stop, err := e.checkMutation(sc, proxyBackendAddr(h.Proxy)); stop || err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cursc, sc) {
+		if err := e.noChange(); err != nil {
+			return err
+		}
+	} else if err := e.setServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	e.printServeURLs(sc, dnsName, port, mps)
+	return nil
+}
+
+// applyClientCertFlags sets the client certificate requirement of wsc
+// from -require-client-cert and -client-ca, if given.
+func (e *serveEnv) applyClientCertFlags(wsc *ipn.WebServerConfig) error {
+	if e.clientCA != "" && !e.requireClientCert.v {
+		return errors.New("-client-ca requires -require-client-cert")
+	}
+	if !e.requireClientCert.set {
+		return nil
+	}
+	wsc.RequireClientCert = e.requireClientCert.v
+	wsc.ClientCAs = ""
+	if e.clientCA == "" {
+		return nil
+	}
+	b, err := os.ReadFile(e.clientCA)
+	if err != nil {
+		return fmt.Errorf("reading -client-ca: %w", err)
+	}
+	if err := checkClientCAs(string(b)); err != nil {
+		return fmt.Errorf("-client-ca %s: %w", e.clientCA, err)
+	}
+	wsc.ClientCAs = string(b)
+	return nil
+}
+
+// checkClientCAs returns an error unless caPEM holds at least one
+// PEM-encoded certificate, all of which parse.
+func checkClientCAs(caPEM string) error {
+	rest := []byte(caPEM)
+	var n int
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("invalid CA certificate: %w", err)
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("no PEM-encoded CA certificates found")
+	}
+	return nil
+}
+
+// removeWebHandlers implements "serve <mount-point>... off".
+func (e *serveEnv) removeWebHandlers(ctx context.Context, mounts []string) error {
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone()
+	if sc == nil {
+		return e.noChange()
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+	for _, m := range mounts {
+		if err := RemoveWebHandler(sc, hp, m); err != nil {
+			return serveInvalid(err)
+		}
+	}
+	if stop, err := e.checkMutation(sc, ""); stop || err != nil {
+		return err
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// checkOutputURL rejects -output-url with the flags that don't save a
+// change, so there's no URL to print.
+func (e *serveEnv) checkOutputURL() error {
+	if e.outputURL && (e.dryRunDiff || e.validateOnly) {
+		return serveInvalid(errors.New("-output-url can't be used with -dry-run-diff or -validate-only, which don't save"))
+	}
+	return nil
+}
+
+// printServeURLs prints, with -output-url, the URL of each of mounts on
+// the web server for dnsName and port, one per line.
+func (e *serveEnv) printServeURLs(sc *ipn.ServeConfig, dnsName string, port uint16, mounts []string) {
+	if !e.outputURL {
+		return
+	}
+	scheme := webScheme(sc, webHostPort(dnsName, port))
+	for _, mp := range mounts {
+		fmt.Fprintln(e.stdout(), webURL(scheme, dnsName, port, mp))
+	}
+}
+
+// archiveFormat returns the Archive format of a path handler for file p,
+// by its extension: "zip", "tar.gz", or "" if it's not an archive.
+func archiveFormat(p string) string {
+	lower := strings.ToLower(p)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// checkArchive returns an error if the archive p isn't a readable archive
+// of the given format, so that a broken one is caught before it's served.
+func checkArchive(p, format string) error {
+	switch format {
+	case "zip":
+		zr, err := zip.OpenReader(p)
+		if err != nil {
+			return fmt.Errorf("invalid zip archive %s: %w", p, err)
+		}
+		return zr.Close()
+	case "tar.gz":
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("invalid tar.gz archive %s: %w", p, err)
+		}
+		tr := tar.NewReader(zr)
+		for {
+			if _, err := tr.Next(); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("invalid tar.gz archive %s: %w", p, err)
+			}
+		}
+	}
+	return fmt.Errorf("unknown archive format %q", format)
+}
+
+// resolveServePath returns the absolute path for a path handler argument.
+// Relative paths resolve against baseDir, or the current directory if
+// baseDir is empty. With a baseDir, relative paths that climb out of it
+// are rejected; absolute paths are used as given.
+func resolveServePath(baseDir, p string) (string, error) {
+	if baseDir == "" || filepath.IsAbs(p) {
+		return filepath.Abs(p)
+	}
+	base, err := filepath.Abs(baseDir)
+	if err != nil {
+		return "", err
+	}
+	abs := filepath.Join(base, p)
+	if rel, err := filepath.Rel(base, abs); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q resolves to %s, outside of -base-dir %s", p, abs, base)
+	}
+	return abs, nil
+}
+
+// checkAllowRoot returns an error unless the existing file or directory p
+// is root or within it, after resolving symlinks in both so that links
+// can't point outside of root. An empty root allows any p.
+func checkAllowRoot(root, p string) error {
+	if root == "" {
+		return nil
+	}
+	absRoot, err := filepath.Abs(root)
+	if err == nil {
+		absRoot, err = filepath.EvalSymlinks(absRoot)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid -allow-root: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absRoot, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		if resolved != p {
+			return fmt.Errorf("path %s resolves to %s, outside of -allow-root %s", p, resolved, root)
+		}
+		return fmt.Errorf("path %s is outside of -allow-root %s", p, root)
+	}
+	return nil
+}
+
+// pathReadWarning returns a warning if tailscaled likely can't read the
+// file or directory p, or the empty string if it probably can. Since
+// tailscaled may run as a different user than the CLI, this is a guess:
+// it tries to read p itself and, on Unix-like systems, checks whether p
+// is readable by everyone.
+func pathReadWarning(p string, fi os.FileInfo) string {
+	f, err := os.Open(p)
+	if err == nil && fi.IsDir() {
+		_, err = f.Readdirnames(1)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if f != nil {
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Sprintf("%s is not readable (%v); requests for it will fail", p, err)
+	}
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	want := fs.FileMode(0004) // other-read
+	if fi.IsDir() {
+		want |= 0001 // other-search
+	}
+	if fi.Mode().Perm()&want != want {
+		return fmt.Sprintf("%s has mode %v; tailscaled may not be able to read it if it runs as a different user", p, fi.Mode().Perm())
+	}
+	return ""
+}
+
+// servePortEnv is the environment variable that sets the default web port,
+// for users who always serve on a port other than 443.
+const servePortEnv = "TAILSCALE_SERVE_PORT"
+
+// webPort returns the port that web handlers are configured on: -port if
+// given, else 80 with -http, else $TAILSCALE_SERVE_PORT if set, else 443.
+func (e *serveEnv) webPort() (uint16, error) {
+	switch {
+	case e.port != 0:
+		if e.port < 0 || e.port > 65535 {
+			return 0, serveInvalid(fmt.Errorf("invalid -port %d", e.port))
+		}
+		return uint16(e.port), nil
+	case e.http:
+		return 80, nil
+	}
+	if v := os.Getenv(servePortEnv); v != "" {
+		p, err := parsePort(v)
+		if err != nil {
+			return 0, serveInvalid(fmt.Errorf("invalid $%s: %w", servePortEnv, err))
+		}
+		return p, nil
+	}
+	return 443, nil
+}
+
+// setWebPortHandler sets sc's TCP handler for port to serve the web
+// handlers at hp: HTTPS, or plaintext HTTP with -http or -no-https. It
+// refuses to switch a port between the two while ingress is on for hp,
+// as that would change what ingress clients connect to.
+func (e *serveEnv) setWebPortHandler(sc *ipn.ServeConfig, hp ipn.HostPort, port uint16) error {
+	plain := e.http || e.noHTTPS
+	if old := sc.TCP[port]; old != nil && (old.HTTP || old.HTTPS) && old.HTTP != plain && sc.AllowIngress[hp] {
+		if plain {
+			return fmt.Errorf("ingress is on for %s, which is served over HTTPS; turn it off with \"tailscale serve ingress off\" before serving plaintext HTTP there", hp)
+		}
+		return fmt.Errorf("ingress is on for %s, which is served over plaintext HTTP; pass -no-https to keep it that way, or turn ingress off first", hp)
+	}
+	mak.Set(&sc.TCP, port, &ipn.TCPPortHandler{HTTP: plain, HTTPS: !plain})
+	return nil
+}
+
+// webHostPort returns the ServeConfig.Web and AllowIngress key for
+// dnsName and port. All commands must build keys this way so that they
+// agree, even for names that need brackets.
+func webHostPort(dnsName string, port uint16) ipn.HostPort {
+	return ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(port))))
+}
+
+// webScheme returns "http" if hp is served as plaintext HTTP in sc, and
+// "https" otherwise.
+func webScheme(sc *ipn.ServeConfig, hp ipn.HostPort) string {
+	if _, port, err := net.SplitHostPort(string(hp)); err == nil {
+		if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+			if th := sc.TCP[uint16(p)]; th != nil && th.HTTP {
+				return "http"
+			}
+		}
+	}
+	return "https"
+}
+
+// checkMutation validates sc, the config a command is about to save, and
+// if -probe was given, dials each of backends (host:ports; empty ones are
+// skipped). It reports whether the caller should stop without saving,
+// either because of an error or because of -validate-only.
+func (e *serveEnv) checkMutation(sc *ipn.ServeConfig, backends ...string) (stop bool, err error) {
+	if err := validateServeConfig(sc); err != nil {
+		return true, serveInvalid(err)
+	}
+	for _, backend := range backends {
+		if !e.probe || backend == "" {
+			continue
+		}
+		c, err := net.DialTimeout("tcp", backend, 2*time.Second)
+		if err != nil {
+			return true, serveInvalid(fmt.Errorf("backend %s is not reachable: %w", backend, err))
+		}
+		c.Close()
+	}
+	if e.validateOnly {
+		e.verbosef("validated new serve config; -validate-only given, so not saving")
+		fmt.Fprintln(e.stdout(), "Validation passed; not saving.")
+		return true, nil
+	}
+	e.verbosef("validated new serve config")
+	return false, nil
+}
+
+// proxyBackendAddr returns the host:port that the proxy URL target
+// connects to, or the empty string if target is empty or invalid.
+func proxyBackendAddr(target string) string {
+	if target == "" {
+		return ""
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme != "http" && u.Scheme != "h2c" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// validateRedirectTarget reports whether target can be redirected to: an
+// http or https URL with a host, or an absolute path on the same host.
+func validateRedirectTarget(target string) error {
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		return nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid redirect target: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid redirect target %q: must be an http:// or https:// URL, or a path starting with /", target)
+	}
+	return nil
+}
+
+// validateRedirectStatus reports whether code is a redirect status that
+// keeps working when the target is a different URL.
+func validateRedirectStatus(code int) error {
+	switch code {
+	case 301, 302, 307, 308:
+		return nil
+	}
+	return fmt.Errorf("invalid redirect status %d: must be 301, 302, 307, or 308", code)
+}
+
+func validateStatusCode(code int) error {
+	if code < 100 || code > 599 {
+		return fmt.Errorf("invalid HTTP status code %d: must be between 100 and 599", code)
+	}
+	return nil
+}
+
+func validateStickySessions(mode string) error {
+	switch mode {
+	case "cookie", "ip":
+		return nil
+	}
+	return fmt.Errorf("invalid sticky session mode %q; want \"cookie\" or \"ip\"", mode)
+}
+
+// cleanMountPoint returns the cleaned form of mount, with a leading slash
+// added if missing. It returns an error if mount isn't already clean or
+// contains anything other than a path, such as a query or fragment.
+func cleanMountPoint(mount string) (string, error) {
+	if mount == "" {
+		return "", errors.New("mount point cannot be empty")
+	}
+	if !strings.HasPrefix(mount, "/") {
+		mount = "/" + mount
+	}
+	u, err := url.Parse(mount)
+	if err != nil {
+		return "", fmt.Errorf("invalid mount point %q: %w", mount, err)
+	}
+	if u.RawQuery != "" || u.ForceQuery {
+		return "", fmt.Errorf("invalid mount point %q: must not contain a query string", mount)
+	}
+	if u.Fragment != "" || strings.Contains(mount, "#") {
+		return "", fmt.Errorf("invalid mount point %q: must not contain a fragment", mount)
+	}
+	if u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return "", fmt.Errorf("invalid mount point %q: must be a path only", mount)
+	}
+	c := path.Clean(mount)
+	if mount == c || mount == c+"/" {
+		return mount, nil
+	}
+	return "", fmt.Errorf("invalid mount point %q", mount)
+}
+
+// resolveProxyTarget is like expandProxyTarget, but first looks up a target
+// of the form "@name" in e.targetsFile.
+func (e *serveEnv) resolveProxyTarget(target string) (string, error) {
+	if !strings.HasPrefix(target, "@") {
+		return expandProxyTarget(target)
+	}
+	name := target[1:]
+	if e.targetsFile == "" {
+		return "", fmt.Errorf("proxy target %s is a name; give -targets with the file to look it up in", target)
+	}
+	names, err := readProxyNames(e.targetsFile)
+	if err != nil {
+		return "", err
+	}
+	t, ok := names[name]
+	if !ok {
+		return "", fmt.Errorf("proxy target %s isn't defined in %s", target, e.targetsFile)
+	}
+	u, err := expandProxyTarget(t)
+	if err != nil {
+		return "", fmt.Errorf("proxy target %s: %w", target, err)
+	}
+	return u, nil
+}
+
+// readProxyNames reads a -targets file: lines of a name and the proxy target,
+// in any form expandProxyTarget takes, that it stands for. Blank lines and
+// lines starting with "#" are ignored.
+func readProxyNames(file string) (map[string]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a name and a target, like \"myservice localhost:8080\"", file, i+1)
+		}
+		name, target := f[0], f[1]
+		if strings.HasPrefix(name, "@") || strings.Contains(name, ",") {
+			return nil, fmt.Errorf("%s:%d: invalid name %q", file, i+1, name)
+		}
+		if _, dup := names[name]; dup {
+			return nil, fmt.Errorf("%s:%d: %q is defined more than once", file, i+1, name)
+		}
+		names[name] = target
+	}
+	return names, nil
+}
+
+// expandProxyTarget returns the URL to proxy to for target, which may be a
+// bare port number ("3000"), a host:port, or a URL.
+func expandProxyTarget(target string) (string, error) {
+	if strings.HasPrefix(target, "@") {
+		return "", fmt.Errorf("proxy target %s is an unresolved name", target)
+	}
+	// A bare ":port", as in "proxy :3000", means localhost.
+	if strings.HasPrefix(target, ":") {
+		if allNumeric(target[1:]) {
+			target = target[1:]
+		} else if target != ":" {
+			target = "127.0.0.1" + target
+		}
+	}
+	if allNumeric(target) {
+		if _, err := parsePort(target); err != nil {
+			return "", err
+		}
+		return "http://127.0.0.1:" + target, nil
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return "", fmt.Errorf("parsing url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "https+insecure", "h2c":
+		// ok
+	case "tcp":
+		port := u.Port()
+		if port == "" {
+			port = "<port>"
+		}
+		return "", fmt.Errorf("tcp:// targets are for \"serve tcp\", not web proxies; did you mean \"tailscale serve tcp %s\"?", port)
+	default:
+		return "", fmt.Errorf("must be a URL starting with http://, https://, https+insecure://, or h2c://")
+	}
+	host := u.Hostname()
+	switch host {
+	// TODO(shayne,bradfitz): do we want to do this?
+	case "localhost", "127.0.0.1":
+		host = "127.0.0.1"
+	default:
+		return "", fmt.Errorf("only localhost or 127.0.0.1 proxies are currently supported")
+	}
+	url := u.Scheme + "://" + host
+	if u.Port() != "" {
+		url += ":" + u.Port()
+	}
+	// Keep any path and query so the backend sees them prepended to
+	// each request.
+	if u.Path != "/" {
+		url += u.EscapedPath()
+	}
+	if u.RawQuery != "" {
+		url += "?" + u.RawQuery
+	}
+	return url, nil
+}
+
+// parseByteSize parses a size like "512", "64KB", or "10MB". The suffixes
+// B, KB, MB, and GB are case-insensitive, and KB, MB, and GB are powers of
+// 1024. The size must be positive.
+func parseByteSize(s string) (int64, error) {
+	num, mult := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || !allNumeric(num) || n <= 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q; want a positive number of bytes, optionally with a KB, MB, or GB suffix", s)
+	}
+	return n * mult, nil
+}
+
+// parsePort parses s as a TCP or UDP port number. Port 0 is rejected.
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if p == 0 || err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(p), nil
+}
+
+// maxTCPPortRange is the most ports that "serve tcp lo-hi" forwards at
+// once, so that a typo doesn't claim thousands of ports.
+const maxTCPPortRange = 100
+
+// parsePortRange parses s, an inclusive "lo-hi" range of ports, such as
+// "50000-50010".
+func parsePortRange(s string) (lo, hi uint16, err error) {
+	los, his, _ := strings.Cut(s, "-")
+	if lo, err = parsePort(los); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if hi, err = parsePort(his); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q: %d is greater than %d", s, lo, hi)
+	}
+	if n := int(hi) - int(lo) + 1; n > maxTCPPortRange {
+		return 0, 0, fmt.Errorf("port range %q has %d ports; at most %d can be forwarded at once", s, n, maxTCPPortRange)
+	}
+	return lo, hi, nil
+}
+
+// parseForwardAddr parses addr, the value of tcp -forward-to, as a
+// host:port, such as "192.168.1.10:5432" or "[::]:8080". It returns the
+// address in canonical form.
+func parseForwardAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid -forward-to %q: %w", addr, err)
+	}
+	if err := validateTargetHost(host); err != nil {
+		return "", err
+	}
+	if _, err := parsePort(port); err != nil {
+		return "", fmt.Errorf("invalid -forward-to %q: %w", addr, err)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// validateTargetHost reports whether host is a bare IP address or DNS name
+// suitable for use as a forwarding target, without a scheme or port.
+func validateTargetHost(host string) error {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if !validDNSLabel(label) {
+			return fmt.Errorf("invalid target host %q: must be a hostname or IP address without a scheme or port", host)
+		}
+	}
+	return nil
+}
+
+// validDNSLabel reports whether label is a valid DNS label: 1 to 63
+// letters, digits, or hyphens, not starting or ending with a hyphen.
+func validDNSLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func allNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+var weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// parseMaintenanceWindow parses a weekly maintenance window of the form
+// "Sat 02:00-04:00" and returns it in canonical form. The end time may be
+// earlier than the start time to denote a window spanning midnight.
+func parseMaintenanceWindow(s string) (string, error) {
+	day, span, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return "", fmt.Errorf("invalid maintenance window %q; want form like \"Sat 02:00-04:00\"", s)
+	}
+	var canonDay string
+	for _, d := range weekdays {
+		if strings.EqualFold(day, d) {
+			canonDay = d
+			break
+		}
+	}
+	if canonDay == "" {
+		return "", fmt.Errorf("invalid maintenance window %q: unknown day %q", s, day)
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(span), "-")
+	if !ok {
+		return "", fmt.Errorf("invalid maintenance window %q; want form like \"Sat 02:00-04:00\"", s)
+	}
+	startMin, err := parseClockMinutes(start)
+	if err != nil {
+		return "", fmt.Errorf("invalid maintenance window %q: %w", s, err)
+	}
+	endMin, err := parseClockMinutes(end)
+	if err != nil {
+		return "", fmt.Errorf("invalid maintenance window %q: %w", s, err)
+	}
+	if startMin == endMin {
+		return "", fmt.Errorf("invalid maintenance window %q: start and end are equal", s)
+	}
+	return fmt.Sprintf("%s %02d:%02d-%02d:%02d", canonDay, startMin/60, startMin%60, endMin/60, endMin%60), nil
+}
+
+// maxRateLimit is the largest request count that a rate limit may allow
+// per unit of time.
+const maxRateLimit = 1_000_000
+
+// parseRateLimit parses a rate limit of the form "N/unit", where N is a
+// positive number of requests and unit is "s", "m", or "h", and returns it
+// in canonical form.
+func parseRateLimit(s string) (string, error) {
+	ns, unit, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok || ns == "" || !allNumeric(ns) {
+		return "", fmt.Errorf("invalid rate limit %q; want form like \"10/s\"", s)
+	}
+	n, err := strconv.Atoi(ns)
+	if err != nil || n == 0 || n > maxRateLimit {
+		return "", fmt.Errorf("invalid rate limit %q: the count must be between 1 and %d", s, maxRateLimit)
+	}
+	switch strings.ToLower(unit) {
+	case "s", "m", "h":
+	default:
+		return "", fmt.Errorf("invalid rate limit %q: unknown unit %q; want s, m, or h", s, unit)
+	}
+	return fmt.Sprintf("%d/%s", n, strings.ToLower(unit)), nil
+}
+
+// parseClockMinutes parses a 24-hour "HH:MM" time and returns the number of
+// minutes since midnight.
+func parseClockMinutes(s string) (int, error) {
+	hs, ms, ok := strings.Cut(s, ":")
+	if !ok || len(ms) != 2 || len(hs) == 0 || len(hs) > 2 || !allNumeric(hs) || !allNumeric(ms) {
+		return 0, fmt.Errorf("invalid time %q; want HH:MM", s)
+	}
+	h, _ := strconv.Atoi(hs)
+	m, _ := strconv.Atoi(ms)
+	if h > 23 || m > 59 {
+		return 0, fmt.Errorf("invalid time %q; want HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func (e *serveEnv) runServeApply(ctx context.Context, args []string) error {
+	if len(args) != 0 || e.file == "" {
+		return flag.ErrHelp
+	}
+	sc, err := e.readServeConfigFile(e.file)
+	if err != nil {
+		return err
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// runServeEdit opens the current serve config in the user's editor and
+// saves what they change it to.
+func (e *serveEnv) runServeEdit(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	cur, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	start := cur
+	if start == nil {
+		start = new(ipn.ServeConfig)
+	}
+	orig, err := json.MarshalIndent(start, "", "  ")
+	if err != nil {
+		return err
+	}
+	orig = append(orig, '\n')
+	f, err := os.CreateTemp("", "tailscale-serve-*.json")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	keep := false
+	defer func() {
+		if !keep {
+			os.Remove(name)
+		}
+	}()
+	_, err = f.Write(orig)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	// keepEdits is for failures after the user is done editing, so that
+	// they can fix the file and "serve apply" it.
+	keepEdits := func(err error) error {
+		keep = true
+		fmt.Fprintf(e.stderr(), "Your edits are in %s.\n", name)
+		return err
+	}
+
+	last, lastErr := orig, error(nil)
+	var sc *ipn.ServeConfig
+	for {
+		if err := e.runEditor(ctx, name); err != nil {
+			return err
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			fmt.Fprintln(e.stderr(), "Edit canceled: the file is empty.")
+			return nil
+		}
+		if bytes.Equal(b, last) {
+			if lastErr != nil {
+				return keepEdits(serveInvalid(fmt.Errorf("edit canceled: %w", lastErr)))
+			}
+			fmt.Fprintln(e.stderr(), "Edit canceled: no changes were made.")
+			return e.noChange()
+		}
+		sc, err = decodeServeConfigPart(bytes.NewReader(b))
+		if err == nil {
+			break
+		}
+		fmt.Fprintf(e.stderr(), "%v\nReopening the editor; save the file unchanged to cancel.\n", err)
+		last, lastErr = b, err
+	}
+	if reflect.DeepEqual(sc, start) {
+		fmt.Fprintln(e.stderr(), "Edit canceled: no changes were made.")
+		return e.noChange()
+	}
+	if stop, err := e.checkMutation(sc); stop || err != nil {
+		if err != nil {
+			return keepEdits(err)
+		}
+		return nil
+	}
+	if err := e.setServeConfig(ctx, sc); err != nil {
+		return keepEdits(err)
+	}
+	return nil
+}
+
+// runEditor runs $EDITOR on file, waiting for it to exit. EDITOR may
+// include arguments, like "code --wait".
+func (e *serveEnv) runEditor(ctx context.Context, file string) error {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+		if runtime.GOOS == "windows" {
+			editor = []string{"notepad"}
+		}
+	}
+	cmd := exec.CommandContext(ctx, editor[0], append(editor[1:], file)...)
+	cmd.Stdin = e.stdin()
+	cmd.Stdout = e.stdout()
+	cmd.Stderr = e.stderr()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running editor %s: %w", editor[0], err)
+	}
+	return nil
+}
+
+// runServeValidate checks the config in -f like apply would, listing every
+// problem instead of stopping at the first.
+func (e *serveEnv) runServeValidate(ctx context.Context, args []string) error {
+	if len(args) != 0 || e.file == "" {
+		return flag.ErrHelp
+	}
+	_, err := e.readServeConfigFile(e.file)
+	var errs serveConfigErrors
+	if !errors.As(err, &errs) {
+		if err == nil {
+			fmt.Fprintf(e.stdout(), "%s: no problems found\n", e.file)
+		}
+		return err
+	}
+	for _, err := range errs {
+		fmt.Fprintf(e.stdout(), "- %v\n", err)
+	}
+	if len(errs) == 1 {
+		return serveInvalid(fmt.Errorf("%s: found 1 problem", e.file))
+	}
+	return serveInvalid(fmt.Errorf("%s: found %d problems", e.file, len(errs)))
+}
+
+func (e *serveEnv) runServeDescribe(ctx context.Context, args []string) error {
+	if len(args) != 0 || e.file == "" {
+		return flag.ErrHelp
+	}
+	sc, err := e.readServeConfigFile(e.file)
+	if err != nil {
+		return err
+	}
+	paras := describeServeConfig(sc)
+	if len(paras) == 0 {
+		fmt.Fprintln(e.stdout(), "Serves nothing.")
+		return nil
+	}
+	fmt.Fprintln(e.stdout(), strings.Join(paras, "\n\n"))
+	return nil
+}
+
+func (e *serveEnv) runServeExplain(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		return &exitCodeError{serveExitNoConfig, errNoServeConfig}
+	}
+	if len(sc.Web) == 0 {
+		return errors.New("the serve config has no web handlers")
+	}
+	w := e.stdout()
+	for _, p := range args {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		for _, hp := range sortedWebHosts(sc) {
+			handlers := sc.Web[hp].Handlers
+			mount, notes := explainServePath(handlers, p)
+			if mount == "" {
+				fmt.Fprintf(w, "%s: %s is not served (404 Not Found)\n", hp, p)
+				continue
+			}
+			h := handlers[mount]
+			fmt.Fprintf(w, "%s: %s is served by %s (%s %s)\n", hp, p, mount, handlerType(h), handlerArg(h))
+			for _, n := range notes {
+				fmt.Fprintf(w, "  %s\n", n)
+			}
+		}
+	}
+	return nil
+}
+
+// explainServePath returns the mount point in handlers that serves a
+// request for p, matched the way tailscaled's getServeHandler does, or ""
+// if none does. The notes explain how p was matched, if not exactly.
+func explainServePath(handlers map[string]*ipn.HTTPHandler, p string) (mount string, notes []string) {
+	if handlers[p] != nil {
+		return p, nil
+	}
+	clean := path.Clean(p)
+	if clean != p && clean+"/" != p {
+		notes = append(notes, fmt.Sprintf("the path is cleaned to %s before matching", clean))
+	}
+	for dir := clean; ; dir = path.Dir(dir) {
+		candidates := []string{dir}
+		if dir != "/" {
+			candidates = []string{dir + "/", dir}
+		}
+		for _, m := range candidates {
+			if handlers[m] == nil {
+				continue
+			}
+			pSlash, mSlash := strings.HasSuffix(p, "/"), strings.HasSuffix(m, "/")
+			switch {
+			case dir != clean:
+				notes = append(notes, fmt.Sprintf("no mount point is %s itself; %s is its closest parent", clean, m))
+			case mSlash && !pSlash:
+				notes = append(notes, fmt.Sprintf("%s matches with a trailing slash added", m))
+			case !mSlash && pSlash:
+				notes = append(notes, fmt.Sprintf("%s matches with the trailing slash removed", m))
+			}
+			if m != dir && handlers[dir] != nil {
+				notes = append(notes, fmt.Sprintf("%s is also a mount point, but %s is tried first", dir, m))
+			}
+			return m, notes
+		}
+		if dir == "/" {
+			return "", nil
+		}
+	}
+}
+
+// describeServeConfig returns one sentence per handler in sc, sorted by
+// address and mount point. It does not touch the network or filesystem.
+func describeServeConfig(sc *ipn.ServeConfig) []string {
+	var paras []string
+	audience := func(on bool) string {
+		if on {
+			return "publicly via Funnel"
+		}
+		return "to your tailnet only"
+	}
+	for _, hp := range sortedWebHosts(sc) {
+		handlers := sc.Web[hp].Handlers
+		for _, mount := range sortedMounts(handlers) {
+			h := handlers[mount]
+			var what string
+			switch {
+			case h.Proxy != "":
+				what = "by proxying to " + h.Proxy
+				if len(h.ExtraProxies) > 0 {
+					what += " (load-balanced with " + strings.Join(h.ExtraProxies, ", ") + ")"
+				}
+			case h.Path != "" && h.Archive != "":
+				what = "from files in the " + h.Archive + " archive " + h.Path
+			case h.Path != "":
+				what = "from files in " + h.Path
+			case len(h.Files) > 0:
+				what = "the files " + namedFilesArg(h.Files)
+			case h.Redirect != "":
+				what = "by redirecting to " + h.Redirect
+			default:
+				what = fmt.Sprintf("with the static text %q", h.Text)
+			}
+			p := fmt.Sprintf("Serves %s on %s://%s %s, %s", mount, webScheme(sc, hp), hp, what, audience(sc.AllowIngress[hp]))
+			if h.BasicAuthUser != "" {
+				p += fmt.Sprintf(", behind basic auth as user %q", h.BasicAuthUser)
+			}
+			paras = append(paras, p+".")
+		}
+	}
+	for _, port := range sortedTCPPorts(sc) {
+		th := sc.TCP[port]
+		if th.TCPForward == "" {
+			continue
+		}
+		portSuffix := ":" + strconv.Itoa(int(port))
+		var ingress bool
+		for hp, on := range sc.AllowIngress {
+			if on && strings.HasSuffix(string(hp), portSuffix) {
+				ingress = true
+			}
+		}
+		tls := "passing TLS through untouched"
+		if th.TerminateTLS != "" {
+			tls = "terminating TLS for " + th.TerminateTLS
+		}
+		if th.ProxyProtocol != 0 {
+			tls += fmt.Sprintf(", sending a PROXY protocol v%d header", th.ProxyProtocol)
+		}
+		paras = append(paras, fmt.Sprintf("Forwards TCP port %d to %s, %s, %s.", port, th.TCPForward, tls, audience(ingress)))
+	}
+	return paras
+}
+
+// errConfigsDiffer is returned by "serve diff" when the file and the
+// current serve config differ.
+var errConfigsDiffer = errors.New("serve config differs from the file")
+
+func (e *serveEnv) runServeDiff(ctx context.Context, args []string) error {
+	if len(args) != 0 || e.file == "" {
+		return flag.ErrHelp
+	}
+	want, err := e.readServeConfigFile(e.file)
+	if err != nil {
+		return err
+	}
+	cur, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	lines := diffServeConfigs(cur, want)
+	if len(lines) == 0 {
+		fmt.Fprintln(e.stdout(), "No differences.")
+		return nil
+	}
+	fmt.Fprintln(e.stdout(), strings.Join(lines, "\n"))
+	return errConfigsDiffer
+}
+
+// diffServeConfigs returns a line for each difference between the serve
+// configs a and b, either of which may be nil. Lines start with "+" for
+// things only b has, "-" for things only a has, and "~" for things that
+// changed, listing the changed fields. A config with nothing in it is the
+// same as nil.
+func diffServeConfigs(a, b *ipn.ServeConfig) []string {
+	if a == nil {
+		a = new(ipn.ServeConfig)
+	}
+	if b == nil {
+		b = new(ipn.ServeConfig)
+	}
+	var lines []string
+	for _, hp := range sortedKeys(a.Web, b.Web) {
+		var aw, bw ipn.WebServerConfig
+		if w := a.Web[hp]; w != nil {
+			aw = *w
+		}
+		if w := b.Web[hp]; w != nil {
+			bw = *w
+		}
+		for _, mount := range sortedKeys(aw.Handlers, bw.Handlers) {
+			lines = appendDiff(lines, "web "+string(hp)+mount, aw.Handlers[mount], bw.Handlers[mount], handlerSummary)
+		}
+		// And the server's own settings.
+		aw.Handlers, bw.Handlers = nil, nil
+		if changed := changedFields(aw, bw); len(changed) > 0 {
+			lines = append(lines, "~ web "+string(hp)+": "+strings.Join(changed, ", "))
+		}
+	}
+	for _, port := range sortedKeys(a.TCP, b.TCP) {
+		lines = appendDiff(lines, fmt.Sprintf("tcp %d", port), a.TCP[port], b.TCP[port], tcpSummary)
+	}
+	for _, port := range sortedKeys(a.UDP, b.UDP) {
+		lines = appendDiff(lines, fmt.Sprintf("udp %d", port), a.UDP[port], b.UDP[port], func(uh *ipn.UDPPortHandler) string {
+			return "forward to " + uh.UDPForward
+		})
+	}
+	for _, hp := range sortedKeys(a.AllowIngress, b.AllowIngress) {
+		switch on := b.AllowIngress[hp]; {
+		case on && !a.AllowIngress[hp]:
+			lines = append(lines, "+ ingress "+string(hp))
+		case !on && a.AllowIngress[hp]:
+			lines = append(lines, "- ingress "+string(hp))
+		}
+	}
+
+	// And anything else, compared field by field.
+	ar, br := *a, *b
+	ar.Web, ar.TCP, ar.UDP, ar.AllowIngress = nil, nil, nil, nil
+	br.Web, br.TCP, br.UDP, br.AllowIngress = nil, nil, nil, nil
+	if changed := changedFields(ar, br); len(changed) > 0 {
+		lines = append(lines, "~ "+strings.Join(changed, ", "))
+	}
+	return lines
+}
+
+// appendDiff appends to lines the difference, if any, between a and b for
+// the thing described by what. Either may be nil. summary describes a
+// thing that was added or removed.
+func appendDiff[T any](lines []string, what string, a, b *T, summary func(*T) string) []string {
+	switch {
+	case a == nil && b == nil:
+	case a == nil:
+		lines = append(lines, "+ "+what+": "+summary(b))
+	case b == nil:
+		lines = append(lines, "- "+what+": "+summary(a))
+	default:
+		if changed := changedFields(*a, *b); len(changed) > 0 {
+			lines = append(lines, "~ "+what+": "+strings.Join(changed, ", "))
+		}
+	}
+	return lines
+}
+
+// changedFields returns "Field: old -> new" for each field that differs
+// between the structs a and b, which must be of the same type, with the
+// values shown as JSON.
+func changedFields[T any](a, b T) []string {
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	var changed []string
+	for i := 0; i < av.NumField(); i++ {
+		af, bf := av.Field(i).Interface(), bv.Field(i).Interface()
+		if reflect.DeepEqual(af, bf) {
+			continue
+		}
+		aj, _ := json.Marshal(af)
+		bj, _ := json.Marshal(bf)
+		changed = append(changed, fmt.Sprintf("%s: %s -> %s", av.Type().Field(i).Name, aj, bj))
+	}
+	return changed
+}
+
+// handlerSummary returns the type and target of h, like "proxy
+// http://127.0.0.1:3000".
+func handlerSummary(h *ipn.HTTPHandler) string {
+	switch handlerType(h) {
+	case "proxy":
+		return "proxy " + h.Proxy
+	case "path":
+		if len(h.Files) > 0 {
+			return "path " + namedFilesArg(h.Files)
+		}
+		return "path " + h.Path
+	case "redirect":
+		return "redirect " + h.Redirect
+	}
+	return fmt.Sprintf("text %q", h.Text)
+}
+
+// handlerFiles returns the local files and directories that h serves, if
+// any: its Path, ExtraPaths, and Files.
+func handlerFiles(h *ipn.HTTPHandler) []string {
+	var paths []string
+	if h.Path != "" {
+		paths = append(paths, h.Path)
+	}
+	paths = append(paths, h.ExtraPaths...)
+	for _, name := range sortedKeys(h.Files, nil) {
+		paths = append(paths, h.Files[name])
+	}
+	return paths
+}
+
+// tcpSummary returns what th does, like "HTTPS" or "forward to
+// 127.0.0.1:5432".
+func tcpSummary(th *ipn.TCPPortHandler) string {
+	switch {
+	case th.HTTPS:
+		return "HTTPS"
+	case th.HTTP:
+		return "HTTP"
+	case th.TerminateTLS != "":
+		return "forward to " + th.TCPForward + ", terminating TLS for " + th.TerminateTLS
+	}
+	return "forward to " + th.TCPForward
+}
+
+// sortedKeys returns the keys of a and b, without duplicates, in order.
+func sortedKeys[K ~string | ~uint16, V any](a, b map[K]V) []K {
+	var keys []K
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedWebHosts(sc *ipn.ServeConfig) []ipn.HostPort {
+	var hps []ipn.HostPort
+	for hp := range sc.Web {
+		hps = append(hps, hp)
+	}
+	sort.Slice(hps, func(i, j int) bool { return hps[i] < hps[j] })
+	return hps
+}
+
+func sortedMounts(handlers map[string]*ipn.HTTPHandler) []string {
+	var mounts []string
+	for mount := range handlers {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+	return mounts
+}
+
+// reconcileMountPoints deletes the handlers that newMount, which was just
+// set in handlers, replaces: those whose mount points differ from it only
+// by a trailing slash. So /foo/ replaces /foo and vice versa, at any depth,
+// and both are removed if both exist. Other mount points, including ones
+// nested under newMount, are kept. It returns the deleted mount points in
+// sorted order.
+func reconcileMountPoints(handlers map[string]*ipn.HTTPHandler, newMount string) (deleted []string) {
+	base := strings.TrimSuffix(newMount, "/")
+	for _, m := range sortedMounts(handlers) {
+		if m != newMount && strings.TrimSuffix(m, "/") == base {
+			delete(handlers, m)
+			deleted = append(deleted, m)
+		}
+	}
+	return deleted
+}
+
+// mountMatchOrder returns the mount points of handlers in the order that
+// tailscaled tries them: a request goes to the mount point that equals its
+// path, or else to the longest one that is a parent directory of its path.
+// Of two mount points differing only by a trailing slash, the one with the
+// slash is tried first (so /foo/ wins over /foo for a request to /foo/x),
+// except that an exact match always wins.
+func mountMatchOrder(handlers map[string]*ipn.HTTPHandler) []string {
+	mounts := sortedMounts(handlers)
+	sort.Slice(mounts, func(i, j int) bool {
+		ti, tj := strings.TrimSuffix(mounts[i], "/"), strings.TrimSuffix(mounts[j], "/")
+		if di, dj := strings.Count(ti, "/"), strings.Count(tj, "/"); di != dj {
+			return di > dj // deeper first
+		}
+		if ti != tj {
+			return ti < tj
+		}
+		return strings.HasSuffix(mounts[i], "/")
+	})
+	return mounts
+}
+
+func sortedTCPPorts(sc *ipn.ServeConfig) []uint16 {
+	var ports []uint16
+	for port := range sc.TCP {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+	return ports
+}
+
+// readServeConfigFile reads, strictly decodes, and validates the serve
+// config in the named file. The name "-" means stdin.
+func (e *serveEnv) readServeConfigFile(name string) (*ipn.ServeConfig, error) {
+	var r io.Reader
+	if name == "-" {
+		r = e.stdin()
+	} else {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var sc *ipn.ServeConfig
+	var err error
+	if format := serveConfigFormat(name); format == "json" {
+		sc, err = decodeServeConfig(r)
+	} else {
+		sc, err = decodeServeConfigAs(r, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return sc, nil
+}
+
+// serveConfigFormat returns the format of the named serve config file
+// based on its extension: "yaml", "toml", or "json" for anything else,
+// including stdin ("-").
+func serveConfigFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "json"
+}
+
+// decodeServeConfigAs decodes a serve config in format ("yaml" or "toml")
+// from r. The document is converted to JSON and passed to
+// decodeServeConfig, so the field names and strictness are the same.
+func decodeServeConfigAs(r io.Reader, format string) (*ipn.ServeConfig, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	switch format {
+	case "yaml":
+		err = yaml.Unmarshal(b, &v)
+	case "toml":
+		var m map[string]any
+		err = toml.Unmarshal(b, &m)
+		v = m
+	default:
+		return nil, fmt.Errorf("unknown serve config format %q", format)
+	}
+	if err != nil {
+		return nil, serveInvalid(fmt.Errorf("invalid %s: %w", strings.ToUpper(format), err))
+	}
+	j, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		return nil, serveInvalid(fmt.Errorf("invalid %s: %w", strings.ToUpper(format), err))
+	}
+	return decodeServeConfig(bytes.NewReader(j))
+}
+
+// jsonCompatible returns v with any maps keyed by non-strings, as YAML
+// produces for keys like TCP ports, converted to maps keyed by strings so
+// that v can be marshaled as JSON.
+func jsonCompatible(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case map[string]any:
+		for k, e := range v {
+			v[k] = jsonCompatible(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = jsonCompatible(e)
+		}
+	}
+	return v
+}
+
+// decodeServeConfig decodes a JSON serve config from r, rejecting unknown
+// fields, and validates it.
+func decodeServeConfig(r io.Reader) (*ipn.ServeConfig, error) {
+	sc, err := decodeServeConfigPart(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateServeConfig(sc); err != nil {
+		return nil, serveInvalid(err)
+	}
+	return sc, nil
+}
+
+// decodeServeConfigPart is like decodeServeConfig, but doesn't validate sc,
+// which may be only part of a config.
+func decodeServeConfigPart(r io.Reader) (*ipn.ServeConfig, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Check the version before decoding strictly, as a newer config may
+	// have fields this version doesn't know about.
+	var v struct{ Version int }
+	if json.Unmarshal(b, &v) == nil && v.Version > ipn.ServeConfigVersion {
+		return nil, serveInvalid(fmt.Errorf("serve config version %d is newer than the newest this version of tailscale supports (%d); upgrade tailscale to use it", v.Version, ipn.ServeConfigVersion))
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	sc := new(ipn.ServeConfig)
+	if err := dec.Decode(sc); err != nil {
+		return nil, serveInvalid(fmt.Errorf("invalid JSON: %w", err))
+	}
+	if dec.More() {
+		return nil, serveInvalid(errors.New("invalid JSON: trailing data after serve config"))
+	}
+	if sc.Version < 0 {
+		return nil, serveInvalid(fmt.Errorf("invalid Version %d", sc.Version))
+	}
+	migrateServeConfig(sc)
+	return sc, nil
+}
+
+// serveConfigMigrations upgrade serve configs from the version at their
+// index to the next. There's one for each version below
+// ipn.ServeConfigVersion.
+var serveConfigMigrations = []func(*ipn.ServeConfig){
+	0: migrateProxyURLs,
+}
+
+// migrateServeConfig upgrades sc from its Version to the current format.
+//
+// It leaves sc.Version as is, since the CLI doesn't set Version in the
+// configs it writes either. Those read as version 0, so each migration must
+// leave configs already in the newer format unchanged.
+func migrateServeConfig(sc *ipn.ServeConfig) {
+	for v := sc.Version; v < ipn.ServeConfigVersion; v++ {
+		serveConfigMigrations[v](sc)
+	}
+}
+
+// migrateProxyURLs rewrites proxy targets given as a bare port or
+// host:port to the URLs "tailscale serve" stores for them. Invalid
+// targets are left for validateServeConfig to report.
+func migrateProxyURLs(sc *ipn.ServeConfig) {
+	migrate := func(target string) string {
+		if strings.Contains(target, "://") {
+			return target
+		}
+		if u, err := expandProxyTarget(target); err == nil {
+			return u
+		}
+		return target
+	}
+	for _, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for _, h := range wsc.Handlers {
+			if h == nil {
+				continue
+			}
+			if h.Proxy != "" {
+				h.Proxy = migrate(h.Proxy)
+			}
+			for i, p := range h.ExtraProxies {
+				h.ExtraProxies[i] = migrate(p)
+			}
+		}
+	}
+}
+
+// serveConfigErrors is the error validateServeConfig returns: the first
+// problem found with each port, host, and handler, in sorted order.
+type serveConfigErrors []error
+
+func (es serveConfigErrors) Error() string {
+	if len(es) == 1 {
+		return es[0].Error()
+	}
+	return fmt.Sprintf("%v (and %d more problems)", es[0], len(es)-1)
+}
+
+// validateServeConfig reports problems with sc that the CLI would never
+// produce itself, such as invalid ports, malformed proxy targets, or
+// handlers that don't set exactly one of Path, Proxy, or Text. The error,
+// if any, is a serveConfigErrors.
+func validateServeConfig(sc *ipn.ServeConfig) error {
+	var errs serveConfigErrors
+	for _, port := range sortedKeys(sc.TCP, nil) {
+		th := sc.TCP[port]
+		if port == 0 {
+			errs = append(errs, errors.New("TCP: port 0 is invalid"))
+			continue
+		}
+		if th == nil {
+			errs = append(errs, fmt.Errorf("TCP[%d]: missing handler", port))
+			continue
+		}
+		var n int
+		for _, set := range []bool{th.HTTPS, th.HTTP, th.TCPForward != ""} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			errs = append(errs, fmt.Errorf("TCP[%d]: exactly one of HTTPS, HTTP, or TCPForward must be set", port))
+			continue
+		}
+		if th.TCPForward != "" {
+			_, fwdPort, err := net.SplitHostPort(th.TCPForward)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("TCP[%d]: invalid TCPForward %q: %w", port, th.TCPForward, err))
+				continue
+			}
+			if _, err := parsePort(fwdPort); err != nil {
+				errs = append(errs, fmt.Errorf("TCP[%d]: invalid TCPForward port %q", port, fwdPort))
+			}
+		}
+		if err := validateProxyProtocol(th.ProxyProtocol); err != nil {
+			errs = append(errs, fmt.Errorf("TCP[%d]: %w", port, err))
+		} else if th.ProxyProtocol != 0 && th.TCPForward == "" {
+			errs = append(errs, fmt.Errorf("TCP[%d]: ProxyProtocol requires TCPForward", port))
+		}
+	}
+	for _, port := range sortedKeys(sc.UDP, nil) {
+		uh := sc.UDP[port]
+		if port == 0 {
+			errs = append(errs, errors.New("UDP: port 0 is invalid"))
+			continue
+		}
+		if uh == nil {
+			errs = append(errs, fmt.Errorf("UDP[%d]: missing handler", port))
+			continue
+		}
+		_, fwdPort, err := net.SplitHostPort(uh.UDPForward)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("UDP[%d]: invalid UDPForward %q: %w", port, uh.UDPForward, err))
+			continue
+		}
+		if _, err := parsePort(fwdPort); err != nil {
+			errs = append(errs, fmt.Errorf("UDP[%d]: invalid UDPForward port %q", port, fwdPort))
+		}
+	}
+	for _, hp := range sortedKeys(sc.IngressExpiry, nil) {
+		if !sc.AllowIngress[hp] {
+			errs = append(errs, fmt.Errorf("IngressExpiry[%q]: ingress is not allowed", hp))
+		}
+	}
+	for _, hp := range sortedKeys(sc.Web, nil) {
+		wsc := sc.Web[hp]
+		_, port, err := net.SplitHostPort(string(hp))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Web[%q]: invalid host:port: %w", hp, err))
+			continue
+		}
+		p, err := parsePort(port)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Web[%q]: invalid port %q", hp, port))
+			continue
+		}
+		if wsc == nil {
+			errs = append(errs, fmt.Errorf("Web[%q]: missing config", hp))
+			continue
+		}
+		if wsc.RequireClientCert {
+			if th := sc.TCP[p]; th != nil && th.HTTP {
+				errs = append(errs, fmt.Errorf("Web[%q]: RequireClientCert needs HTTPS, but port %d serves plaintext HTTP", hp, p))
+			}
+		} else if wsc.ClientCAs != "" {
+			errs = append(errs, fmt.Errorf("Web[%q]: ClientCAs requires RequireClientCert", hp))
+		}
+		if wsc.ClientCAs != "" {
+			if err := checkClientCAs(wsc.ClientCAs); err != nil {
+				errs = append(errs, fmt.Errorf("Web[%q]: ClientCAs: %w", hp, err))
+			}
+		}
+		for _, mount := range sortedKeys(wsc.Handlers, nil) {
+			h := wsc.Handlers[mount]
+			if _, err := cleanMountPoint(mount); err != nil || !strings.HasPrefix(mount, "/") {
+				errs = append(errs, fmt.Errorf("Web[%q]: invalid mount point %q", hp, mount))
+				continue
+			}
+			if err := validateHTTPHandler(h); err != nil {
+				errs = append(errs, fmt.Errorf("Web[%q][%q]: %w", hp, mount, err))
+			} else if len(h.Files) > 0 && !strings.HasSuffix(mount, "/") {
+				errs = append(errs, fmt.Errorf("Web[%q][%q]: Files requires a mount point ending in \"/\"", hp, mount))
+			}
+		}
+	}
+	for _, hp := range sortedKeys(sc.AllowIngress, nil) {
+		if _, _, err := net.SplitHostPort(string(hp)); err != nil {
+			errs = append(errs, fmt.Errorf("AllowIngress[%q]: invalid host:port: %w", hp, err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateHTTPHandler is the part of validateServeConfig that checks a
+// single web handler. It returns the first problem found.
+func validateHTTPHandler(h *ipn.HTTPHandler) error {
+	if h == nil {
+		return errors.New("missing handler")
+	}
+	var n int
+	for _, v := range []string{h.Path, h.Proxy, h.Text, h.Redirect} {
+		if v != "" {
+			n++
+		}
+	}
+	if len(h.Files) > 0 {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of Path, Proxy, Text, Redirect, or Files must be set")
+	}
+	for _, name := range sortedKeys(h.Files, nil) {
+		if err := validateFileName(name); err != nil {
+			return fmt.Errorf("Files: %w", err)
+		}
+		if !filepath.IsAbs(h.Files[name]) {
+			return fmt.Errorf("Files[%q]: %q is not an absolute path", name, h.Files[name])
+		}
+	}
+	if h.Redirect != "" {
+		if err := validateRedirectTarget(h.Redirect); err != nil {
+			return err
+		}
+	}
+	if h.Proxy != "" {
+		if _, err := expandProxyTarget(h.Proxy); err != nil {
+			return fmt.Errorf("invalid Proxy: %w", err)
+		}
+	}
+	if len(h.ExtraPaths) > 0 && h.Path == "" {
+		return errors.New("ExtraPaths requires Path")
+	}
+	if h.Archive != "" {
+		if h.Archive != "zip" && h.Archive != "tar.gz" {
+			return fmt.Errorf("invalid Archive %q: must be \"zip\" or \"tar.gz\"", h.Archive)
+		}
+		if h.Path == "" {
+			return errors.New("Archive requires Path")
+		}
+		if len(h.ExtraPaths) > 0 || h.SPAFallback {
+			return errors.New("Archive can't be used with ExtraPaths or SPAFallback")
+		}
+	}
+	for _, p := range h.ExtraPaths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("ExtraPaths entry %q is not an absolute path", p)
+		}
+	}
+	if len(h.ExtraProxies) > 0 && h.Proxy == "" {
+		return errors.New("ExtraProxies requires Proxy")
+	}
+	for _, p := range h.ExtraProxies {
+		if _, err := expandProxyTarget(p); err != nil {
+			return fmt.Errorf("invalid ExtraProxies entry: %w", err)
+		}
+	}
+	if h.StickySessions != "" {
+		if err := validateStickySessions(h.StickySessions); err != nil {
+			return err
+		}
+		if len(h.ExtraProxies) == 0 {
+			return errors.New("StickySessions requires ExtraProxies")
+		}
+	}
+	if h.FollowRedirects != nil && h.Proxy == "" {
+		return errors.New("FollowRedirects requires Proxy")
+	}
+	if (len(h.BodyReplace) > 0 || h.DecodeUpstream) && h.Proxy == "" {
+		return errors.New("BodyReplace and DecodeUpstream require Proxy")
+	}
+	for old := range h.BodyReplace {
+		if old == "" {
+			return errors.New("BodyReplace has an empty key")
+		}
+	}
+	if (h.BasicAuthUser == "") != (h.BasicAuthHash == "") {
+		return errors.New("BasicAuthUser and BasicAuthHash must be set together")
+	}
+	if h.BasicAuthHash == redactedSecret {
+		return errors.New("BasicAuthHash is redacted; get the config with \"show-config -show-secrets\"")
+	}
+	if h.HSTSMaxAge < 0 {
+		return errors.New("HSTSMaxAge must not be negative")
+	}
+	if h.CacheMaxAge != nil && *h.CacheMaxAge < 0 {
+		return errors.New("CacheMaxAge must not be negative")
+	}
+	if h.CacheMaxAge != nil && h.Path == "" && len(h.Files) == 0 {
+		return errors.New("CacheMaxAge requires Path or Files")
+	}
+	if h.SPAFallback && h.Path == "" {
+		return errors.New("SPAFallback requires Path")
+	}
+	if h.MaxRequestBytes < 0 {
+		return errors.New("MaxRequestBytes must not be negative")
+	}
+	if h.MaxRequestBytes > 0 && h.Proxy == "" {
+		return errors.New("MaxRequestBytes requires Proxy")
+	}
+	if h.StatusCode != 0 {
+		switch {
+		case h.Redirect != "":
+			if err := validateRedirectStatus(h.StatusCode); err != nil {
+				return err
+			}
+		case h.Text == "":
+			return errors.New("StatusCode requires Text or Redirect")
+		default:
+			if err := validateStatusCode(h.StatusCode); err != nil {
+				return err
+			}
+		}
+	}
+	if h.MaintenanceWindow != "" {
+		if _, err := parseMaintenanceWindow(h.MaintenanceWindow); err != nil {
+			return err
+		}
+	}
+	if h.RateLimit != "" {
+		if h.Proxy == "" && h.Path == "" {
+			return errors.New("RateLimit requires Proxy or Path")
+		}
+		if _, err := parseRateLimit(h.RateLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runServeMove moves the handler at one mount point to another under the
+// same host:port.
+func (e *serveEnv) runServeMove(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return flag.ErrHelp
+	}
+	from, err := cleanMountPoint(args[0])
+	if err != nil {
+		return serveInvalid(err)
+	}
+	to, err := cleanMountPoint(args[1])
+	if err != nil {
+		return serveInvalid(err)
+	}
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+	sc := cursc.Clone()
+	var h *ipn.HTTPHandler
+	if sc != nil && sc.Web[hp] != nil {
+		h = sc.Web[hp].Handlers[from]
+	}
+	if h == nil {
+		return fmt.Errorf("no handler at mount point %q", from)
+	}
+	if (h.Path != "" || len(h.Files) > 0) && strings.HasSuffix(from, "/") && !strings.HasSuffix(to, "/") {
+		// Keep the slash that directory handlers need; see parseServeArgs.
+		to += "/"
+	}
+	if to == from {
+		return e.noChange()
+	}
+	handlers := sc.Web[hp].Handlers
+	if !e.force {
+		for _, m := range sortedMounts(handlers) {
+			if m != from && strings.TrimSuffix(m, "/") == strings.TrimSuffix(to, "/") {
+				return fmt.Errorf("a handler is already at %s; use -force to replace it", m)
+			}
+		}
+	}
+	delete(handlers, from)
+	handlers[to] = h
+	reconcileMountPoints(handlers, to)
+
+	if stop, err := e.checkMutation(sc, ""); stop || err != nil {
+		return err
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// runServeRotateAuth replaces the basic-auth password of the handler at
+// the given mount point with a new random one, printing it once.
+func (e *serveEnv) runServeRotateAuth(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	mp, err := cleanMountPoint(args[0])
+	if err != nil {
+		return err
+	}
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+	sc := cursc.Clone()
+	var h *ipn.HTTPHandler
+	if sc != nil && sc.Web[hp] != nil {
+		h = sc.Web[hp].Handlers[mp]
+	}
+	if h == nil {
+		return fmt.Errorf("no handler at mount point %q", mp)
+	}
+	if h.BasicAuthHash == "" {
+		return fmt.Errorf("handler at %q does not use basic auth", mp)
+	}
+	if e.authUser != "" {
+		h.BasicAuthUser = e.authUser
+	}
+	if h.BasicAuthUser == "" {
+		return errors.New("no basic-auth user set; use -user")
+	}
+	pass, hash, err := newBasicAuthPassword()
+	if err != nil {
+		return err
+	}
+	h.BasicAuthHash = hash
+	if stop, err := e.checkMutation(sc, ""); stop || err != nil {
+		return err
+	}
+	if err := e.setServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	if e.dryRunDiff {
+		// Nothing was saved, so the password would never work.
+		return nil
+	}
+	fmt.Fprintf(e.stdout(), "New password for user %q at %s (shown only once):\n%s\n", h.BasicAuthUser, mp, pass)
+	return nil
+}
+
+// newBasicAuthPassword returns a new random password and its bcrypt hash.
+func newBasicAuthPassword() (pass, hash string, err error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	pass = base64.RawURLEncoding.EncodeToString(b)
+	hb, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return pass, string(hb), nil
+}
+
+// serveGlobalFile is the name of the file written by "export -split"
+// holding everything in the serve config other than web handlers.
+const serveGlobalFile = "_global.json"
+
+func (e *serveEnv) runServeExport(ctx context.Context, args []string) error {
+	if len(args) != 0 || e.split != (e.dir != "") {
+		return flag.ErrHelp
+	}
+	if !e.split {
+		return e.runServeShowConfig(ctx, args)
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(e.dir, 0700); err != nil {
+		return err
+	}
+	parts := splitServeConfig(sc)
+	for name, part := range parts {
+		j, err := json.MarshalIndent(part, "", "  ")
+		if err != nil {
+			return err
+		}
+		// Like backups, the files may hold secrets.
+		if err := os.WriteFile(filepath.Join(e.dir, name), append(j, '\n'), 0600); err != nil {
+			return err
+		}
+	}
+	// Remove files left from an earlier export, such as for a host that's
+	// gone since, which "serve import -dir" would otherwise bring back.
+	old, err := filepath.Glob(filepath.Join(e.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range old {
+		if _, ok := parts[filepath.Base(p)]; !ok {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serveBackupTimeFormat is the time format in the names of the files
+// written by "serve backup". It sorts by time and avoids colons, which
+// Windows doesn't allow in file names.
+const serveBackupTimeFormat = "20060102T150405Z"
+
+func (e *serveEnv) runServeBackup(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	dir := args[0]
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		return &exitCodeError{serveExitNoConfig, errNoServeConfig}
+	}
+	j, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, "serve-"+e.now().UTC().Format(serveBackupTimeFormat)+".json")
+	// The backup may hold secrets, and must not replace an earlier one.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(j, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintln(e.stdout(), name)
+	return nil
+}
+
+func (e *serveEnv) runServeRestore(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	sc, err := e.readServeConfigFile(args[0])
+	if err != nil {
+		return err
+	}
+	if e.restoreDryRun {
+		e.dryRunDiff = true
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+func (e *serveEnv) runServeImport(ctx context.Context, args []string) error {
+	if e.importFormat != "" || e.file != "" {
+		if len(args) != 0 || e.dir != "" || e.importFormat == "" || e.file == "" {
+			return flag.ErrHelp
+		}
+		return e.runServeImportFile(ctx)
+	}
+	if len(args) != 0 || e.dir == "" {
+		return flag.ErrHelp
+	}
+	names, err := filepath.Glob(filepath.Join(e.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no .json files in %s", e.dir)
+	}
+	var parts []*ipn.ServeConfig
+	for _, name := range names {
+		part, err := e.readServeConfigFile(name)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part)
+	}
+	sc, err := joinServeConfigs(parts)
+	if err != nil {
+		return err
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// runServeImportFile converts the reverse-proxy config in e.file to a serve
+// config for this node and prints it for review, without saving it.
+func (e *serveEnv) runServeImportFile(ctx context.Context) error {
+	if e.importFormat != "caddyfile" {
+		return serveInvalid(fmt.Errorf("unknown -format %q; the only supported format is \"caddyfile\"", e.importFormat))
+	}
+	var r io.Reader
+	if e.file == "-" {
+		r = e.stdin()
+	} else {
+		f, err := os.Open(e.file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	warn := func(line int, format string, args ...any) {
+		fmt.Fprintf(e.stderr(), "Warning: %s:%d: %s\n", e.file, line, fmt.Sprintf(format, args...))
+	}
+	sc, err := caddyfileToServeConfig(string(src), dnsName, warn)
+	if err != nil {
+		return serveInvalid(fmt.Errorf("%s: %w", e.file, err))
+	}
+	j, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+	e.stdout().Write(append(j, '\n'))
+	return nil
+}
+
+func (e *serveEnv) runServeMerge(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	part, err := decodeServeConfigPart(e.stdin())
+	if err != nil {
+		return err
+	}
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone()
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	mergeServeConfig(sc, part)
+	if stop, err := e.checkMutation(sc, ""); stop || err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cursc, sc) {
+		return e.noChange()
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// mergeServeConfig merges part into sc, key by key. Where both set the
+// same port, host:port, or mount point, part wins. Mount points that part
+// sets replace those in sc differing only by a trailing slash, as with
+// "tailscale serve". A web server in part that requires client certificates
+// sets that requirement, with its ClientCAs, on the one in sc; one that
+// doesn't leaves sc's requirement alone.
+func mergeServeConfig(sc, part *ipn.ServeConfig) {
+	for port, th := range part.TCP {
+		mak.Set(&sc.TCP, port, th.Clone())
+	}
+	for port, uh := range part.UDP {
+		mak.Set(&sc.UDP, port, uh.Clone())
+	}
+	for hp, wsc := range part.Web {
+		if sc.Web[hp] == nil || wsc == nil {
+			mak.Set(&sc.Web, hp, wsc.Clone())
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			mak.Set(&sc.Web[hp].Handlers, mount, h.Clone())
+			reconcileMountPoints(sc.Web[hp].Handlers, mount)
+		}
+		if wsc.RequireClientCert {
+			sc.Web[hp].RequireClientCert = true
+			sc.Web[hp].ClientCAs = wsc.ClientCAs
+		}
+	}
+	for hp, on := range part.AllowIngress {
+		mak.Set(&sc.AllowIngress, hp, on)
+	}
+	for hp, exp := range part.IngressExpiry {
+		mak.Set(&sc.IngressExpiry, hp, exp)
+	}
+	sc.EncryptedSecrets = sc.EncryptedSecrets || part.EncryptedSecrets
+}
+
+// runServeSet replaces the web handlers on the -http or HTTPS port with
+// those in args, a list of handler specs as parsed by parseServeArgs.
+func (e *serveEnv) runServeSet(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	if e.appendPath {
+		return serveInvalid(errors.New("-append can't be used with set"))
+	}
+	if err := e.checkOutputURL(); err != nil {
+		return err
+	}
+	handlers := make(map[string]*ipn.HTTPHandler)
+	var backends []string
+	for _, spec := range splitServeSpecs(args) {
+		mps, h, err := e.parseServeArgs(spec)
+		if err != nil {
+			return serveInvalid(err)
+		}
+		for _, mp := range mps {
+			if _, ok := handlers[mp]; ok {
+				return serveInvalid(fmt.Errorf("mount point %s is given more than once", mp))
+			}
+			handlers[mp] = h.Clone()
+		}
+		if addr := proxyBackendAddr(h.Proxy); addr != "" {
+			backends = append(backends, addr)
+		}
+	}
+	if _, err := dedupMountPoints(sortedMounts(handlers)); err != nil {
+		return serveInvalid(err)
+	}
+
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone()
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	if sc.IsTCPForwardingOnPort(port) {
+		return fmt.Errorf("cannot serve web on port %d: it's already used by a TCP forward (see \"tailscale serve tcp off\"); remove the forward or pick a different port", port)
+	}
+	hp := webHostPort(dnsName, port)
+	if err := e.setWebPortHandler(sc, hp, port); err != nil {
+		return err
+	}
+	mak.Set(&sc.Web, hp, &ipn.WebServerConfig{Handlers: handlers})
+
+	if stop, err := e.checkMutation(sc, backends...); stop || err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cursc, sc) {
+		if err := e.noChange(); err != nil {
+			return err
+		}
+	} else if err := e.setServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	e.printServeURLs(sc, dnsName, port, sortedMounts(handlers))
+	return nil
+}
+
+// splitServeSpecs splits args into handler specs, each of one or more
+// mount points, a type, and its argument. Any trailing incomplete spec is
+// returned as is, for parseServeArgs to reject.
+func splitServeSpecs(args []string) [][]string {
+	var specs [][]string
+	start := 0
+	for i := 0; i < len(args)-1; i++ {
+		if isServeType(args[i]) {
+			end := i + 2
+			if args[i] == "path" && isNamedFileArg(args[i+1]) {
+				for end < len(args) && isNamedFileArg(args[end]) {
+					end++
+				}
+			}
+			specs = append(specs, args[start:end])
+			start = end
+			i = end - 1
+		}
+	}
+	if start < len(args) {
+		specs = append(specs, args[start:])
+	}
+	return specs
+}
+
+func (e *serveEnv) runServeCloneFrom(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	st, err := e.getLocalClientStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("getting client status: %w", err)
+	}
+	peerName, err := findPeerDNSName(st, args[0])
+	if err != nil {
+		return err
+	}
+	selfName := strings.TrimSuffix(st.Self.DNSName, ".")
+
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if !e.force && cursc != nil && !reflect.DeepEqual(cursc, new(ipn.ServeConfig)) {
+		return errors.New("this node already has a serve config; use -force to replace it")
+	}
+	peersc, err := e.getPeerServeConfig(ctx, peerName)
+	if err != nil {
+		return err
+	}
+	if peersc == nil {
+		return fmt.Errorf("%s has no serve config", peerName)
+	}
+	sc := rehomeServeConfig(peersc, peerName, selfName)
+	// Peers leave out basic-auth hashes, so each handler that uses basic
+	// auth gets a new password here.
+	var passwords []string
+	for _, hp := range sortedWebHosts(sc) {
+		for _, mount := range sortedMounts(sc.Web[hp].Handlers) {
+			h := sc.Web[hp].Handlers[mount]
+			for _, p := range handlerFiles(h) {
+				if _, err := os.Stat(p); err != nil {
+					return fmt.Errorf("path handler %s%s: %w", hp, mount, err)
+				}
+			}
+			if h.BasicAuthUser != "" && h.BasicAuthHash == "" {
+				pass, hash, err := newBasicAuthPassword()
+				if err != nil {
+					return err
+				}
+				h.BasicAuthHash = hash
+				passwords = append(passwords, fmt.Sprintf("New password for user %q at %s%s (shown only once):\n%s\n", h.BasicAuthUser, hp, mount, pass))
+			}
+		}
+	}
+	if stop, err := e.checkMutation(sc, ""); stop || err != nil {
+		return err
+	}
+	if err := e.setServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	if e.dryRunDiff {
+		// Nothing was saved, so the passwords would never work.
+		return nil
+	}
+	for _, p := range passwords {
+		io.WriteString(e.stdout(), p)
+	}
+	return nil
+}
+
+// findPeerDNSName returns the MagicDNS name, without the trailing dot, of
+// the peer in st named by name, which may be the peer's MagicDNS name or
+// its host name.
+func findPeerDNSName(st *ipnstate.Status, name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	var matches []string
+	for _, ps := range st.Peer {
+		dnsName := strings.TrimSuffix(ps.DNSName, ".")
+		if dnsName == "" {
+			continue
+		}
+		if strings.EqualFold(dnsName, name) {
+			return dnsName, nil
+		}
+		if short, _, _ := strings.Cut(dnsName, "."); strings.EqualFold(short, name) || strings.EqualFold(ps.HostName, name) {
+			matches = append(matches, dnsName)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no peer named %q", name)
+	case 1:
+		return matches[0], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("peer name %q is ambiguous; use one of: %s", name, strings.Join(matches, ", "))
+}
+
+// rehomeServeConfig returns a copy of sc with every use of the DNS name
+// from, in Web, AllowIngress, IngressExpiry, and TCP -terminate-tls names,
+// replaced by to.
+func rehomeServeConfig(sc *ipn.ServeConfig, from, to string) *ipn.ServeConfig {
+	sc = sc.Clone()
+	rehome := func(hp ipn.HostPort) ipn.HostPort {
+		host, port, err := net.SplitHostPort(string(hp))
+		if err != nil || !strings.EqualFold(host, from) {
+			return hp
+		}
+		return ipn.HostPort(net.JoinHostPort(to, port))
+	}
+	if sc.Web != nil {
+		web := make(map[ipn.HostPort]*ipn.WebServerConfig, len(sc.Web))
+		for hp, wsc := range sc.Web {
+			web[rehome(hp)] = wsc
+		}
+		sc.Web = web
+	}
+	if sc.AllowIngress != nil {
+		ingress := make(map[ipn.HostPort]bool, len(sc.AllowIngress))
+		for hp, on := range sc.AllowIngress {
+			ingress[rehome(hp)] = on
+		}
+		sc.AllowIngress = ingress
+	}
+	if sc.IngressExpiry != nil {
+		expiry := make(map[ipn.HostPort]time.Time, len(sc.IngressExpiry))
+		for hp, t := range sc.IngressExpiry {
+			expiry[rehome(hp)] = t
+		}
+		sc.IngressExpiry = expiry
+	}
+	for _, th := range sc.TCP {
+		if strings.EqualFold(th.TerminateTLS, from) {
+			th.TerminateTLS = to
+		}
+	}
+	return sc
+}
+
+// splitServeConfig splits sc into one config per host name holding that
+// host's web handlers, keyed by "<host>.json", plus one keyed by
+// serveGlobalFile holding everything else.
+func splitServeConfig(sc *ipn.ServeConfig) map[string]*ipn.ServeConfig {
+	global := new(ipn.ServeConfig)
+	parts := map[string]*ipn.ServeConfig{serveGlobalFile: global}
+	if sc == nil {
+		return parts
+	}
+	global.TCP = sc.TCP
+	global.UDP = sc.UDP
+	global.AllowIngress = sc.AllowIngress
+	global.IngressExpiry = sc.IngressExpiry
+	global.EncryptedSecrets = sc.EncryptedSecrets
+	for hp, wsc := range sc.Web {
+		host, _, err := net.SplitHostPort(string(hp))
+		if err != nil {
+			host = string(hp)
+		}
+		name := host + ".json"
+		if parts[name] == nil {
+			parts[name] = new(ipn.ServeConfig)
+		}
+		mak.Set(&parts[name].Web, hp, wsc)
+	}
+	return parts
+}
+
+// joinServeConfigs merges parts, as returned by splitServeConfig, back
+// into one config. It's an error for two parts to set the same key.
+func joinServeConfigs(parts []*ipn.ServeConfig) (*ipn.ServeConfig, error) {
+	sc := new(ipn.ServeConfig)
+	for _, part := range parts {
+		for port, th := range part.TCP {
+			if _, dup := sc.TCP[port]; dup {
+				return nil, fmt.Errorf("TCP port %d set in multiple files", port)
+			}
+			mak.Set(&sc.TCP, port, th)
+		}
+		for port, uh := range part.UDP {
+			if _, dup := sc.UDP[port]; dup {
+				return nil, fmt.Errorf("UDP port %d set in multiple files", port)
+			}
+			mak.Set(&sc.UDP, port, uh)
+		}
+		for hp, wsc := range part.Web {
+			if _, dup := sc.Web[hp]; dup {
+				return nil, fmt.Errorf("web config for %s set in multiple files", hp)
+			}
+			mak.Set(&sc.Web, hp, wsc)
+		}
+		for hp, on := range part.AllowIngress {
+			if _, dup := sc.AllowIngress[hp]; dup {
+				return nil, fmt.Errorf("ingress for %s set in multiple files", hp)
+			}
+			mak.Set(&sc.AllowIngress, hp, on)
+		}
+		for hp, exp := range part.IngressExpiry {
+			if _, dup := sc.IngressExpiry[hp]; dup {
+				return nil, fmt.Errorf("ingress expiry for %s set in multiple files", hp)
+			}
+			mak.Set(&sc.IngressExpiry, hp, exp)
+		}
+		sc.EncryptedSecrets = sc.EncryptedSecrets || part.EncryptedSecrets
+	}
+	return sc, nil
+}
+
+func (e *serveEnv) runServeShowConfig(ctx context.Context, args []string) error {
+	if e.watch && e.showMount != "" {
+		fmt.Fprintf(e.stderr(), "error: -mount can't be used with -watch\n\n")
+		return flag.ErrHelp
+	}
+	if e.watch && e.resolvePaths {
+		fmt.Fprintf(e.stderr(), "error: -resolve-paths can't be used with -watch\n\n")
+		return flag.ErrHelp
+	}
+	if e.watch && e.ndjson {
+		fmt.Fprintf(e.stderr(), "error: -ndjson can't be used with -watch\n\n")
+		return flag.ErrHelp
+	}
+	if e.watch {
+		return e.watchServeConfig(ctx)
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		return &exitCodeError{serveExitNoConfig, errNoServeConfig}
+	}
+	if e.showMount != "" {
+		mp, err := cleanMountPoint(e.showMount)
+		if err != nil {
+			return serveInvalid(err)
+		}
+		if sc = serveConfigForMount(sc, mp); sc == nil {
+			return fmt.Errorf("no handler at mount point %q", mp)
+		}
+	}
+	if !e.showSecrets {
+		sc = redactServeConfig(sc)
+	}
+	if e.ndjson {
+		if err := writeServeNDJSON(e.stdout(), sc); err != nil {
+			return err
+		}
+	} else {
+		j, err := json.MarshalIndent(sc, "", "  ")
+		if err != nil {
+			return err
+		}
+		e.stdout().Write(append(j, '\n'))
+	}
+	// Annotate overlapping mounts on stderr, to keep stdout valid JSON.
+	for _, hp := range sortedWebHosts(sc) {
+		if order := mountMatchOrder(sc.Web[hp].Handlers); len(order) > 1 {
+			fmt.Fprintf(e.stderr(), "# %s matches mount points in order: %s\n", hp, strings.Join(order, ", "))
+		}
+	}
+	if e.resolvePaths {
+		printPathExistence(e.stderr(), sc)
+	}
+	return nil
+}
+
+// serveNDJSONLine is a line of show-config -ndjson output: either a web
+// handler, with the host:port and mount point it's served at, or a TCP
+// forward.
+type serveNDJSONLine struct {
+	HostPort ipn.HostPort        `json:",omitempty"`
+	Port     uint16              // the listening port
+	Mount    string              `json:",omitempty"`
+	Handler  *ipn.HTTPHandler    `json:",omitempty"`
+	TCP      *ipn.TCPPortHandler `json:",omitempty"`
+}
+
+// writeServeNDJSON writes sc to w as JSON Lines, one serveNDJSONLine per
+// web handler and then per TCP forward, in sorted order. TCP entries that
+// just serve the web handlers aren't written.
+func writeServeNDJSON(w io.Writer, sc *ipn.ServeConfig) error {
+	enc := json.NewEncoder(w)
+	for _, hp := range sortedWebHosts(sc) {
+		handlers := sc.Web[hp].Handlers
+		var port uint16
+		if _, p, err := net.SplitHostPort(string(hp)); err == nil {
+			if n, err := strconv.ParseUint(p, 10, 16); err == nil {
+				port = uint16(n)
+			}
+		}
+		for _, mount := range sortedMounts(handlers) {
+			if err := enc.Encode(serveNDJSONLine{HostPort: hp, Port: port, Mount: mount, Handler: handlers[mount]}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, port := range sortedKeys(sc.TCP, nil) {
+		if th := sc.TCP[port]; th != nil && th.TCPForward != "" {
+			if err := enc.Encode(serveNDJSONLine{Port: port, TCP: th}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// printPathExistence writes to w, for show-config -resolve-paths, a line
+// per file or directory served by a path handler in sc, noting whether it
+// currently exists.
+func printPathExistence(w io.Writer, sc *ipn.ServeConfig) {
+	show := func(url, p string) {
+		state := "exists"
+		if _, err := os.Stat(p); err != nil {
+			state = "MISSING"
+		}
+		fmt.Fprintf(w, "# %s path %s (%s)\n", url, p, state)
+	}
+	for _, hp := range sortedWebHosts(sc) {
+		handlers := sc.Web[hp].Handlers
+		for _, mount := range sortedMounts(handlers) {
+			h := handlers[mount]
+			if h == nil {
+				continue
+			}
+			if h.Path != "" {
+				for _, p := range append([]string{h.Path}, h.ExtraPaths...) {
+					show(string(hp)+mount, p)
+				}
+			}
+			for _, name := range sortedKeys(h.Files, nil) {
+				show(string(hp)+mount+name, h.Files[name])
+			}
+		}
+	}
+}
+
+// redactedSecret replaces secret handler fields in redacted output.
+const redactedSecret = "REDACTED"
+
+// redactServeConfig returns a copy of sc with the secret fields of its
+// handlers replaced by redactedSecret. New secret fields must be added
+// here, to validateHTTPHandler's check for redactedSecret, and to
+// withoutServeSecrets in ipn/ipnlocal, which leaves them out of the
+// config sent to clone-from.
+func redactServeConfig(sc *ipn.ServeConfig) *ipn.ServeConfig {
+	sc = sc.Clone()
+	if sc == nil {
+		return nil
+	}
+	for _, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		for _, h := range wsc.Handlers {
+			if h != nil && h.BasicAuthHash != "" {
+				h.BasicAuthHash = redactedSecret
+			}
+		}
+	}
+	return sc
+}
+
+// serveConfigForMount returns the part of sc that serves mount point mp:
+// the handlers at mp, the TCP entries for their ports, and their ingress
+// settings. It returns nil if no host:port has a handler at mp.
+func serveConfigForMount(sc *ipn.ServeConfig, mp string) *ipn.ServeConfig {
+	if sc == nil {
+		return nil
+	}
+	var out *ipn.ServeConfig
+	for hp, wsc := range sc.Web {
+		if wsc == nil || wsc.Handlers[mp] == nil {
+			continue
+		}
+		h := wsc.Handlers[mp]
+		if out == nil {
+			out = new(ipn.ServeConfig)
+		}
+		mak.Set(&out.Web, hp, &ipn.WebServerConfig{Handlers: map[string]*ipn.HTTPHandler{mp: h}})
+		if _, port, err := net.SplitHostPort(string(hp)); err == nil {
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil && sc.TCP[uint16(p)] != nil {
+				mak.Set(&out.TCP, uint16(p), sc.TCP[uint16(p)])
+			}
+		}
+		if sc.AllowIngress[hp] {
+			mak.Set(&out.AllowIngress, hp, true)
+		}
+		if exp, ok := sc.IngressExpiry[hp]; ok {
+			mak.Set(&out.IngressExpiry, hp, exp)
+		}
+	}
+	return out
+}
+
+// serveConfigJSON returns the current serve config as indented JSON,
+// redacted unless -show-secrets was given.
+func (e *serveEnv) serveConfigJSON(ctx context.Context) ([]byte, error) {
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !e.showSecrets {
+		sc = redactServeConfig(sc)
+	}
+	j, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(j, '\n'), nil
+}
+
+// watchServeConfig polls the serve config every e.watchInterval, clearing
+// the screen and re-printing it each time it changes, until ctx is done
+// or the user hits Ctrl-C.
+func (e *serveEnv) watchServeConfig(ctx context.Context) error {
+	if e.watchInterval <= 0 {
+		return fmt.Errorf("invalid -interval %v", e.watchInterval)
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	t := time.NewTicker(e.watchInterval)
+	defer t.Stop()
+	var last []byte
+	for {
+		j, err := e.serveConfigJSON(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if !bytes.Equal(j, last) {
+			io.WriteString(e.stdout(), "\x1b[H\x1b[2J") // move cursor home and clear screen
+			e.stdout().Write(j)
+			last = j
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// serveRow is one resolved row of the serve status table: a web handler at
+// a mount point, or a TCP forward.
+type serveRow struct {
+	Addr        string // "foo.ts.net:443" for web handlers, ":443" for TCP forwards
+	Mount       string // mount point for web handlers; empty for TCP
+	Type        string // "proxy", "path", "text", "redirect", or "tcp"
+	Target      string // proxy URL, file path, text, or forward address
+	TLS         string // "terminated", "passthrough", or "none" for plaintext HTTP
+	Ingress     bool
+	Health      string // "ok", "missing", "unreachable", or "-"; empty if not checked
+	Description string
+}
+
+// resolveServeRows flattens sc into rows sorted by address and mount point.
+// Only if health is true does it check the rows' targets, which can take
+// a while, and fill in Health.
+func resolveServeRows(sc *ipn.ServeConfig, health bool) []serveRow {
+	var rows []serveRow
+	if sc == nil {
+		return rows
+	}
+	for hp, wsc := range sc.Web {
+		for mount, h := range wsc.Handlers {
+			r := serveRow{
+				Addr:    string(hp),
+				Mount:   mount,
+				TLS:     "terminated",
+				Ingress: sc.AllowIngress[hp],
+			}
+			if webScheme(sc, hp) == "http" {
+				r.TLS = "none"
+			}
+			switch {
+			case h.Proxy != "":
+				r.Type, r.Target = "proxy", h.Proxy
+				if health {
+					r.Health = "-"
+					if addr := proxyBackendAddr(h.Proxy); addr != "" {
+						r.Health = dialHealth(addr)
+					}
+				}
+				r.Description = "proxies to " + h.Proxy
+			case h.Path != "":
+				r.Type, r.Target = "path", h.Path
+				if health {
+					r.Health = "ok"
+					if _, err := os.Stat(h.Path); err != nil {
+						r.Health = "missing"
+					}
+				}
+				r.Description = "serves files from " + h.Path
+				if h.Archive != "" {
+					r.Description = "serves files from the " + h.Archive + " archive " + h.Path
+				}
+			case len(h.Files) > 0:
+				r.Type, r.Target = "path", namedFilesArg(h.Files)
+				if health {
+					r.Health = "ok"
+					for _, p := range handlerFiles(h) {
+						if _, err := os.Stat(p); err != nil {
+							r.Health = "missing"
+						}
+					}
+				}
+				r.Description = fmt.Sprintf("serves %d named files", len(h.Files))
+			case h.Redirect != "":
+				r.Type, r.Target = "redirect", h.Redirect
+				if health {
+					r.Health = "-"
+				}
+				r.Description = "redirects to " + h.Redirect
+			default:
+				r.Type, r.Target = "text", strconv.Quote(h.Text)
+				if health {
+					r.Health = "-"
+				}
+				r.Description = "serves static text"
+			}
+			rows = append(rows, r)
+		}
+	}
+	for port, th := range sc.TCP {
+		if th.TCPForward == "" {
+			continue
+		}
+		portSuffix := ":" + strconv.Itoa(int(port))
+		r := serveRow{
+			Addr:        portSuffix,
+			Type:        "tcp",
+			Target:      th.TCPForward,
+			TLS:         "passthrough",
+			Description: "forwards TCP to " + th.TCPForward,
+		}
+		if health {
+			r.Health = dialHealth(th.TCPForward)
+		}
+		if th.TerminateTLS != "" {
+			r.TLS = "terminated"
+		}
+		for hp, on := range sc.AllowIngress {
+			if on && strings.HasSuffix(string(hp), portSuffix) {
+				r.Ingress = true
+			}
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Addr != rows[j].Addr {
+			return rows[i].Addr < rows[j].Addr
+		}
+		return rows[i].Mount < rows[j].Mount
+	})
+	return rows
+}
+
+// dialHealth reports whether a TCP connection to hostPort can be
+// established quickly, as "ok" or "unreachable".
+func dialHealth(hostPort string) string {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		// No explicit port (e.g. "http://127.0.0.1"); nothing to dial.
+		return "-"
+	}
+	c, err := net.DialTimeout("tcp", hostPort, 500*time.Millisecond)
+	if err != nil {
+		return "unreachable"
+	}
+	c.Close()
+	return "ok"
+}
+
+func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	var wide bool
+	switch e.statusFormat {
+	case "":
+	case "wide":
+		wide = true
+	default:
+		return fmt.Errorf("unknown format %q; want \"wide\" or empty", e.statusFormat)
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		return &exitCodeError{serveExitNoConfig, errNoServeConfig}
+	}
+	tw := tabwriter.NewWriter(e.stdout(), 0, 2, 2, ' ', 0)
+	if wide {
+		fmt.Fprintln(tw, "ADDRESS\tMOUNT\tTARGET\tTYPE\tTLS\tINGRESS\tHEALTH\tDESCRIPTION")
+	} else {
+		fmt.Fprintln(tw, "ADDRESS\tMOUNT\tTARGET")
+	}
+	for _, r := range resolveServeRows(sc, wide) {
+		mount := r.Mount
+		if mount == "" {
+			mount = "-"
+		}
+		if !wide {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Addr, mount, r.Target)
+			continue
+		}
+		ingress := "off"
+		if r.Ingress {
+			ingress = "on"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Addr, mount, r.Target, r.Type, r.TLS, ingress, r.Health, r.Description)
+	}
+	return tw.Flush()
+}
+
+func (e *serveEnv) runServeDoctor(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	problems := diagnoseServeConfig(sc)
+	w := e.stdout()
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "No problems found.")
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Fprintf(w, "- %s\n  hint: %s\n", p.problem, p.hint)
+	}
+	if len(problems) == 1 {
+		return errors.New("found 1 problem")
+	}
+	return fmt.Errorf("found %d problems", len(problems))
+}
+
+// serveProblem is a problem found by "serve doctor".
+type serveProblem struct {
+	problem string
+	hint    string // how to fix it
+}
+
+// diagnoseServeConfig returns the problems "serve doctor" reports for sc,
+// in a stable order. It dials proxy backends, so it may take a moment.
+func diagnoseServeConfig(sc *ipn.ServeConfig) []serveProblem {
+	if sc == nil {
+		return nil
+	}
+	var problems []serveProblem
+	add := func(hint, format string, args ...any) {
+		problems = append(problems, serveProblem{fmt.Sprintf(format, args...), hint})
+	}
+	for _, port := range sortedTCPPorts(sc) {
+		th := sc.TCP[port]
+		if th != nil && th.TCPForward != "" && (th.HTTPS || th.HTTP) {
+			add(fmt.Sprintf("remove the forward with \"tailscale serve tcp off %d\" or move the web handlers to another port", port),
+				"port %d is used by both web handlers and a TCP forward to %s", port, th.TCPForward)
+		}
+	}
+	for _, hp := range sortedWebHosts(sc) {
+		if _, port, err := net.SplitHostPort(string(hp)); err == nil {
+			if p, err := parsePort(port); err == nil {
+				if th := sc.TCP[p]; th == nil || !th.HTTPS && !th.HTTP {
+					add(fmt.Sprintf("re-add a handler with \"tailscale serve\" to claim port %d for web", p),
+						"web handlers for %s are unreachable: port %d isn't set up to serve HTTP or HTTPS", hp, p)
+				}
+			}
+		}
+		handlers := sc.Web[hp].Handlers
+		for _, mount := range sortedMounts(handlers) {
+			h := handlers[mount]
+			for _, p := range handlerFiles(h) {
+				if _, err := os.Stat(p); err != nil {
+					add("restore the file, or point the handler at a new path with \"tailscale serve -force "+mount+" path <path>\"",
+						"%s%s: path %s doesn't exist", hp, mount, p)
+				}
+			}
+			for _, target := range append([]string{h.Proxy}, h.ExtraProxies...) {
+				addr := proxyBackendAddr(target)
+				if addr == "" {
+					continue
+				}
+				if dialHealth(addr) == "unreachable" {
+					add("start the backend, or check the proxy target's port",
+						"%s%s: nothing is accepting connections on %s", hp, mount, addr)
+				}
+			}
+		}
+	}
+	var ingress []string
+	for hp, on := range sc.AllowIngress {
+		if on && !hasIngressTarget(sc, hp) {
+			ingress = append(ingress, string(hp))
+		}
+	}
+	sort.Strings(ingress)
+	for _, hp := range ingress {
+		add("add a handler, or turn ingress off with \"tailscale serve ingress off\"",
+			"ingress is on for %s, but nothing is served there", hp)
+	}
+	return problems
+}
+
+func (e *serveEnv) runServeList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil {
+		return &exitCodeError{serveExitNoConfig, errNoServeConfig}
+	}
+	w := e.stdout()
+	for _, hp := range sortedWebHosts(sc) {
+		handlers := sc.Web[hp].Handlers
+		scheme := webScheme(sc, hp)
+		for _, mount := range sortedMounts(handlers) {
+			h := handlers[mount]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s%s\n", scheme, hp, mount, handlerType(h), handlerArg(h), listLabel(h.Comment))
+		}
+	}
+	for _, port := range sortedTCPPorts(sc) {
+		th := sc.TCP[port]
+		if th.TCPForward == "" {
+			continue
+		}
+		if th.TerminateTLS != "" {
+			fmt.Fprintf(w, "tcp\t%d\tforward\t%s\t%s%s\n", port, th.TCPForward, th.TerminateTLS, listLabel(th.Comment))
+		} else {
+			fmt.Fprintf(w, "tcp\t%d\tforward\t%s%s\n", port, th.TCPForward, listLabel(th.Comment))
+		}
+	}
+	for _, port := range sortedKeys(sc.UDP, nil) {
+		fmt.Fprintf(w, "udp\t%d\tforward\t%s\n", port, sc.UDP[port].UDPForward)
+	}
+	var ingress []string
+	for hp, on := range sc.AllowIngress {
+		if on {
+			ingress = append(ingress, string(hp))
+		}
+	}
+	sort.Strings(ingress)
+	for _, hp := range ingress {
+		if exp, ok := sc.IngressExpiry[ipn.HostPort(hp)]; ok {
+			fmt.Fprintf(w, "ingress\t%s\ton\t%s\n", hp, exp.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(w, "ingress\t%s\ton\n", hp)
+		}
+	}
+	return nil
+}
+
+// listLabel returns the "serve list" column for a handler's Comment, or
+// the empty string if it has none. It's quoted and prefixed with "label="
+// so that it can't be mistaken for an optional column before it.
+func listLabel(comment string) string {
+	if comment == "" {
+		return ""
+	}
+	return "\tlabel=" + strconv.Quote(comment)
+}
+
+// runServeShareLink prints the URL of the handler at the mount point in
+// args, or of the web server if none is given, warning if ingress is off
+// so that the link only works within the tailnet.
+func (e *serveEnv) runServeShareLink(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return flag.ErrHelp
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+	var handlers map[string]*ipn.HTTPHandler
+	if sc != nil && sc.Web[hp] != nil {
+		handlers = sc.Web[hp].Handlers
+	}
+	if len(handlers) == 0 {
+		return fmt.Errorf("nothing is served on %s; add a handler first, like \"tailscale serve / proxy 3000\"", hp)
+	}
+	mount := "/"
+	if len(args) == 1 {
+		mp, err := cleanMountPoint(args[0])
+		if err != nil {
+			return serveInvalid(err)
+		}
+		switch {
+		case handlers[mp] != nil:
+			mount = mp
+		case handlers[mp+"/"] != nil:
+			mount = mp + "/"
+		default:
+			return fmt.Errorf("no handler at mount point %q on %s", mp, hp)
+		}
+	}
+	if !sc.AllowIngress[hp] {
+		fmt.Fprintf(e.stderr(), "Warning: ingress is off for %s, so this link only works within your tailnet; turn it on with \"tailscale serve ingress on\"\n", hp)
+	}
+	fmt.Fprintln(e.stdout(), webURL(webScheme(sc, hp), dnsName, port, mount))
+	return nil
+}
+
+// webURL returns the URL of mount on the web server for dnsName and port,
+// leaving out the port if it's the default for scheme.
+func webURL(scheme, dnsName string, port uint16, mount string) string {
+	host := dnsName
+	if !(scheme == "https" && port == 443 || scheme == "http" && port == 80) {
+		host = string(webHostPort(dnsName, port))
+	}
+	return scheme + "://" + host + mount
+}
+
+// Argument errors from "serve tcp" when adding a forward.
+var (
+	errMissingTCPPort = errors.New("missing <port> argument: the flags given add a TCP forward, which needs the local port to forward to")
+	errTooManyTCPArgs = errors.New("too many arguments: expected a single <port>")
+)
+
+func (e *serveEnv) runServeTCP(ctx context.Context, args []string) error {
+	if len(args) == 2 && args[0] == "off" {
+		return e.removeTCPForward(ctx, args[1])
+	}
+	// Flags that only make sense when adding a forward mean that the
+	// user forgot the port, rather than wanting to list forwards.
+	adding := e.forwardTo != "" || e.terminateTLS.set || e.targetHost != "" || e.probe || e.validateOnly || e.udpToo || e.proxyProtocol != 0
+	if !adding && (len(args) == 0 || len(args) == 1 && args[0] == "show") {
+		return e.showTCPForwards(ctx)
+	}
+	if err := validateProxyProtocol(e.proxyProtocol); err != nil {
+		return serveInvalid(fmt.Errorf("-proxy-protocol: %w", err))
+	}
+	// forwards maps the ports to listen on to their forward targets.
+	forwards := make(map[uint16]string)
+	if e.forwardTo != "" {
+		if len(args) != 0 || e.targetHost != "" {
+			fmt.Fprintf(e.stderr(), "error: -forward-to replaces the <port> argument and -target-host\n\n")
+			return flag.ErrHelp
+		}
+		target, err := parseForwardAddr(e.forwardTo)
+		if err != nil {
+			return serveInvalid(err)
+		}
+		forwards[443] = target
+	} else {
+		switch {
+		case len(args) == 0:
+			return serveInvalid(errMissingTCPPort)
+		case len(args) > 1:
+			return serveInvalid(errTooManyTCPArgs)
+		}
+		portStr := args[0]
+		host := e.targetHost
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		if err := validateTargetHost(host); err != nil {
+			return err
+		}
+		if strings.Contains(portStr, "-") {
+			lo, hi, err := parsePortRange(portStr)
+			if err != nil {
+				return serveInvalid(err)
+			}
+			for p := int(lo); p <= int(hi); p++ {
+				forwards[uint16(p)] = net.JoinHostPort(host, strconv.Itoa(p))
+			}
+		} else {
+			if _, err := parsePort(portStr); err != nil {
+				fmt.Fprintf(e.stderr(), "error: %v\n\n", err)
+				return flag.ErrHelp
+			}
+			forwards[443] = net.JoinHostPort(host, portStr)
+		}
+	}
+
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+
+	var terminateTLS string
+	switch {
+	case e.terminateTLS.name != "":
+		terminateTLS = e.terminateTLS.name
+	case e.terminateTLS.on:
+		dnsName, err := e.getSelfDNSName(ctx)
+		if err != nil {
+			return err
+		}
+		terminateTLS = dnsName
+	}
+	if e.udpToo && terminateTLS != "" {
+		return serveInvalid(errors.New("-udp-too can't be used with -terminate-tls, as UDP forwards don't carry TLS"))
+	}
+	var targets []string
+	for _, port := range sortedKeys(forwards, nil) {
+		if sc.IsServingWebOnPort(port) {
+			return fmt.Errorf("cannot forward TCP on port %d: it's already used by web handlers; remove them or pick a different port", port)
+		}
+		mak.Set(&sc.TCP, port, &ipn.TCPPortHandler{
+			TCPForward:    forwards[port],
+			TerminateTLS:  terminateTLS,
+			ProxyProtocol: e.proxyProtocol,
+			Comment:       e.label,
+		})
+		if e.udpToo {
+			mak.Set(&sc.UDP, port, &ipn.UDPPortHandler{UDPForward: forwards[port]})
+		}
+		targets = append(targets, forwards[port])
+	}
+
+	if stop, err := e.checkMutation(sc, targets...); stop || err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cursc, sc) {
+		return e.noChange()
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// validateProxyProtocol returns an error unless v is a PROXY protocol
+// version that tailscaled can send, or 0 for none.
+func validateProxyProtocol(v int) error {
+	if v != 0 && v != 1 && v != 2 {
+		return fmt.Errorf("invalid PROXY protocol version %d: must be 1 or 2", v)
+	}
+	return nil
+}
+
+// showTCPForwards prints a table of the configured TCP forwards.
+func (e *serveEnv) showTCPForwards(ctx context.Context) error {
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(e.stdout(), 0, 2, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tFORWARD\tTLS")
+	if sc != nil {
+		for _, port := range sortedTCPPorts(sc) {
+			th := sc.TCP[port]
+			if th.TCPForward == "" {
+				continue
+			}
+			tls := "passthrough"
+			if th.TerminateTLS != "" {
+				tls = "terminated (" + th.TerminateTLS + ")"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", port, th.TCPForward, tls)
+		}
+	}
+	return tw.Flush()
+}
+
+// removeTCPForward removes the TCP forwards to portStr, as added by
+// "serve tcp <port>", or to each port of a "lo-hi" range. HTTPS entries
+// used by web handlers are left alone.
+func (e *serveEnv) removeTCPForward(ctx context.Context, portStr string) error {
+	ports := []string{portStr}
+	if strings.Contains(portStr, "-") {
+		lo, hi, err := parsePortRange(portStr)
+		if err != nil {
+			return serveInvalid(err)
+		}
+		ports = nil
+		for p := int(lo); p <= int(hi); p++ {
+			ports = append(ports, strconv.Itoa(p))
+		}
+	} else if _, err := parsePort(portStr); err != nil {
+		fmt.Fprintf(e.stderr(), "error: %v\n\n", err)
+		return flag.ErrHelp
+	}
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone()
+	if sc == nil {
+		return e.noChange()
+	}
+	for port, th := range sc.TCP {
+		if th.TCPForward == "" {
+			continue
+		}
+		if _, fwdPort, err := net.SplitHostPort(th.TCPForward); err == nil && slices.Contains(ports, fwdPort) {
+			delete(sc.TCP, port)
+		}
+	}
+	if reflect.DeepEqual(cursc, sc) {
+		return e.noChange()
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+func (e *serveEnv) runServeUDP(ctx context.Context, args []string) error {
+	if len(args) == 2 && args[0] == "off" {
+		return e.removeUDPForward(ctx, args[1])
+	}
+	if len(args) != 1 {
+		fmt.Fprintf(e.stderr(), "error: invalid number of arguments\n\n")
+		return flag.ErrHelp
+	}
+
+	portStr := args[0]
+	p, err := parsePort(portStr)
+	if err != nil {
+		fmt.Fprintf(e.stderr(), "error: %v\n\n", err)
+		return flag.ErrHelp
+	}
+
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	sc := cursc.Clone() // nil if no config
+	if sc == nil {
+		sc = new(ipn.ServeConfig)
+	}
+
+	host := e.targetHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if err := validateTargetHost(host); err != nil {
+		return err
+	}
+	mak.Set(&sc.UDP, p, &ipn.UDPPortHandler{UDPForward: net.JoinHostPort(host, portStr)})
+
+	// There's nothing to -probe: UDP has no handshake to check.
+	if stop, err := e.checkMutation(sc, ""); stop || err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cursc, sc) {
+		return e.noChange()
+	}
+	return e.setServeConfig(ctx, sc)
+}
+
+// removeUDPForward removes the UDP forward listening on portStr.
+func (e *serveEnv) removeUDPForward(ctx context.Context, portStr string) error {
+	p, err := parsePort(portStr)
+	if err != nil {
+		fmt.Fprintf(e.stderr(), "error: %v\n\n", err)
+		return flag.ErrHelp
+	}
+	cursc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if cursc == nil || cursc.UDP[p] == nil {
+		return e.noChange()
+	}
+	sc := cursc.Clone()
+	delete(sc.UDP, p)
+	return e.setServeConfig(ctx, sc)
+}
+
+// terminateTLSFlag is the value of the tcp -terminate-tls flag. It acts
+// like a boolean flag, but also accepts a cert name (-terminate-tls=name)
+// to use instead of the node's own DNS name.
+type terminateTLSFlag struct {
+	on   bool
+	name string // optional cert name override
+	set  bool   // whether the flag was given at all
+}
+
+func (f *terminateTLSFlag) String() string {
+	if f.name != "" {
+		return f.name
+	}
+	return strconv.FormatBool(f.on)
+}
+
+func (f *terminateTLSFlag) Set(v string) error {
+	f.set = true
+	if b, err := strconv.ParseBool(v); err == nil {
+		f.on, f.name = b, ""
+		return nil
+	}
+	name := strings.TrimSuffix(v, ".")
+	if name == "" || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid cert name %q", v)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label != "*" && !validDNSLabel(label) {
+			return fmt.Errorf("invalid cert name %q", v)
+		}
+	}
+	f.on, f.name = true, name
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value.
+func (f *terminateTLSFlag) IsBoolFlag() bool { return true }
+
+// bodyReplaceFlag is the value of the repeatable -body-replace flag,
+// mapping old strings to new ones.
+type bodyReplaceFlag map[string]string
+
+func (f bodyReplaceFlag) String() string {
+	var pairs []string
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *bodyReplaceFlag) Set(v string) error {
+	from, to, ok := strings.Cut(v, "=")
+	if !ok || from == "" {
+		return fmt.Errorf("invalid body replacement %q; want old=new", v)
+	}
+	mak.Set((*map[string]string)(f), from, to)
+	return nil
+}
+
+// setBoolFlag is a boolean flag that records whether it was given,
+// so that an explicit false can be told apart from the default.
+type setBoolFlag struct {
+	v   bool
+	set bool
+}
+
+func (f *setBoolFlag) String() string { return strconv.FormatBool(f.v) }
+
+func (f *setBoolFlag) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	f.v, f.set = v, true
+	return nil
+}
+
+func (f *setBoolFlag) IsBoolFlag() bool { return true }
+
+// setIntFlag is an integer flag that records whether it was given,
+// so that an explicit zero can be told apart from the default.
+type setIntFlag struct {
+	v   int
+	set bool
+}
+
+func (f *setIntFlag) String() string { return strconv.Itoa(f.v) }
+
+func (f *setIntFlag) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	f.v, f.set = v, true
+	return nil
+}
+
+// hasIngressTarget reports whether sc has something for ingress to reach on
+// hp: web handlers, or a TCP forward on its port.
+func hasIngressTarget(sc *ipn.ServeConfig, hp ipn.HostPort) bool {
+	if sc == nil {
+		return false
+	}
+	if wsc := sc.Web[hp]; wsc != nil && len(wsc.Handlers) > 0 {
+		return true
+	}
+	_, port, err := net.SplitHostPort(string(hp))
+	if err != nil {
+		return false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && sc.IsTCPForwardingOnPort(uint16(p))
+}
+
+// showIngressStatus implements "serve ingress status". It tells apart
+// ingress that's off, on but not active for the reasons it can find, and
+// active.
+func (e *serveEnv) showIngressStatus(ctx context.Context) error {
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	st, err := e.getLocalClientStatus(ctx)
+	if err != nil {
+		return fmt.Errorf("getting client status: %w", err)
+	}
+	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
+	if dnsName == "" {
+		return errors.New("this node has no DNS name yet, so it can't have ingress; log in first")
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+	w := e.stdout()
+	if sc == nil || !sc.AllowIngress[hp] {
+		fmt.Fprintf(w, "Ingress is off for %s.\n", hp)
+		return nil
+	}
+	exp, hasExpiry := sc.IngressExpiry[hp]
+	var problems []string
+	if !slices.Contains(st.Self.Capabilities, tailcfg.CapabilityIngress) {
+		problems = append(problems, "the tailnet hasn't granted this node the ingress capability; check that Funnel is enabled for it in the tailnet policy file")
+	}
+	if hasExpiry && !e.now().Before(exp) {
+		problems = append(problems, "it expired at "+exp.Format(time.RFC3339))
+	}
+	if !hasIngressTarget(sc, hp) {
+		problems = append(problems, "nothing is served on "+string(hp))
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(w, "Ingress is configured for %s, but not active:\n", hp)
+		for _, p := range problems {
+			fmt.Fprintf(w, "  - %s\n", p)
+		}
+		return nil
+	}
+	fmt.Fprintf(w, "Ingress is active for %s, at %s\n", hp, webURL(webScheme(sc, hp), dnsName, port, "/"))
+	if hasExpiry {
+		fmt.Fprintf(w, "It expires at %s.\n", exp.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// runServeIngress implements "serve ingress". Flags may also follow the
+// on/off argument, as in "ingress on -expire 2h"; fs is re-used to parse
+// them.
+func (e *serveEnv) runServeIngress(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	if len(args) > 1 {
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		args = append(args[:1], fs.Args()...)
+	}
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	var on bool
+	switch args[0] {
+	case "on", "off", "status":
+		on = args[0] == "on"
+	default:
+		return flag.ErrHelp
+	}
+	if e.ingressExpire < 0 || e.ingressExpire != 0 && !on {
+		fmt.Fprintf(e.stderr(), "error: -expire must be a positive duration and is only valid with \"on\"\n\n")
+		return flag.ErrHelp
+	}
+	if args[0] == "status" {
+		return e.showIngressStatus(ctx)
+	}
+	sc, err := e.getServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	dnsName, err := e.getSelfDNSName(ctx)
+	if err != nil {
+		return err
+	}
+	port, err := e.webPort()
+	if err != nil {
+		return err
+	}
+	hp := webHostPort(dnsName, port)
+	var allowed, hasExpiry bool
+	if sc != nil {
+		allowed = sc.AllowIngress[hp]
+		_, hasExpiry = sc.IngressExpiry[hp]
+	}
+	if on && allowed && !hasExpiry && e.ingressExpire == 0 ||
+		!on && !allowed && !hasExpiry {
+		return e.noChange()
+	}
+	if on && !hasIngressTarget(sc, hp) {
+		return fmt.Errorf("nothing is served on %s yet; add a handler (like \"tailscale serve / proxy 3000\") or a TCP forward before turning on ingress", hp)
+	}
+	if sc == nil {
+		sc = &ipn.ServeConfig{}
+	}
+	if on {
+		mak.Set(&sc.AllowIngress, hp, true)
+	} else {
+		delete(sc.AllowIngress, hp)
+	}
+	if on && e.ingressExpire != 0 {
+		mak.Set(&sc.IngressExpiry, hp, e.now().Add(e.ingressExpire).UTC().Truncate(time.Second))
 	} else {
-		delete(sc.AllowIngress, "foo:123")
+		delete(sc.IngressExpiry, hp)
 	}
 	return e.setServeConfig(ctx, sc)
 }
@@ -0,0 +1,378 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/mak"
+)
+
+// caddyToken is a token of a Caddyfile and the line it starts on.
+type caddyToken struct {
+	text   string
+	line   int
+	quoted bool // so "{" and "}" are literal
+}
+
+// lexCaddyfile splits src into tokens: words separated by whitespace,
+// strings quoted with "" or “, and braces. Comments start with a "#" at
+// the start of a token and run to the end of the line.
+func lexCaddyfile(src string) ([]caddyToken, error) {
+	var toks []caddyToken
+	line := 1
+	for i := 0; i < len(src); {
+		switch c := src[i]; c {
+		case '\n':
+			line++
+			i++
+		case ' ', '\t', '\r':
+			i++
+		case '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case '"', '`':
+			start := line
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if c == '"' && src[j] == '\\' && j+1 < len(src) && (src[j+1] == '"' || src[j+1] == '\\') {
+					j++
+				}
+				if src[j] == '\n' {
+					line++
+				}
+				b.WriteByte(src[j])
+			}
+			if j == len(src) {
+				return nil, fmt.Errorf("line %d: unterminated quoted string", start)
+			}
+			toks = append(toks, caddyToken{text: b.String(), line: start, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \t\r\n", rune(src[j])) {
+				j++
+			}
+			toks = append(toks, caddyToken{text: src[i:j], line: line})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// caddyDirective is a line of a Caddyfile, such as a site address or a
+// directive, with the block that follows it, if any.
+type caddyDirective struct {
+	line     int
+	args     []string
+	hasBlock bool
+	block    []*caddyDirective
+}
+
+// parseCaddyBlock parses the directives in toks starting at i, up to the
+// "}" closing the block if nested, or to the end of toks. It returns
+// them and the index of the first token after them.
+func parseCaddyBlock(toks []caddyToken, i int, nested bool) ([]*caddyDirective, int, error) {
+	isBrace := func(t caddyToken, b string) bool { return !t.quoted && t.text == b }
+	var ds []*caddyDirective
+	for i < len(toks) {
+		if isBrace(toks[i], "}") {
+			if !nested {
+				return nil, 0, fmt.Errorf("line %d: unexpected }", toks[i].line)
+			}
+			return ds, i + 1, nil
+		}
+		d := &caddyDirective{line: toks[i].line}
+		for i < len(toks) && toks[i].line == d.line && !isBrace(toks[i], "}") {
+			if isBrace(toks[i], "{") {
+				block, next, err := parseCaddyBlock(toks, i+1, true)
+				if err != nil {
+					return nil, 0, err
+				}
+				d.block, d.hasBlock = block, true
+				i = next
+				break
+			}
+			d.args = append(d.args, toks[i].text)
+			i++
+		}
+		ds = append(ds, d)
+	}
+	if nested {
+		return nil, 0, errors.New("unexpected end of file: missing }")
+	}
+	return ds, i, nil
+}
+
+// caddySitePort returns the port of a Caddyfile site address, like
+// "example.com", "example.com:8443", ":8080", or "http://localhost", and
+// whether it serves plaintext HTTP.
+func caddySitePort(addr string) (port uint16, plain bool, err error) {
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		scheme, rest = "", addr
+	}
+	hostPort, _, _ := strings.Cut(rest, "/")
+	var portStr string
+	if i := strings.LastIndex(hostPort, ":"); i >= 0 && !strings.Contains(hostPort[i:], "]") {
+		portStr = hostPort[i+1:]
+	}
+	switch {
+	case portStr != "":
+		if port, err = parsePort(portStr); err != nil {
+			return 0, false, fmt.Errorf("site address %q: %w", addr, err)
+		}
+		return port, scheme == "http" || scheme == "" && port == 80, nil
+	case scheme == "http":
+		return 80, true, nil
+	case scheme == "https" || scheme == "":
+		return 443, false, nil
+	}
+	return 0, false, fmt.Errorf("site address %q: unsupported scheme %q", addr, scheme)
+}
+
+// caddyScope is where the directives of a Caddyfile block apply: the
+// mount point of the enclosing handle or handle_path block, "/" for a
+// site, and whether handle_path strips it from request paths.
+type caddyScope struct {
+	mount string
+	strip bool
+}
+
+// mountFor returns the mount point for a directive's path matcher in s.
+// No matcher, or "*", means s's own mount point.
+func (s caddyScope) mountFor(matcher string) (string, error) {
+	if matcher == "" || matcher == "*" {
+		return s.mount, nil
+	}
+	if strings.HasPrefix(matcher, "@") {
+		return "", fmt.Errorf("named matcher %s isn't supported; only path prefixes like /api/* are", matcher)
+	}
+	m := strings.TrimSuffix(matcher, "*")
+	if strings.ContainsAny(m, "*?[") {
+		return "", fmt.Errorf("path matcher %q isn't supported; only path prefixes like /api/* are", matcher)
+	}
+	if s.strip {
+		// Matchers inside handle_path see the stripped path.
+		m = strings.TrimSuffix(s.mount, "/") + m
+	}
+	return cleanMountPoint(m)
+}
+
+// isCaddyMatcher reports whether a directive argument is a matcher, rather
+// than the directive's own argument.
+func isCaddyMatcher(arg string) bool {
+	return arg == "*" || strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, "@")
+}
+
+// caddySite collects the handlers of a Caddyfile site block.
+type caddySite struct {
+	handlers map[string]*ipn.HTTPHandler // by mount point
+	lines    map[string]int              // line each handler was defined on
+	roots    map[string]string           // root directory, by mount point
+	files    []caddyFileServer           // resolved once all roots are known
+	warn     func(line int, format string, args ...any)
+}
+
+// caddyFileServer is a file_server directive, whose directory depends on
+// root directives that may come after it.
+type caddyFileServer struct {
+	line  int
+	mount string
+	scope caddyScope
+}
+
+func (cs *caddySite) add(line int, mount string, h *ipn.HTTPHandler) error {
+	if prev, ok := cs.lines[mount]; ok {
+		return fmt.Errorf("line %d: more than one handler for %s; the first is on line %d", line, mount, prev)
+	}
+	mak.Set(&cs.handlers, mount, h)
+	mak.Set(&cs.lines, mount, line)
+	return nil
+}
+
+// addBlock adds the handlers for the directives in ds, which apply in s.
+func (cs *caddySite) addBlock(ds []*caddyDirective, s caddyScope) error {
+	for _, d := range ds {
+		if len(d.args) == 0 {
+			continue
+		}
+		name, args := d.args[0], d.args[1:]
+		var matcher string
+		if len(args) > 0 && isCaddyMatcher(args[0]) {
+			matcher, args = args[0], args[1:]
+		}
+		switch name {
+		case "root", "file_server", "reverse_proxy", "handle", "handle_path":
+		default:
+			cs.warn(d.line, "skipping unsupported directive %q", name)
+			continue
+		}
+		mount, err := s.mountFor(matcher)
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %w", d.line, name, err)
+		}
+		switch name {
+		case "root":
+			if len(args) != 1 {
+				return fmt.Errorf("line %d: root takes a directory", d.line)
+			}
+			if !filepath.IsAbs(args[0]) {
+				return fmt.Errorf("line %d: root %q must be an absolute path", d.line, args[0])
+			}
+			mak.Set(&cs.roots, mount, filepath.Clean(args[0]))
+		case "file_server":
+			if len(args) == 1 && args[0] == "browse" {
+				args = nil
+			}
+			if len(args) != 0 || d.hasBlock {
+				cs.warn(d.line, "skipping file_server options; serve always lists directories")
+			}
+			cs.files = append(cs.files, caddyFileServer{line: d.line, mount: mount, scope: s})
+		case "reverse_proxy":
+			if d.hasBlock {
+				cs.warn(d.line, "skipping reverse_proxy options")
+			}
+			if len(args) == 0 {
+				return fmt.Errorf("line %d: reverse_proxy has no upstreams", d.line)
+			}
+			if s.strip {
+				cs.warn(d.line, "handle_path strips %s before proxying, but serve proxies pass the full path to the backend", s.mount)
+			}
+			var targets []string
+			for _, u := range args {
+				t, err := expandProxyTarget(u)
+				if err != nil {
+					return fmt.Errorf("line %d: reverse_proxy upstream %q: %w", d.line, u, err)
+				}
+				targets = append(targets, t)
+			}
+			h := &ipn.HTTPHandler{Proxy: targets[0]}
+			if len(targets) > 1 {
+				h.ExtraProxies = targets[1:]
+			}
+			if err := cs.add(d.line, mount, h); err != nil {
+				return err
+			}
+		case "handle", "handle_path":
+			if !d.hasBlock {
+				return fmt.Errorf("line %d: %s needs a block", d.line, name)
+			}
+			if name == "handle_path" && matcher == "" {
+				return fmt.Errorf("line %d: handle_path needs a path matcher", d.line)
+			}
+			if err := cs.addBlock(d.block, caddyScope{mount: mount, strip: s.strip || name == "handle_path"}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveFiles adds path handlers for cs's file_server directives, using
+// the nearest root directive for each.
+func (cs *caddySite) resolveFiles() error {
+	for _, fsd := range cs.files {
+		root, ok := cs.roots[fsd.mount]
+		if !ok {
+			root, ok = cs.roots[fsd.scope.mount]
+		}
+		if !ok {
+			root, ok = cs.roots["/"]
+		}
+		if !ok {
+			return fmt.Errorf("line %d: file_server needs a root directive with an absolute path", fsd.line)
+		}
+		dir := root
+		if !fsd.scope.strip && fsd.mount != "/" {
+			// Without handle_path, Caddy looks up the full request
+			// path under the root, but serve strips the mount point.
+			dir = filepath.Join(root, filepath.FromSlash(fsd.mount))
+		}
+		mount := fsd.mount
+		if !strings.HasSuffix(mount, "/") {
+			mount += "/"
+		}
+		if err := cs.add(fsd.line, mount, &ipn.HTTPHandler{Path: dir}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// caddyfileToServeConfig converts the site blocks of the Caddyfile src to
+// a serve config for the node dnsName. Each site's reverse_proxy and
+// file_server directives become proxy and path handlers on the site's port.
+// It calls warn for each part of src it skips.
+func caddyfileToServeConfig(src, dnsName string, warn func(line int, format string, args ...any)) (*ipn.ServeConfig, error) {
+	toks, err := lexCaddyfile(src)
+	if err != nil {
+		return nil, err
+	}
+	ds, _, err := parseCaddyBlock(toks, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	sc := new(ipn.ServeConfig)
+	for _, d := range ds {
+		switch {
+		case len(d.args) == 0:
+			// The global options block.
+			continue
+		case strings.HasPrefix(d.args[0], "("):
+			warn(d.line, "skipping snippet %s", d.args[0])
+			continue
+		case !d.hasBlock:
+			return nil, fmt.Errorf("line %d: expected a site address followed by a block in braces", d.line)
+		}
+		cs := &caddySite{warn: warn}
+		if err := cs.addBlock(d.block, caddyScope{mount: "/"}); err != nil {
+			return nil, err
+		}
+		if err := cs.resolveFiles(); err != nil {
+			return nil, err
+		}
+		for _, arg := range d.args {
+			for _, addr := range strings.Split(arg, ",") {
+				if addr == "" {
+					continue
+				}
+				port, plain, err := caddySitePort(addr)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", d.line, err)
+				}
+				mak.Set(&sc.TCP, port, &ipn.TCPPortHandler{HTTPS: !plain, HTTP: plain})
+				hp := webHostPort(dnsName, port)
+				if sc.Web[hp] == nil {
+					mak.Set(&sc.Web, hp, new(ipn.WebServerConfig))
+				}
+				for _, mount := range sortedKeys(cs.handlers, nil) {
+					if _, dup := sc.Web[hp].Handlers[mount]; dup {
+						return nil, fmt.Errorf("line %d: more than one site has a handler for %s on port %d", d.line, mount, port)
+					}
+					mak.Set(&sc.Web[hp].Handlers, mount, cs.handlers[mount].Clone())
+				}
+			}
+		}
+	}
+	if len(sc.Web) == 0 {
+		return nil, errors.New("no site blocks found")
+	}
+	for hp, wsc := range sc.Web {
+		if len(wsc.Handlers) == 0 {
+			return nil, fmt.Errorf("no reverse_proxy or file_server directives for %s", hp)
+		}
+	}
+	if err := validateServeConfig(sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestCaddyfileToServeConfig(t *testing.T) {
+	const caddyfile = `
+{
+	email admin@example.com
+}
+
+# The main site.
+example.com {
+	encode gzip
+	root * /srv/www
+	reverse_proxy /api/* localhost:8080 :8081
+	handle_path /static/* {
+		root * /srv/static
+		file_server
+	}
+	handle /docs/* {
+		file_server browse
+	}
+	reverse_proxy "localhost:3000"
+}
+
+http://example.com:8080 {
+	reverse_proxy /metrics 9090 {
+		header_up Host {host}
+	}
+}
+`
+	var warnings []string
+	warn := func(line int, format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf("%d: ", line)+fmt.Sprintf(format, args...))
+	}
+	got, err := caddyfileToServeConfig(caddyfile, "foo.test.ts.net", warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			8080: {HTTP: true},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":        {Proxy: "http://127.0.0.1:3000"},
+				"/api/":    {Proxy: "http://127.0.0.1:8080", ExtraProxies: []string{"http://127.0.0.1:8081"}},
+				"/static/": {Path: "/srv/static"},
+				"/docs/":   {Path: "/srv/www/docs"},
+			}},
+			"foo.test.ts.net:8080": {Handlers: map[string]*ipn.HTTPHandler{
+				"/metrics": {Proxy: "http://127.0.0.1:9090"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", asJSON(got), asJSON(want))
+	}
+	wantWarnings := []string{
+		`8: skipping unsupported directive "encode"`,
+		"22: skipping reverse_proxy options",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("warnings = %q; want %q", warnings, wantWarnings)
+	}
+
+	for _, tt := range []struct {
+		name, src, wantErr string
+	}{
+		{"no-root", "a.com {\n\tfile_server\n}", "line 2: file_server needs a root directive"},
+		{"relative-root", "a.com {\n\troot * www\n}", `line 2: root "www" must be an absolute path`},
+		{"remote-upstream", "a.com {\n\treverse_proxy 10.0.0.1:80\n}", `line 2: reverse_proxy upstream "10.0.0.1:80"`},
+		{"named-matcher", "a.com {\n\treverse_proxy @api 3000\n}", "named matcher @api isn't supported"},
+		{"duplicate", "a.com {\n\treverse_proxy 3000\n\treverse_proxy * 3001\n}", "line 3: more than one handler for /"},
+		{"unclosed", "a.com {\n\treverse_proxy 3000\n", "missing }"},
+		{"no-block", "a.com\nreverse_proxy 3000\n", "line 1: expected a site address"},
+		{"no-handlers", "a.com {\n\tencode gzip\n}", "no reverse_proxy or file_server directives"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := caddyfileToServeConfig(tt.src, "foo.test.ts.net", func(int, string, ...any) {})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v; want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeImportCaddyfile(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdin:   strings.NewReader("example.com {\n\treverse_proxy localhost:3000\n\tlog\n}\n"),
+		testStdout:  &stdout,
+		testStderr:  &stderr,
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return nil, nil
+		},
+		testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+			t.Error("import -format must not save the serve config")
+			return nil
+		},
+		testGetLocalClientStatus: fakeRunningStatus,
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("import -format caddyfile -f -")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeServeConfig(&stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s; want %s", asJSON(got), asJSON(want))
+	}
+	if want := "Warning: -:3: skipping unsupported directive \"log\"\n"; stderr.String() != want {
+		t.Errorf("stderr = %q; want %q", stderr.String(), want)
+	}
+
+	e.testStdin = strings.NewReader("")
+	err = newServeCommand(e).ParseAndRun(context.Background(), cmd("import -format nginx -f -"))
+	if ExitCode(err) != serveExitInvalid {
+		t.Errorf("unknown -format: got %v; want exit status %d", err, serveExitInvalid)
+	}
+}
@@ -5,16 +5,42 @@
 package cli
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 func TestServeConfigMutations(t *testing.T) {
@@ -35,15 +61,54 @@ type step struct {
 	add(step{reset: true})
 	add(step{
 		command: cmd("ingress on"),
-		want:    &ipn.ServeConfig{AllowIngress: map[ipn.HostPort]bool{"foo:123": true}},
+		wantErr: anyErr(), // nothing to serve
+	})
+	add(step{
+		command: cmd("ingress off"),
+		want:    nil, // nothing to save
+	})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("ingress on"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
 	})
 	add(step{
 		command: cmd("ingress on"),
 		want:    nil, // nothing to save
 	})
+	add(step{
+		command: cmd("-http ingress on"),
+		wantErr: anyErr(), // nothing on port 80
+	})
 	add(step{
 		command: cmd("ingress off"),
-		want:    &ipn.ServeConfig{AllowIngress: map[ipn.HostPort]bool{}},
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{},
+		},
 	})
 	add(step{
 		command: cmd("ingress off"),
@@ -53,74 +118,5809 @@ type step struct {
 		command: cmd("ingress"),
 		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
 	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("ingress on"),
+		want: &ipn.ServeConfig{
+			TCP:          map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		want:    nil, // nothing to save
+	})
+	add(step{
+		command: cmd("/foo proxy localhost:3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Proxy: "http://127.0.0.1:3001"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/foo/ text hi"), // replaces /foo
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":     {Proxy: "http://127.0.0.1:3000"},
+					"/foo/": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/foo text bye"), // replaces /foo/
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Text: "bye"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/api proxy http://localhost:3000/v2"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Text: "bye"},
+					"/api": {Proxy: "http://127.0.0.1:3000/v2"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/api proxy localhost:3000/v2/?key=a%20b"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Text: "bye"},
+					"/api": {Proxy: "http://127.0.0.1:3000/v2/?key=a%20b"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/api proxy http://localhost:3000/"), // bare slash is dropped
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Text: "bye"},
+					"/api": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/bar proxy https://example.com"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/bar proxy ftp://localhost:21"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/bar proxy 0"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/bar/../baz text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/x?y=1 text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/x? text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/x#frag text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("//example.com/x text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-status 503 /healthz text down"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":        {Proxy: "http://127.0.0.1:3000"},
+					"/foo":     {Text: "bye"},
+					"/api":     {Proxy: "http://127.0.0.1:3000"},
+					"/healthz": {Text: "down", StatusCode: 503},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/healthz text OK"), // back to the default 200
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":        {Proxy: "http://127.0.0.1:3000"},
+					"/foo":     {Text: "bye"},
+					"/api":     {Proxy: "http://127.0.0.1:3000"},
+					"/healthz": {Text: "OK"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-status 99 /healthz text OK"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-status 600 /healthz text OK"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-status 503 /api proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/bar bogus-type arg"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("/bar text"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+
+	// http
+	add(step{reset: true})
+	add(step{
+		command: cmd("-http / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-http ingress on"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:80": true},
+		},
+	})
+	add(step{
+		command: cmd("ingress -http off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{},
+		},
+	})
+	add(step{
+		command: cmd("/ text hi"), // HTTPS alongside HTTP
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}, 443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{},
+		},
+	})
+	add(step{
+		command: cmd("-http -hsts 3600 / text hi"),
+		wantErr: anyErr(),
+	})
+
+	// path
+	td := t.TempDir()
+	writeFile := func(suffix, contents string) {
+		if err := os.WriteFile(filepath.Join(td, suffix), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(step{reset: true})
+	writeFile("foo", "this is foo")
+	add(step{
+		command: cmd("/ path " + filepath.Join(td, "foo")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Path: filepath.Join(td, "foo")},
+				}},
+			},
+		},
+	})
+	os.MkdirAll(filepath.Join(td, "subdir"), 0700)
+	add(step{
+		command: cmd("/some/where path " + filepath.Join(td, "subdir")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":            {Path: filepath.Join(td, "foo")},
+					"/some/where/": {Path: filepath.Join(td, "subdir")},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/ path " + filepath.Join(td, "does-not-exist")),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("-base-dir " + td + " / path foo"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Path: filepath.Join(td, "foo")},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-base-dir " + filepath.Join(td, "subdir") + " /foo path ../foo"),
+		wantErr: anyErr(),
+	})
+
+	// multiple mount points
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ /app proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/app": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/app/ /b /b /c text hi"), // /app/ replaces /app; /b is deduped
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":     {Proxy: "http://127.0.0.1:3000"},
+					"/app/": {Text: "hi"},
+					"/b":    {Text: "hi"},
+					"/c":    {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/x /x/ text hi"), // would replace each other
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/x /y?z text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("proxy 3000"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("/x /y proxy"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{reset: true})
+	os.MkdirAll(filepath.Join(td, "multi"), 0700)
+	add(step{
+		command: cmd("/docs /files/ path " + filepath.Join(td, "multi")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/docs/":  {Path: filepath.Join(td, "multi")},
+					"/files/": {Path: filepath.Join(td, "multi")},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/docs /docs/ path " + filepath.Join(td, "multi")),
+		want:    nil, // both are /docs/, which is already set
+	})
+
+	// move
+	add(step{reset: true})
+	add(step{
+		command: cmd("-hsts 60 /old proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old": {Proxy: "http://127.0.0.1:3000", HSTSMaxAge: 60},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/other text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old":   {Proxy: "http://127.0.0.1:3000", HSTSMaxAge: 60},
+					"/other": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("move /old new"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/new":   {Proxy: "http://127.0.0.1:3000", HSTSMaxAge: 60},
+					"/other": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("move /old /x"),
+		wantErr: anyErr(), // nothing at /old anymore
+	})
+	add(step{
+		command: cmd("move /new /other/"),
+		wantErr: anyErr(), // /other is taken
+	})
+	add(step{
+		command: cmd("move /new /a?b"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("move -force /new /other/"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/other/": {Proxy: "http://127.0.0.1:3000", HSTSMaxAge: 60},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("move /other"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{reset: true})
+	writeFile("f.txt", "f")
+	add(step{
+		command: cmd("/f path f.txt=" + filepath.Join(td, "f.txt")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/f/": {Files: map[string]string{"f.txt": filepath.Join(td, "f.txt")}},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("move /f/ /g"), // named files keep their directory slash
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/g/": {Files: map[string]string{"f.txt": filepath.Join(td, "f.txt")}},
+				}},
+			},
+		},
+	})
+
+	// text @file
+	add(step{reset: true})
+	writeFile("banner.html", "<h1>hi</h1>\n")
+	writeFile("empty.html", "")
+	writeFile("big.html", strings.Repeat("x", maxTextFileSize+1))
+	add(step{
+		command: cmd("/ text @" + filepath.Join(td, "banner.html")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "<h1>hi</h1>\n"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/at text @@home"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":   {Text: "<h1>hi</h1>\n"},
+					"/at": {Text: "@home"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/missing text @" + filepath.Join(td, "does-not-exist.html")),
+		wantErr: func(err error) string {
+			if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Sprintf("got error %v; want a not-exist error", err)
+			}
+			return ""
+		},
+	})
+	add(step{
+		command: cmd("/empty text @" + filepath.Join(td, "empty.html")),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/big text @" + filepath.Join(td, "big.html")),
+		wantErr: anyErr(),
+	})
+
+	// -expand-env
+	t.Setenv("TS_TEST_SERVE_PORT", "3030")
+	t.Setenv("TS_TEST_SERVE_ROOT", filepath.Join(td, "subdir"))
+	add(step{reset: true})
+	add(step{
+		command: cmd("-expand-env / proxy $TS_TEST_SERVE_PORT"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3030"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-expand-env /docs path ${TS_TEST_SERVE_ROOT}"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":      {Proxy: "http://127.0.0.1:3030"},
+					"/docs/": {Path: filepath.Join(td, "subdir")},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-expand-env /t text $TS_TEST_SERVE_PORT"), // text is never expanded
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":      {Proxy: "http://127.0.0.1:3030"},
+					"/docs/": {Path: filepath.Join(td, "subdir")},
+					"/t":     {Text: "$TS_TEST_SERVE_PORT"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/x proxy $TS_TEST_SERVE_PORT"), // no -expand-env
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-expand-env /x proxy $TS_TEST_SERVE_UNSET"),
+		wantErr: anyErr(),
+	})
+
+	// path -append
+	add(step{reset: true})
+	os.MkdirAll(filepath.Join(td, "theme"), 0700)
+	add(step{
+		command: cmd("-append /site path " + filepath.Join(td, "subdir")),
+		wantErr: anyErr(), // nothing to append to
+	})
+	add(step{
+		command: cmd("-hsts 60 /site path " + filepath.Join(td, "subdir")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/site/": {Path: filepath.Join(td, "subdir"), HSTSMaxAge: 60},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-append /site path " + filepath.Join(td, "theme")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/site/": {
+						Path:       filepath.Join(td, "subdir"),
+						ExtraPaths: []string{filepath.Join(td, "theme")},
+						HSTSMaxAge: 60,
+					},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-append /site path " + filepath.Join(td, "theme")),
+		want:    nil, // already layered
+	})
+	add(step{
+		command: cmd("-append /site path " + filepath.Join(td, "foo")),
+		wantErr: anyErr(), // not a directory
+	})
+	add(step{
+		command: cmd("-append /site proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/site path " + filepath.Join(td, "theme")), // replaces the layers
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/site/": {Path: filepath.Join(td, "theme")},
+				}},
+			},
+		},
+	})
+	writeFile("extra-paths-no-path.json", `{"Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Text": "hi", "ExtraPaths": ["/tmp"]}}}}}`)
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "extra-paths-no-path.json")),
+		wantErr: anyErr(),
+	})
+
+	// apply
+	add(step{reset: true})
+	writeFile("serve.json", `{
+		"TCP": {"443": {"HTTPS": true}},
+		"Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Proxy": "http://127.0.0.1:3000"}}}},
+		"AllowIngress": {"foo.test.ts.net:443": true}
+	}`)
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "serve.json")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	writeFile("unknown-field.json", `{"TCP": {"443": {"HTTPS": true, "Bogus": 1}}}`)
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "unknown-field.json")),
+		wantErr: anyErr(),
+	})
+	writeFile("bad-port.json", `{"TCP": {"0": {"HTTPS": true}}}`)
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "bad-port.json")),
+		wantErr: anyErr(),
+	})
+	writeFile("bad-proxy.json", `{"Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Proxy": "ftp://127.0.0.1:21"}}}}}`)
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "bad-proxy.json")),
+		wantErr: anyErr(),
+	})
+	writeFile("two-kinds.json", `{"Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Text": "hi", "Path": "/tmp"}}}}}`)
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "two-kinds.json")),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("apply -f " + filepath.Join(td, "missing.json")),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("apply"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+
+	// tcp
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls 8443"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {
+				TCPForward:   "127.0.0.1:8443",
+				TerminateTLS: "foo.test.ts.net",
+			}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls=false 8445"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:8445"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls=db.example.com 8443"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {
+				TCPForward:   "127.0.0.1:8443",
+				TerminateTLS: "db.example.com",
+			}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls=true 8443"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {
+				TCPForward:   "127.0.0.1:8443",
+				TerminateTLS: "foo.test.ts.net",
+			}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls=bad_name! 8443"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("tcp"),
+		want:    nil, // shows forwards; nothing to save
+	})
+	add(step{
+		command: cmd("tcp 8443 8444"),
+		wantErr: exactErr(errTooManyTCPArgs, "errTooManyTCPArgs"),
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls 8443 8444"),
+		wantErr: exactErr(errTooManyTCPArgs, "errTooManyTCPArgs"),
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls"), // not a request to list forwards
+		wantErr: exactErr(errMissingTCPPort, "errMissingTCPPort"),
+	})
+	add(step{
+		command: cmd("tcp -terminate-tls=false"),
+		wantErr: exactErr(errMissingTCPPort, "errMissingTCPPort"),
+	})
+	add(step{
+		command: cmd("tcp -target-host 10.0.0.5"),
+		wantErr: exactErr(errMissingTCPPort, "errMissingTCPPort"),
+	})
+	add(step{
+		command: cmd("tcp 0"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("tcp 70000"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("/ proxy 70000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("tcp -target-host 10.88.0.2 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "10.88.0.2:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -target-host db.internal 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "db.internal:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -target-host ::1 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "[::1]:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -target-host 10.88.0.2:5432 5432"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("tcp -target-host http://10.88.0.2 5432"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("tcp -target-host bad_host! 5432"),
+		wantErr: anyErr(),
+	})
+
+	// tcp port ranges
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp -target-host 10.88.0.2 50000-50002"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				50000: {TCPForward: "10.88.0.2:50000"},
+				50001: {TCPForward: "10.88.0.2:50001"},
+				50002: {TCPForward: "10.88.0.2:50002"},
+			},
+		},
+	})
+	add(step{
+		command: cmd("tcp 21"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:   {TCPForward: "127.0.0.1:21"},
+				50000: {TCPForward: "10.88.0.2:50000"},
+				50001: {TCPForward: "10.88.0.2:50001"},
+				50002: {TCPForward: "10.88.0.2:50002"},
+			},
+		},
+	})
+	add(step{
+		command: cmd("tcp off 50001-50002"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:   {TCPForward: "127.0.0.1:21"},
+				50000: {TCPForward: "10.88.0.2:50000"},
+			},
+		},
+	})
+	for _, bad := range []string{
+		"tcp 50010-50000",                 // inverted
+		"tcp 50000-50100",                 // 101 ports
+		"tcp 1-65535",                     // far too many
+		"tcp 0-10",                        // port 0
+		"tcp 50000-",                      // no end
+		"tcp 50000-50001-50002",           // not a range
+		"tcp off 50010-50000",             // inverted
+		"tcp -forward-to 10.0.0.1:80 1-2", // -forward-to takes no port
+	} {
+		add(step{command: cmd(bad), wantErr: anyErr()})
+	}
+
+	// tcp off
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp off 5432"),
+		want:    nil, // nothing to remove
+	})
+	add(step{
+		command: cmd("tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp off 5433"),
+		want:    nil, // no forward to that port
+	})
+	add(step{
+		command: cmd("tcp off 5432"),
+		want:    &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{}},
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("tcp off 443"),
+		want:    nil, // the HTTPS entry for web handlers is not a forward
+	})
+	add(step{
+		command: cmd("tcp off 0"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+
+	// proxy :port
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ proxy :3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/ proxy :3000/v2"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000/v2"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/ proxy :0"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/ proxy :"),
+		wantErr: anyErr(),
+	})
+
+	// ingress -expire
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("ingress on --expire 2h"),
+		want: &ipn.ServeConfig{
+			TCP:           map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			AllowIngress:  map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+			IngressExpiry: map[ipn.HostPort]time.Time{"foo.test.ts.net:443": fakeNow.Add(2 * time.Hour)},
+		},
+	})
+	add(step{
+		command: cmd("ingress -expire 30m on"),
+		want: &ipn.ServeConfig{
+			TCP:           map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			AllowIngress:  map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+			IngressExpiry: map[ipn.HostPort]time.Time{"foo.test.ts.net:443": fakeNow.Add(30 * time.Minute)},
+		},
+	})
+	add(step{
+		command: cmd("ingress on"), // drops the expiry
+		want: &ipn.ServeConfig{
+			TCP:           map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			AllowIngress:  map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+			IngressExpiry: map[ipn.HostPort]time.Time{},
+		},
+	})
+	add(step{
+		command: cmd("ingress on -expire 1h"),
+		want: &ipn.ServeConfig{
+			TCP:           map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			AllowIngress:  map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+			IngressExpiry: map[ipn.HostPort]time.Time{"foo.test.ts.net:443": fakeNow.Add(time.Hour)},
+		},
+	})
+	add(step{
+		command: cmd("ingress off"),
+		want: &ipn.ServeConfig{
+			TCP:           map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			AllowIngress:  map[ipn.HostPort]bool{},
+			IngressExpiry: map[ipn.HostPort]time.Time{},
+		},
+	})
+	add(step{
+		command: cmd("ingress off -expire 1h"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("ingress on -expire -1h"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("ingress on -expire soon"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("ingress on extra"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+
+	// udp
+	add(step{reset: true})
+	add(step{
+		command: cmd("udp 53"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:53"}},
+		},
+	})
+	add(step{
+		command: cmd("udp -target-host ::1 3478"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{
+				53:   {UDPForward: "127.0.0.1:53"},
+				3478: {UDPForward: "[::1]:3478"},
+			},
+		},
+	})
+	add(step{
+		command: cmd("udp -validate-only 5000"),
+		want:    nil, // validated only
+	})
+	add(step{
+		command: cmd("udp off 53"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{3478: {UDPForward: "[::1]:3478"}},
+		},
+	})
+	add(step{
+		command: cmd("udp off 53"),
+		want:    nil, // already removed
+	})
+	add(step{
+		command: cmd("udp 0"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("udp 70000"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("udp"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+	add(step{
+		command: cmd("udp -target-host bad_host! 53"),
+		wantErr: anyErr(),
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("udp 443"),
+		want: &ipn.ServeConfig{
+			UDP: map[uint16]*ipn.UDPPortHandler{443: {UDPForward: "127.0.0.1:443"}},
+		},
+	})
+	add(step{
+		command: cmd("/ text hi"), // UDP 443 doesn't collide with HTTPS
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			UDP: map[uint16]*ipn.UDPPortHandler{443: {UDPForward: "127.0.0.1:443"}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
+		},
+	})
+
+	// web and TCP forwards colliding on port 443
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("tcp 5432"),
+		wantErr: anyErr(),
+	})
+
+	// maintenance window
+	add(step{reset: true})
+	add(step{
+		command: cmd("-maintenance-window=sat_02:00-04:00 / text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: []string{"-maintenance-window", "sat 2:00-04:30", "/", "text", "hi"},
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi", MaintenanceWindow: "Sat 02:00-04:30"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: []string{"-maintenance-window", "Sun 23:00-01:00", "/", "text", "hi"},
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi", MaintenanceWindow: "Sun 23:00-01:00"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: []string{"-maintenance-window", "Sat 02:00-24:00", "/", "text", "hi"},
+		wantErr: anyErr(),
+	})
+
+	// rate limit
+	add(step{reset: true})
+	add(step{
+		command: cmd("-rate-limit 10/S / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", RateLimit: "10/s"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-rate-limit 10/s /hi text hi"),
+		wantErr: anyErr(), // only for proxy and path
+	})
+	add(step{
+		command: cmd("-rate-limit 10/day / proxy 3000"),
+		wantErr: anyErr(),
+	})
+
+	// hsts
+	add(step{reset: true})
+	add(step{
+		command: cmd("-hsts 63072000 / text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi", HSTSMaxAge: 63072000},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-hsts 300 -hsts-subdomains / text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi", HSTSMaxAge: 300, HSTSIncludeSubdomains: true},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-hsts -1 / text hi"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-hsts-subdomains / text hi"),
+		wantErr: anyErr(),
+	})
+
+	// multiple backends and sticky sessions
+	add(step{reset: true})
+	add(step{
+		command: cmd("-sticky cookie / proxy 3000,localhost:3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {
+						Proxy:          "http://127.0.0.1:3000",
+						ExtraProxies:   []string{"http://127.0.0.1:3001"},
+						StickySessions: "cookie",
+					},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-sticky ip / proxy 3000,3001"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {
+						Proxy:          "http://127.0.0.1:3000",
+						ExtraProxies:   []string{"http://127.0.0.1:3001"},
+						StickySessions: "ip",
+					},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-sticky ip / proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-sticky bogus / proxy 3000,3001"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/ proxy 3000,"),
+		wantErr: anyErr(),
+	})
+
+	// body rewriting
+	add(step{reset: true})
+	add(step{
+		command: cmd("-body-replace http://127.0.0.1:3000=https://foo.test.ts.net -body-replace a=b / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {
+						Proxy:          "http://127.0.0.1:3000",
+						BodyReplace:    map[string]string{"http://127.0.0.1:3000": "https://foo.test.ts.net", "a": "b"},
+						DecodeUpstream: true,
+					},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-body-replace a=b -decode-upstream=false / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {
+						Proxy:       "http://127.0.0.1:3000",
+						BodyReplace: map[string]string{"a": "b"},
+					},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-decode-upstream / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000", DecodeUpstream: true},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-body-replace =b / proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-body-replace a=b / text hi"),
+		wantErr: anyErr(),
+	})
+
+	// -max-body
+	add(step{reset: true})
+	add(step{
+		command: cmd("-max-body 10MB /upload proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/upload": {Proxy: "http://127.0.0.1:3000", MaxRequestBytes: 10 << 20},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-max-body 10XB /upload proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-max-body 10MB /t text hi"),
+		wantErr: anyErr(),
+	})
+
+	// -must-change
+	add(step{reset: true})
+	add(step{
+		command: cmd("-must-change / text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/ text hi"),
+		want:    nil, // no change, and that's fine without -must-change
+	})
+	add(step{
+		command: cmd("-must-change / text hi"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{
+		command: cmd("-must-change tcp off 5432"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{
+		command: cmd("-must-change udp off 53"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{
+		command: cmd("-must-change ingress off"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{
+		command: cmd("-must-change ingress on"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	add(step{
+		command: cmd("-must-change ingress on"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("-must-change tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("-must-change tcp 5432"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{
+		command: cmd("-must-change udp 53"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:53"}},
+		},
+	})
+	add(step{
+		command: cmd("-must-change udp 53"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+
+	// h2c:// backends
+	add(step{reset: true})
+	add(step{
+		command: cmd("/grpc proxy h2c://localhost:50051"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/grpc": {Proxy: "h2c://127.0.0.1:50051"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/grpc proxy h2c://localhost:50051/v1"), // like http://, the path is kept
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/grpc": {Proxy: "h2c://127.0.0.1:50051/v1"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/grpc proxy h2c://example.com:50051"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/grpc proxy h2cs://localhost:50051"),
+		wantErr: anyErr(),
+	})
+
+	// set
+	add(step{reset: true})
+	add(step{command: cmd("/old text bye"), want: &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/old": {Text: "bye"}}},
+		},
+	}})
+	add(step{command: cmd("-http / text plain"), want: &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}, 443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:80":  {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "plain"}}},
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/old": {Text: "bye"}}},
+		},
+	}})
+	add(step{command: cmd("udp 53"), want: &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}, 443: {HTTPS: true}},
+		UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:53"}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:80":  {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "plain"}}},
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/old": {Text: "bye"}}},
+		},
+	}})
+	add(step{
+		command: cmd("set / proxy 3000 /docs /help text hi"), // /old is removed
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}, 443: {HTTPS: true}},
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:53"}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "plain"}}},
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":     {Proxy: "http://127.0.0.1:3000"},
+					"/docs": {Text: "hi"},
+					"/help": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-must-change set / proxy 3000 /docs /help text hi"),
+		wantErr: exactErr(errNoChange, "errNoChange"),
+	})
+	add(step{
+		command: cmd("-http set /new text new"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}, 443: {HTTPS: true}},
+			UDP: map[uint16]*ipn.UDPPortHandler{53: {UDPForward: "127.0.0.1:53"}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{"/new": {Text: "new"}}},
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":     {Proxy: "http://127.0.0.1:3000"},
+					"/docs": {Text: "hi"},
+					"/help": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("set / proxy 3000 /docs text hi /docs text again"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("set / proxy 3000 /docs text hi /docs/ text again"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("set / proxy 3000 /docs"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("set"),
+		wantErr: exactErr(flag.ErrHelp, "flag.ErrHelp"),
+	})
+
+	// redirect
+	add(step{reset: true})
+	add(step{
+		command: cmd("/old redirect https://example.com/new"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old": {Redirect: "https://example.com/new"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-status 301 /old /older redirect /new?from=old"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/old":   {Redirect: "/new?from=old", StatusCode: 301},
+					"/older": {Redirect: "/new?from=old", StatusCode: 301},
+				}},
+			},
+		},
+	})
+	for _, bad := range []string{
+		"/old redirect example.com/new",       // no scheme, and not a path
+		"/old redirect //example.com/new",     // scheme-relative
+		"/old redirect ftp://example.com/new", // not http(s)
+		"/old redirect https:///new",          // no host
+		"-status 200 /old redirect /new",      // not a redirect status
+		"-status 303 /old redirect /new",      // changes the method
+		"-status 301 /old proxy 3000",         // -status isn't for proxies
+	} {
+		add(step{command: cmd(bad), wantErr: anyErr()})
+	}
+
+	// path with named files
+	add(step{reset: true})
+	writeFile("subdir/a.zip", "A")
+	writeFile("b.zip", "B")
+	add(step{
+		command: cmd("/downloads path a.zip=" + filepath.Join(td, "subdir/a.zip") + " b.zip=" + filepath.Join(td, "b.zip")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/downloads/": {Files: map[string]string{
+						"a.zip": filepath.Join(td, "subdir/a.zip"),
+						"b.zip": filepath.Join(td, "b.zip"),
+					}},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("set /downloads path latest.zip=" + filepath.Join(td, "b.zip") + " / text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":           {Text: "hi"},
+					"/downloads/": {Files: map[string]string{"latest.zip": filepath.Join(td, "b.zip")}},
+				}},
+			},
+		},
+	})
+	for _, bad := range []string{
+		"/dl path a.zip=" + filepath.Join(td, "b.zip") + " " + filepath.Join(td, "foo"),       // mixes a plain path in
+		"/dl path a.zip=" + filepath.Join(td, "b.zip") + " a.zip=" + filepath.Join(td, "foo"), // duplicate name
+		"/dl path ..=" + filepath.Join(td, "b.zip"),                                           // bad name
+		"/dl path sub=" + filepath.Join(td, "subdir"),                                         // a directory
+		"/dl path a.zip=" + filepath.Join(td, "does-not-exist"),                               // missing
+		"-append /dl path a.zip=" + filepath.Join(td, "b.zip"),                                // not a directory
+		"/dl proxy 3000 a.zip=" + filepath.Join(td, "b.zip"),                                  // only for path
+	} {
+		add(step{command: cmd(bad), wantErr: anyErr()})
+	}
+
+	// path to an archive
+	add(step{reset: true})
+	writeFile("site.zip", zipFixture(t, map[string]string{"index.html": "hi"}))
+	writeFile("site.tgz", tarGzFixture(t, map[string]string{"index.html": "hi"}))
+	writeFile("broken.zip", "not a zip")
+	add(step{
+		command: cmd("/ path " + filepath.Join(td, "site.zip")),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Path: filepath.Join(td, "site.zip"), Archive: "zip"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/site path " + filepath.Join(td, "site.tgz")), // gets a slash, like a directory
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":      {Path: filepath.Join(td, "site.zip"), Archive: "zip"},
+					"/site/": {Path: filepath.Join(td, "site.tgz"), Archive: "tar.gz"},
+				}},
+			},
+		},
+	})
+	for _, bad := range []string{
+		"/x path " + filepath.Join(td, "broken.zip"),        // doesn't open
+		"-spa /x path " + filepath.Join(td, "site.zip"),     // not a directory
+		"-append /site path " + filepath.Join(td, "subdir"), // can't layer beneath an archive
+	} {
+		add(step{command: cmd(bad), wantErr: anyErr()})
+	}
+
+	// no-https
+	add(step{reset: true})
+	add(step{
+		command: cmd("-no-https / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-no-https set / proxy 3000 /status text ok"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":       {Proxy: "http://127.0.0.1:3000"},
+					"/status": {Text: "ok"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-no-https -hsts 60 / proxy 3000"),
+		wantErr: anyErr(), // HSTS over plaintext
+	})
+	add(step{
+		command: cmd("ingress on"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":       {Proxy: "http://127.0.0.1:3000"},
+					"/status": {Text: "ok"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	add(step{
+		command: cmd("/status text fine"),
+		wantErr: anyErr(), // would switch ingress to HTTPS
+	})
+	add(step{
+		command: cmd("-no-https /status text fine"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":       {Proxy: "http://127.0.0.1:3000"},
+					"/status": {Text: "fine"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("ingress on"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+	})
+	add(step{
+		command: cmd("-no-https / proxy 3000"),
+		wantErr: anyErr(), // would switch ingress to plaintext
+	})
+
+	// tcp -udp-too
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp -udp-too 53-54"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				53: {TCPForward: "127.0.0.1:53"},
+				54: {TCPForward: "127.0.0.1:54"},
+			},
+			UDP: map[uint16]*ipn.UDPPortHandler{
+				53: {UDPForward: "127.0.0.1:53"},
+				54: {UDPForward: "127.0.0.1:54"},
+			},
+		},
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp -udp-too -target-host ::1 5353"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "[::1]:5353"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{443: {UDPForward: "[::1]:5353"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -udp-too -forward-to 10.0.0.2:53"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "10.0.0.2:53"}},
+			UDP: map[uint16]*ipn.UDPPortHandler{443: {UDPForward: "10.0.0.2:53"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -udp-too -terminate-tls 853"),
+		wantErr: anyErr(), // UDP can't carry TLS
+	})
+	add(step{
+		command: cmd("tcp -udp-too"),
+		wantErr: exactErr(errMissingTCPPort, "errMissingTCPPort"),
+	})
+
+	// tcp -proxy-protocol
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp -proxy-protocol 2 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432", ProxyProtocol: 2}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -proxy-protocol 1 -forward-to 10.0.0.2:25"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "10.0.0.2:25", ProxyProtocol: 1}},
+		},
+	})
+	add(step{
+		command: cmd("tcp 25"), // replacing the forward drops the header
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:25"}},
+		},
+	})
+	add(step{
+		command: cmd("tcp -proxy-protocol 3 25"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("tcp -proxy-protocol 2"),
+		wantErr: exactErr(errMissingTCPPort, "errMissingTCPPort"),
+	})
+
+	// removing web handlers
+	add(step{reset: true})
+	add(step{
+		command: cmd("/ proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/foo text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/foo off"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/foo off"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("/ off"), // the last handler takes port 443 with it
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{},
+		},
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("tcp 5432"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+		},
+	})
+	add(step{
+		command: cmd("-port 8443 / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {TCPForward: "127.0.0.1:5432"},
+				8443: {HTTPS: true},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/ off"), // nothing is served on 443's web server
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-port 8443 / off"), // the TCP forward stays
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{},
+		},
+	})
+
+	// client certificates
+	caPEM := caFixture(t)
+	writeFile("ca.pem", caPEM)
+	writeFile("bad-ca.pem", "not a certificate")
+	caFile, badCAFile := filepath.Join(td, "ca.pem"), filepath.Join(td, "bad-ca.pem")
+	add(step{reset: true})
+	add(step{
+		command: cmd("-require-client-cert / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {
+					Handlers:          map[string]*ipn.HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}},
+					RequireClientCert: true,
+				},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-require-client-cert -client-ca " + caFile + " / proxy 3000"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {
+					Handlers:          map[string]*ipn.HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}},
+					RequireClientCert: true,
+					ClientCAs:         caPEM,
+				},
+			},
+		},
+	})
+	add(step{
+		command: cmd("/foo text hi"), // other changes keep the requirement
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {
+					Handlers: map[string]*ipn.HTTPHandler{
+						"/":    {Proxy: "http://127.0.0.1:3000"},
+						"/foo": {Text: "hi"},
+					},
+					RequireClientCert: true,
+					ClientCAs:         caPEM,
+				},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-require-client-cert=false /foo text hi"),
+		want: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/foo": {Text: "hi"},
+				}},
+			},
+		},
+	})
+	add(step{
+		command: cmd("-client-ca " + caFile + " / proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{
+		command: cmd("-require-client-cert -client-ca " + badCAFile + " / proxy 3000"),
+		wantErr: anyErr(),
+	})
+	add(step{reset: true})
+	add(step{
+		command: cmd("-http -require-client-cert / proxy 3000"),
+		wantErr: anyErr(),
+	})
+
+	// And now run the steps above.
+	var current *ipn.ServeConfig
+	for i, st := range steps {
+		if st.reset {
+			t.Logf("Executing step #%d, line %v: [reset]", i, st.line)
+			current = nil
+		}
+		if st.command == nil {
+			continue
+		}
+		t.Logf("Executing step #%d, line %v: %q ... ", i, st.line, st.command)
+
+		var stdout bytes.Buffer
+		var flagOut bytes.Buffer
+		var newState *ipn.ServeConfig
+		e := &serveEnv{
+			testFlagOut: &flagOut,
+			testStdout:  &stdout,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return current, nil
+			},
+			testSetServeConfig: func(_ context.Context, c *ipn.ServeConfig) error {
+				newState = c
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+			testNow:                  func() time.Time { return fakeNow },
+		}
+		cmd := newServeCommand(e)
+		err := cmd.ParseAndRun(context.Background(), st.command)
+		if flagOut.Len() > 0 {
+			t.Logf("flag package output: %q", flagOut.Bytes())
+		}
+		if err != nil {
+			if st.wantErr == nil {
+				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, err)
+			}
+			if bad := st.wantErr(err); bad != "" {
+				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, bad)
+			}
+			continue
+		}
+		if st.wantErr != nil {
+			t.Fatalf("step #%d, line %v: got success (saved=%v), but wanted an error", i, st.line, newState != nil)
+		}
+		if !reflect.DeepEqual(newState, st.want) {
+			t.Fatalf("[%d] %v: bad state. got:\n%s\n\nwant:\n%s\n",
+				i, st.command, asJSON(newState), asJSON(st.want))
+		}
+		if newState != nil {
+			current = newState
+		}
+	}
+}
+
+// fakeNow is the current time in tests that set serveEnv.testNow.
+var fakeNow = time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeRunningStatus is a testGetLocalClientStatus func for a running node
+// named foo.test.ts.net.
+func fakeRunningStatus(context.Context) (*ipnstate.Status, error) {
+	return &ipnstate.Status{
+		BackendState: ipn.Running.String(),
+		Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net."},
+	}, nil
+}
+
+// newSavingServeEnv returns a serveEnv for a running node that keeps its
+// serve config in *saved: fetches return it and saves replace it.
+// Output goes to buffers.
+func newSavingServeEnv(saved **ipn.ServeConfig) *serveEnv {
+	return &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  new(bytes.Buffer),
+		testStderr:  new(bytes.Buffer),
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return *saved, nil
+		},
+		testSetServeConfig: func(_ context.Context, sc *ipn.ServeConfig) error {
+			*saved = sc
+			return nil
+		},
+		testGetLocalClientStatus: fakeRunningStatus,
+	}
+}
+
+// checkShowConfigRoundTrip checks that sc survives a show-config | apply
+// round trip unchanged, and returns the show-config output.
+func checkShowConfigRoundTrip(t *testing.T, sc *ipn.ServeConfig) string {
+	t.Helper()
+	e := newSavingServeEnv(&sc)
+	var stdout bytes.Buffer
+	e.testStdout = &stdout
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("show-config")); err != nil {
+		t.Fatal(err)
+	}
+	out := stdout.String()
+	got, err := decodeServeConfig(&stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, sc) {
+		t.Errorf("round trip changed config:\n got: %s\nwant: %s", asJSON(got), asJSON(sc))
+	}
+	return out
+}
+
+// exactError returns an error checker that wants exactly the provided want error.
+// If optName is non-empty, it's used in the error message.
+func exactErr(want error, optName ...string) func(error) string {
+	return func(got error) string {
+		// Serve commands wrap errors with their exit codes.
+		if got == want || errors.Unwrap(got) == want {
+			return ""
+		}
+		if len(optName) > 0 {
+			return fmt.Sprintf("got error %v, want %v", got, optName[0])
+		}
+		return fmt.Sprintf("got error %v, want %v", got, want)
+	}
+}
+
+// anyErr returns an error checker that wants any error.
+func anyErr() func(error) string {
+	return func(got error) string {
+		return ""
+	}
+}
+
+func cmd(s string) []string {
+	return strings.Fields(s)
+}
+
+func TestExpandProxyTargetTCP(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"tcp://localhost:3000", `did you mean "tailscale serve tcp 3000"?`},
+		{"tcp://127.0.0.1:5432/", `did you mean "tailscale serve tcp 5432"?`},
+		{"tcp://localhost", `did you mean "tailscale serve tcp <port>"?`},
+	}
+	for _, tt := range tests {
+		_, err := expandProxyTarget(tt.target)
+		if err == nil || !strings.HasPrefix(err.Error(), `tcp:// targets are for "serve tcp", not web proxies`) || !strings.HasSuffix(err.Error(), tt.want) {
+			t.Errorf("expandProxyTarget(%q) = %v; want the serve tcp hint ending in %q", tt.target, err, tt.want)
+		}
+	}
+	// Other schemes still get the generic error.
+	if _, err := expandProxyTarget("udp://localhost:53"); err == nil || strings.Contains(err.Error(), "serve tcp") {
+		t.Errorf("expandProxyTarget(udp://...) = %v; want the generic scheme error", err)
+	}
+}
+
+func TestServeNamedProxyTarget(t *testing.T) {
+	targets := filepath.Join(t.TempDir(), "targets")
+	const names = `
+# name target
+myservice localhost:8080
+grafana   3000
+`
+	if err := os.WriteFile(targets, []byte(names), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var saved *ipn.ServeConfig
+	run := func(args string) error {
+		saved = nil
+		e := newSavingServeEnv(&saved)
+		return newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+	}
+
+	if err := run("-targets " + targets + " / proxy @myservice,@grafana"); err != nil {
+		t.Fatal(err)
+	}
+	h := saved.Web["foo.test.ts.net:443"].Handlers["/"]
+	if h.Proxy != "http://127.0.0.1:8080" || !reflect.DeepEqual(h.ExtraProxies, []string{"http://127.0.0.1:3000"}) {
+		t.Errorf("got handler %s; want the resolved targets stored", asJSON(h))
+	}
+
+	for _, tt := range []struct {
+		args, wantErr string
+	}{
+		{"-targets " + targets + " / proxy @nope", "proxy target @nope isn't defined in " + targets},
+		{"/ proxy @myservice", "give -targets"},
+		{"-targets " + filepath.Join(t.TempDir(), "missing") + " / proxy @myservice", "no such file"},
+	} {
+		err := run(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v; want one containing %q", tt.args, err, tt.wantErr)
+		}
+		if saved != nil {
+			t.Errorf("%q: saved %s", tt.args, asJSON(saved))
+		}
+	}
+}
+
+func TestReadProxyNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name, contents, wantErr string
+	}{
+		{"ok", "a 1\n\n  # comment\nb localhost:2\n", ""},
+		{"one-field", "a\n", ":1: want a name and a target"},
+		{"dup", "a 1\na 2\n", `:2: "a" is defined more than once`},
+		{"at-name", "@a 1\n", `:1: invalid name "@a"`},
+	} {
+		file := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(file, []byte(tt.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		names, err := readProxyNames(file)
+		if tt.wantErr == "" {
+			if err != nil || !reflect.DeepEqual(names, map[string]string{"a": "1", "b": "localhost:2"}) {
+				t.Errorf("%s: got %v, %v", tt.name, names, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v; want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "Sat 02:00-04:00", want: "Sat 02:00-04:00"},
+		{in: "mon 9:30-17:00", want: "Mon 09:30-17:00"},
+		{in: "Fri 22:00-02:00", want: "Fri 22:00-02:00"},
+		{in: "", wantErr: true},
+		{in: "Sat", wantErr: true},
+		{in: "Someday 02:00-04:00", wantErr: true},
+		{in: "Sat 02:00", wantErr: true},
+		{in: "Sat 02:00-02:00", wantErr: true},
+		{in: "Sat 25:00-26:00", wantErr: true},
+		{in: "Sat 02:60-03:00", wantErr: true},
+		{in: "Sat 2-4", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMaintenanceWindow(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMaintenanceWindow(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMaintenanceWindow(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10/s", want: "10/s"},
+		{in: "600/M", want: "600/m"},
+		{in: " 5000/h ", want: "5000/h"},
+		{in: "007/s", want: "7/s"},
+		{in: "1000000/s", want: "1000000/s"},
+		{in: "", wantErr: true},
+		{in: "10", wantErr: true},
+		{in: "10/", wantErr: true},
+		{in: "/s", wantErr: true},
+		{in: "0/s", wantErr: true},
+		{in: "-1/s", wantErr: true},
+		{in: "1.5/s", wantErr: true},
+		{in: "1000001/s", wantErr: true},
+		{in: "99999999999999999999/s", wantErr: true},
+		{in: "10/d", wantErr: true},
+		{in: "10/sec", wantErr: true},
+		{in: "10 per s", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateLimit(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRateLimit(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRateLimit(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "512", want: 512},
+		{in: "512B", want: 512},
+		{in: "64KB", want: 64 << 10},
+		{in: "10MB", want: 10 << 20},
+		{in: "10mb", want: 10 << 20},
+		{in: "1 GB", want: 1 << 30},
+		{in: "", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "-5MB", wantErr: true},
+		{in: "+5MB", wantErr: true},
+		{in: "1.5MB", wantErr: true},
+		{in: "10TB", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "10 M B", wantErr: true},
+		{in: "9999999999999GB", wantErr: true}, // overflows int64
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseByteSize(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d; want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestServeStatusFormats(t *testing.T) {
+	td := t.TempDir()
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {TCPForward: "127.0.0.1:1", TerminateTLS: "foo.test.ts.net"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Text: "hi"},
+				"/files/": {Path: td},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	run := func(args ...string) []string {
+		t.Helper()
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return sc, nil
+			},
+		}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), append([]string{"status"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	}
+	narrow := run()
+	if len(narrow) != 4 {
+		t.Fatalf("narrow: got %d lines, want 4:\n%s", len(narrow), strings.Join(narrow, "\n"))
+	}
+	for i, ln := range narrow {
+		if got := len(strings.Fields(ln)); got != 3 {
+			t.Errorf("narrow line %d: got %d columns, want 3: %q", i, got, ln)
+		}
+	}
+
+	wide := run("-o", "wide")
+	if len(wide) != 4 {
+		t.Fatalf("wide: got %d lines, want 4:\n%s", len(wide), strings.Join(wide, "\n"))
+	}
+	if got := len(strings.Fields(wide[0])); got != 8 {
+		t.Errorf("wide header: got %d columns, want 8: %q", got, wide[0])
+	}
+	for i, ln := range wide[1:] {
+		// The description column contains spaces, so it spans several fields.
+		if got := len(strings.Fields(ln)); got < 8 {
+			t.Errorf("wide line %d: got %d columns, want at least 8: %q", i+1, got, ln)
+		}
+	}
+	if tcpRow := wide[1]; !strings.HasPrefix(tcpRow, ":8443") || !strings.Contains(tcpRow, "unreachable") || !strings.Contains(tcpRow, "terminated") {
+		t.Errorf("wide TCP row missing health or TLS status: %q", tcpRow)
+	}
+	if got := run("-format=wide"); !reflect.DeepEqual(got, wide) {
+		t.Errorf("-format=wide differs from -o wide:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestResolveServeRowsHealth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan bool, 2)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+			accepted <- true
+		}
+	}()
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: ln.Addr().String()}, 8443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "h2c://" + ln.Addr().String()},
+			}},
+		},
+	}
+
+	rows := resolveServeRows(sc, false)
+	if len(rows) != 2 || rows[0].Health != "" || rows[1].Health != "" {
+		t.Fatalf("without health: got %+v; want two rows with no Health", rows)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("resolveServeRows dialed the forward without health")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rows = resolveServeRows(sc, true)
+	if len(rows) != 2 || rows[0].Health != "ok" || rows[1].Health != "ok" {
+		t.Fatalf("with health: got %+v; want two rows with Health ok", rows)
+	}
+}
+
+func TestServeRotateAuth(t *testing.T) {
+	const hp = "foo.test.ts.net:443"
+	oldHash, err := bcrypt.GenerateFromPassword([]byte("old"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			hp: {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Text: "hi"},
+				"/admin": {Proxy: "http://127.0.0.1:3000", BasicAuthUser: "admin", BasicAuthHash: string(oldHash)},
+			}},
+			"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/admin": {Proxy: "http://127.0.0.1:3001", BasicAuthUser: "ops", BasicAuthHash: string(oldHash)},
+			}},
+		},
+	}
+	// args are the serve command line.
+	run := func(args ...string) (saved *ipn.ServeConfig, stdout string, err error) {
+		var out bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &out,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return current, nil
+			},
+			testSetServeConfig: func(_ context.Context, c *ipn.ServeConfig) error {
+				saved = c
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		err = newServeCommand(e).ParseAndRun(context.Background(), args)
+		return saved, out.String(), err
+	}
+
+	saved, out, err := run("rotate-auth", "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := saved.Web[hp].Handlers["/admin"]
+	if h.BasicAuthHash == string(oldHash) {
+		t.Fatal("hash unchanged after rotation")
+	}
+	if h.BasicAuthUser != "admin" {
+		t.Errorf("user = %q; want admin", h.BasicAuthUser)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	pass := lines[len(lines)-1]
+	if err := bcrypt.CompareHashAndPassword([]byte(h.BasicAuthHash), []byte(pass)); err != nil {
+		t.Errorf("printed password doesn't match stored hash: %v", err)
+	}
+	if current.Web[hp].Handlers["/admin"].BasicAuthHash != string(oldHash) {
+		t.Error("current config was mutated")
+	}
+
+	saved, _, err = run("rotate-auth", "-user", "root", "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.Web[hp].Handlers["/admin"].BasicAuthUser; got != "root" {
+		t.Errorf("user = %q; want root", got)
+	}
+
+	if saved, _, err := run("rotate-auth", "/"); err == nil || saved != nil {
+		t.Errorf("rotating handler without basic auth: err=%v, saved=%v; want error and no save", err, saved != nil)
+	}
+	if saved, _, err := run("rotate-auth", "/nope"); err == nil || saved != nil {
+		t.Errorf("rotating missing handler: err=%v, saved=%v; want error and no save", err, saved != nil)
+	}
+
+	saved, _, err = run("-port", "8443", "rotate-auth", "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := saved.Web["foo.test.ts.net:8443"].Handlers["/admin"]; h.BasicAuthHash == string(oldHash) || h.BasicAuthUser != "ops" {
+		t.Errorf("-port 8443: handler not rotated: %+v", h)
+	}
+	if h := saved.Web[hp].Handlers["/admin"]; h.BasicAuthHash != string(oldHash) {
+		t.Error("-port 8443 rotated the handler on port 443")
+	}
+
+	saved, out, err = run("-dry-run-diff", "rotate-auth", "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != nil {
+		t.Error("-dry-run-diff saved the config")
+	}
+	if strings.Contains(out, "password") {
+		t.Errorf("-dry-run-diff printed a password that was never saved: %q", out)
+	}
+}
+
+func TestServeValidateOnly(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	openPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	run := func(args ...string) error {
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return nil, nil
+			},
+			testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+				t.Errorf("%q: unexpected setServeConfig call", args)
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		return newServeCommand(e).ParseAndRun(context.Background(), args)
+	}
+
+	if err := run("-validate-only", "/", "proxy", openPort); err != nil {
+		t.Errorf("valid mutation: %v", err)
+	}
+	if err := run("-validate-only", "-probe", "/", "proxy", openPort); err != nil {
+		t.Errorf("valid mutation with -probe: %v", err)
+	}
+	if err := run("-validate-only", "/", "proxy", closedPort); err != nil {
+		t.Errorf("unreachable backend without -probe: %v", err)
+	}
+	if err := run("-validate-only", "-probe", "/", "proxy", closedPort); err == nil {
+		t.Error("unreachable backend with -probe: got success, want error")
+	}
+	if err := run("-validate-only", "/", "proxy", "0"); err == nil {
+		t.Error("invalid port: got success, want error")
+	}
+	if err := run("tcp", "-validate-only", "-probe", openPort); err != nil {
+		t.Errorf("tcp with -probe: %v", err)
+	}
+	if err := run("tcp", "-validate-only", "-probe", closedPort); err == nil {
+		t.Error("tcp with unreachable target and -probe: got success, want error")
+	}
+}
+
+func TestServeTCPInvalidPortNotSaved(t *testing.T) {
+	for _, args := range []string{"tcp 0", "tcp 70000", "tcp 5432x", "tcp http", "tcp off 0"} {
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return nil, nil
+			},
+			testSetServeConfig: func(_ context.Context, sc *ipn.ServeConfig) error {
+				t.Errorf("%q: unexpected setServeConfig call with %v", args, asJSON(sc))
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args)); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("%q: err = %v; want flag.ErrHelp", args, err)
+		}
+	}
+}
+
+func TestServeTCPForwardTo(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    string // TCPForward; empty means an error
+		wantErr error  // if non-nil, the error want
+	}{
+		{args: "tcp -forward-to 192.168.1.10:5432", want: "192.168.1.10:5432"},
+		{args: "tcp -forward-to 0.0.0.0:8080", want: "0.0.0.0:8080"},
+		{args: "tcp -forward-to [::]:8080", want: "[::]:8080"},
+		{args: "tcp -forward-to [fd7a::1]:22", want: "[fd7a::1]:22"},
+		{args: "tcp -forward-to db.lan:5432", want: "db.lan:5432"},
+		{args: "tcp -forward-to -terminate-tls 10.0.0.5:443", want: ""}, // flag value taken as address
+		{args: "tcp -forward-to 10.0.0.5", want: ""},                    // no port
+		{args: "tcp -forward-to 10.0.0.5:0", want: ""},
+		{args: "tcp -forward-to 10.0.0.5:70000", want: ""},
+		{args: "tcp -forward-to :5432", want: ""},
+		{args: "tcp -forward-to http://10.0.0.5:80", want: ""},
+		{args: "tcp -forward-to 10.0.0.5:5432 5432", wantErr: flag.ErrHelp},
+		{args: "tcp -forward-to 10.0.0.5:5432 -target-host 10.0.0.6", wantErr: flag.ErrHelp},
+	}
+	for _, tt := range tests {
+		var saved *ipn.ServeConfig
+		e := newSavingServeEnv(&saved)
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+		switch {
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%q: err = %v; want %v", tt.args, err, tt.wantErr)
+			}
+		case tt.want == "":
+			if err == nil {
+				t.Errorf("%q: saved %s; want an error", tt.args, asJSON(saved))
+			}
+		case err != nil:
+			t.Errorf("%q: %v", tt.args, err)
+		default:
+			if got := saved.TCP[443].TCPForward; got != tt.want {
+				t.Errorf("%q: TCPForward = %q; want %q", tt.args, got, tt.want)
+			}
+		}
+		if err != nil && saved != nil {
+			t.Errorf("%q: saved config despite error %v", tt.args, err)
+		}
+	}
+}
+
+func TestServeEncryptSecrets(t *testing.T) {
+	run := func(caps []string) (*ipn.ServeConfig, error) {
+		var saved *ipn.ServeConfig
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return nil, nil
+			},
+			testSetServeConfig: func(_ context.Context, c *ipn.ServeConfig) error {
+				saved = c
+				return nil
+			},
+			testGetLocalClientStatus: func(context.Context) (*ipnstate.Status, error) {
+				return &ipnstate.Status{
+					BackendState: ipn.Running.String(),
+					Self: &ipnstate.PeerStatus{
+						DNSName:      "foo.test.ts.net.",
+						Capabilities: caps,
+					},
+				}, nil
+			},
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd("-encrypt-secrets / text hi"))
+		return saved, err
+	}
+
+	saved, err := run([]string{tailcfg.CapabilityServeEncryptedSecrets})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.EncryptedSecrets {
+		t.Error("EncryptedSecrets not set")
+	}
+
+	saved, err = run(nil)
+	if err == nil || !strings.Contains(err.Error(), "does not support") {
+		t.Errorf("missing capability: got err %v; want unsupported error", err)
+	}
+	if saved != nil {
+		t.Error("config saved despite missing capability")
+	}
+}
+
+func TestServeApplyFormats(t *testing.T) {
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/txt": {Text: "hi", StatusCode: 404},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	files := map[string]string{
+		"serve.yaml": `
+TCP:
+  443:
+    HTTPS: true
+Web:
+  foo.test.ts.net:443:
+    Handlers:
+      /:
+        Proxy: http://127.0.0.1:3000
+      /txt:
+        Text: hi
+        StatusCode: 404
+AllowIngress:
+  foo.test.ts.net:443: true
+`,
+		"serve.toml": `
+[TCP.443]
+HTTPS = true
+
+[Web."foo.test.ts.net:443".Handlers."/"]
+Proxy = "http://127.0.0.1:3000"
+
+[Web."foo.test.ts.net:443".Handlers."/txt"]
+Text = "hi"
+StatusCode = 404
+
+[AllowIngress]
+"foo.test.ts.net:443" = true
+`,
+		"bad.yml":  "TCP:\n  443:\n    HTTPS: true\nBogus: 1\n",
+		"bad.toml": "TCP = [",
+	}
+	td := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(td, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"serve.yaml", "serve.toml", "bad.yml", "bad.toml"} {
+		var saved *ipn.ServeConfig
+		var stdout bytes.Buffer
+		e := newSavingServeEnv(&saved)
+		e.testStdout = &stdout
+		err := newServeCommand(e).ParseAndRun(context.Background(), []string{"apply", "-f", filepath.Join(td, name)})
+		if strings.HasPrefix(name, "bad") {
+			if ExitCode(err) != serveExitInvalid {
+				t.Errorf("%s: got error %v; want an invalid config error", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		// It must read back the same through show-config.
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("show-config")); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeServeConfig(&stdout)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %s\nwant %s", name, asJSON(got), asJSON(want))
+		}
+	}
+}
+
+func TestServeDiff(t *testing.T) {
+	live := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/old": {Text: "bye"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	file := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3001", Compress: true},
+				"/new": {Path: "/srv/www"},
+			}},
+		},
+		EncryptedSecrets: true,
+	}
+	td := t.TempDir()
+	writeConfig := func(name string, sc *ipn.ServeConfig) string {
+		t.Helper()
+		name = filepath.Join(td, name)
+		if err := os.WriteFile(name, []byte(asJSON(sc)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	run := func(file string) (string, error) {
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return live, nil
+			},
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), []string{"diff", "-f", file})
+		return stdout.String(), err
+	}
+
+	got, err := run(writeConfig("changed.json", file))
+	if err != errConfigsDiffer {
+		t.Errorf("got error %v; want errConfigsDiffer", err)
+	}
+	want := strings.Join([]string{
+		`~ web foo.test.ts.net:443/: Proxy: "http://127.0.0.1:3000" -> "http://127.0.0.1:3001", Compress: false -> true`,
+		`+ web foo.test.ts.net:443/new: path /srv/www`,
+		`- web foo.test.ts.net:443/old: text "bye"`,
+		`- tcp 5432: forward to 127.0.0.1:5432`,
+		`- ingress foo.test.ts.net:443`,
+		`~ EncryptedSecrets: false -> true`,
+	}, "\n") + "\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	got, err = run(writeConfig("same.json", live))
+	if err != nil {
+		t.Errorf("unchanged: %v", err)
+	}
+	if got != "No differences.\n" {
+		t.Errorf("unchanged: got %q", got)
+	}
+}
+
+func TestServeMerge(t *testing.T) {
+	caPEM := caFixture(t)
+	cur := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:3000"},
+				"/docs": {Text: "old docs"},
+				"/keep": {Text: "kept"},
+			}},
+		},
+	}
+	tests := []struct {
+		name    string
+		in      string
+		want    *ipn.ServeConfig
+		wantErr bool
+	}{
+		{
+			name: "web-and-tcp",
+			in: `{
+				"TCP": {"8443": {"TCPForward": "127.0.0.1:8443"}, "5432": {"TCPForward": "127.0.0.1:6543"}},
+				"Web": {"foo.test.ts.net:443": {"Handlers": {
+					"/": {"Proxy": "http://127.0.0.1:3001"},
+					"/docs/": {"Text": "new docs"},
+					"/api": {"Proxy": "http://127.0.0.1:4000"}
+				}}},
+				"AllowIngress": {"foo.test.ts.net:443": true}
+			}`,
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443:  {HTTPS: true},
+					5432: {TCPForward: "127.0.0.1:6543"},
+					8443: {TCPForward: "127.0.0.1:8443"},
+				},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/":      {Proxy: "http://127.0.0.1:3001"},
+						"/api":   {Proxy: "http://127.0.0.1:4000"},
+						"/docs/": {Text: "new docs"}, // replaces /docs
+						"/keep":  {Text: "kept"},
+					}},
+				},
+				AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+			},
+		},
+		{
+			name: "new-host",
+			in:   `{"TCP": {"8443": {"HTTPS": true}}, "Web": {"foo.test.ts.net:8443": {"Handlers": {"/": {"Text": "hi"}}}}}`,
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{
+					443:  {HTTPS: true},
+					5432: {TCPForward: "127.0.0.1:5432"},
+					8443: {HTTPS: true},
+				},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"foo.test.ts.net:443": cur.Web["foo.test.ts.net:443"],
+					"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/": {Text: "hi"},
+					}},
+				},
+			},
+		},
+		{
+			name: "client-cert",
+			in:   `{"Web": {"foo.test.ts.net:443": {"Handlers": {"/api": {"Proxy": "http://127.0.0.1:4000"}}, "RequireClientCert": true, "ClientCAs": ` + strconv.Quote(caPEM) + `}}}`,
+			want: &ipn.ServeConfig{
+				TCP: cur.TCP,
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"foo.test.ts.net:443": {
+						Handlers: map[string]*ipn.HTTPHandler{
+							"/":     {Proxy: "http://127.0.0.1:3000"},
+							"/api":  {Proxy: "http://127.0.0.1:4000"},
+							"/docs": {Text: "old docs"},
+							"/keep": {Text: "kept"},
+						},
+						RequireClientCert: true,
+						ClientCAs:         caPEM,
+					},
+				},
+			},
+		},
+		{
+			name:    "invalid-result",
+			in:      `{"Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Text": "hi", "Path": "/srv"}}}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown-field",
+			in:      `{"Bogus": true}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved *ipn.ServeConfig
+			e := newSavingServeEnv(&saved)
+			e.testStdin = strings.NewReader(tt.in)
+			e.testGetServeConfig = func(context.Context) (*ipn.ServeConfig, error) {
+				return cur.Clone(), nil
+			}
+			err := newServeCommand(e).ParseAndRun(context.Background(), cmd("merge"))
+			if tt.wantErr {
+				if err == nil || saved != nil {
+					t.Fatalf("got err %v, saved %s; want an error and nothing saved", err, asJSON(saved))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(saved, tt.want) {
+				t.Errorf("got %s\nwant %s", asJSON(saved), asJSON(tt.want))
+			}
+		})
+	}
+}
+
+func TestServeExportSplit(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000"},
+			}},
+			"bar.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Text: "hi"},
+				"/api": {Proxy: "http://127.0.0.1:3001"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	dir := filepath.Join(t.TempDir(), "serve.d")
+	var imported *ipn.ServeConfig
+	newEnv := func() *serveEnv {
+		return &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return sc, nil
+			},
+			testSetServeConfig: func(_ context.Context, c *ipn.ServeConfig) error {
+				imported = c
+				return nil
+			},
+		}
+	}
+
+	if err := newServeCommand(newEnv()).ParseAndRun(context.Background(), []string{"export", "-split", "-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, de := range ents {
+		got = append(got, de.Name())
+	}
+	want := []string{serveGlobalFile, "bar.test.ts.net.json", "foo.test.ts.net.json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("files = %q; want %q", got, want)
+	}
+
+	if err := newServeCommand(newEnv()).ParseAndRun(context.Background(), []string{"import", "-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported, sc) {
+		t.Errorf("reassembled config differs.\ngot:  %s\nwant: %s", asJSON(imported), asJSON(sc))
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filepath.Join(dir, "foo.test.ts.net.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Errorf("exported file mode = %v; want 0600", perm)
+		}
+	}
+
+	// Exporting again after a host is removed removes its file, so that
+	// importing doesn't bring it back.
+	sc = sc.Clone()
+	delete(sc.Web, "bar.test.ts.net:443")
+	if err := newServeCommand(newEnv()).ParseAndRun(context.Background(), []string{"export", "-split", "-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bar.test.ts.net.json")); !os.IsNotExist(err) {
+		t.Errorf("stale bar.test.ts.net.json: got %v, want it removed", err)
+	}
+	if err := newServeCommand(newEnv()).ParseAndRun(context.Background(), []string{"import", "-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported, sc) {
+		t.Errorf("config reassembled after removing a host differs.\ngot:  %s\nwant: %s", asJSON(imported), asJSON(sc))
+	}
+
+	// A duplicate key across files is an error.
+	dup, err := os.ReadFile(filepath.Join(dir, "foo.test.ts.net.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "foo-copy.json"), dup, 0644); err != nil {
+		t.Fatal(err)
+	}
+	imported = nil
+	if err := newServeCommand(newEnv()).ParseAndRun(context.Background(), []string{"import", "-dir", dir}); err == nil {
+		t.Error("import with duplicate host: got success, want error")
+	}
+	if imported != nil {
+		t.Error("import with duplicate host saved a config")
+	}
+}
+
+func TestServeShowConfigWatch(t *testing.T) {
+	configs := []*ipn.ServeConfig{
+		nil,
+		nil,
+		{AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls int
+	var stdout bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  &stdout,
+		testGetServeConfig: func(ctx context.Context) (*ipn.ServeConfig, error) {
+			if calls == len(configs) {
+				cancel()
+				return nil, ctx.Err()
+			}
+			sc := configs[calls]
+			calls++
+			return sc, nil
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(ctx, cmd("show-config -watch -interval 1ms")); err != nil {
+		t.Fatalf("got error %v; want nil after cancelation", err)
+	}
+	const clear = "\x1b[H\x1b[2J"
+	if got := strings.Count(stdout.String(), clear); got != 2 {
+		t.Errorf("printed %d times; want 2 (unchanged config not re-printed):\n%q", got, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "AllowIngress") {
+		t.Errorf("changed config not printed:\n%s", stdout.String())
+	}
+}
+
+func TestServeShowConfigMount(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			80:   {HTTP: true},
+			8443: {HTTPS: true},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/foo": {Text: "foo"},
+			}},
+			"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/foo": {Text: "plain foo"},
+			}},
+			"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/bar": {Text: "bar"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true, "foo.test.ts.net:8443": true},
+	}
+	run := func(args string) (*ipn.ServeConfig, error) {
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testStderr:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return sc, nil
+			},
+		}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			return nil, err
+		}
+		return decodeServeConfigPart(&stdout)
+	}
+
+	got, err := run("show-config -mount foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 80: {HTTP: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/foo": {Text: "foo"},
+			}},
+			"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/foo": {Text: "plain foo"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s\nwant %s", asJSON(got), asJSON(want))
+	}
+
+	for _, args := range []string{"show-config -mount /missing", "show-config -mount /foo/", "show-config -mount /a?b"} {
+		if got, err := run(args); err == nil {
+			t.Errorf("%q: got %s; want an error", args, asJSON(got))
+		}
+	}
+	if _, err := run("show-config -watch -mount /foo"); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("-watch -mount: got %v; want flag.ErrHelp", err)
+	}
+}
+
+func TestServeDescribe(t *testing.T) {
+	td := t.TempDir()
+	f := filepath.Join(td, "serve.json")
+	writeFile := func(sc *ipn.ServeConfig) {
+		j, err := json.Marshal(sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, j, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	describe := func() string {
+		t.Helper()
+		var stdout bytes.Buffer
+		e := &serveEnv{testFlagOut: new(bytes.Buffer), testStdout: &stdout}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("describe -f "+f)); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+
+	writeFile(&ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/api": {Proxy: "http://127.0.0.1:3000"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	})
+	want := "Serves /api on https://foo.test.ts.net:443 by proxying to http://127.0.0.1:3000, publicly via Funnel.\n"
+	if got := describe(); got != want {
+		t.Errorf("proxy with ingress:\n got: %q\nwant: %q", got, want)
+	}
+
+	writeFile(&ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/static/": {Path: "/var/www"},
+			}},
+		},
+	})
+	want = "Serves /static/ on https://foo.test.ts.net:443 from files in /var/www, to your tailnet only.\n"
+	if got := describe(); got != want {
+		t.Errorf("path:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestResolveServePath(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := t.TempDir()
+	tests := []struct {
+		base, path string
+		want       string
+		wantErr    bool
+	}{
+		{"", "foo", filepath.Join(wd, "foo"), false},
+		{"", "../foo", filepath.Join(filepath.Dir(wd), "foo"), false},
+		{base, "foo", filepath.Join(base, "foo"), false},
+		{base, "a/../foo", filepath.Join(base, "foo"), false},
+		{base, "..foo", filepath.Join(base, "..foo"), false},
+		{base, "../foo", "", true},
+		{base, "..", "", true},
+		{base, wd, wd, false}, // absolute paths are used as given
+	}
+	for _, tt := range tests {
+		got, err := resolveServePath(tt.base, tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolveServePath(%q, %q) error = %v; wantErr %v", tt.base, tt.path, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolveServePath(%q, %q) = %q; want %q", tt.base, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathReadWarning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not meaningful on Windows")
+	}
+	td := t.TempDir()
+	check := func(name string, mode os.FileMode, wantWarn bool) {
+		t.Helper()
+		p := filepath.Join(td, name)
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := pathReadWarning(p, fi); (w != "") != wantWarn {
+			t.Errorf("%s with mode %v: warning = %q; want warning: %v", name, mode, w, wantWarn)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(td, "file"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(td, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	check("file", 0644, false)
+	check("file", 0600, true)
+	check("file", 0000, true)
+	check("dir", 0755, false)
+	check("dir", 0744, true) // readable but not searchable
+	check("dir", 0700, true)
+	os.Chmod(filepath.Join(td, "dir"), 0755) // so TempDir cleanup works
+}
+
+func TestServeList(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432", Comment: "postgres"},
+			8443: {TCPForward: "127.0.0.1:8443", TerminateTLS: "foo.test.ts.net"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Proxy: "http://127.0.0.1:3000", Comment: "the \"main\" app"},
+				"/files/": {Path: "/var/www"},
+				"/hi":     {Text: "hello\tworld"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{
+			"foo.test.ts.net:443":  true,
+			"foo.test.ts.net:8443": false,
+		},
+	}
+	var stdout bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  &stdout,
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return sc, nil
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("list")); err != nil {
+		t.Fatal(err)
+	}
+	const want = "" +
+		"https\tfoo.test.ts.net:443\t/\tproxy\thttp://127.0.0.1:3000\tlabel=\"the \\\"main\\\" app\"\n" +
+		"https\tfoo.test.ts.net:443\t/files/\tpath\t/var/www\n" +
+		"https\tfoo.test.ts.net:443\t/hi\ttext\t\"hello\\tworld\"\n" +
+		"tcp\t5432\tforward\t127.0.0.1:5432\tlabel=\"postgres\"\n" +
+		"tcp\t8443\tforward\t127.0.0.1:8443\tfoo.test.ts.net\n" +
+		"ingress\tfoo.test.ts.net:443\ton\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestServeShareLink(t *testing.T) {
+	web := func(port uint16, plain bool, ingress bool, mounts ...string) *ipn.ServeConfig {
+		hp := ipn.HostPort("foo.test.ts.net:" + strconv.Itoa(int(port)))
+		sc := &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{port: {HTTPS: !plain, HTTP: plain}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: {Handlers: map[string]*ipn.HTTPHandler{}}},
+		}
+		for _, m := range mounts {
+			sc.Web[hp].Handlers[m] = &ipn.HTTPHandler{Text: "hi"}
+		}
+		if ingress {
+			sc.AllowIngress = map[ipn.HostPort]bool{hp: true}
+		}
+		return sc
+	}
+	tests := []struct {
+		args     string
+		sc       *ipn.ServeConfig
+		want     string
+		wantWarn bool
+		wantErr  bool
+	}{
+		{args: "share-link", sc: web(443, false, true, "/"), want: "https://foo.test.ts.net/\n"},
+		{args: "share-link", sc: web(443, false, false, "/"), want: "https://foo.test.ts.net/\n", wantWarn: true},
+		{args: "share-link /docs", sc: web(443, false, true, "/", "/docs/"), want: "https://foo.test.ts.net/docs/\n"},
+		{args: "share-link docs/", sc: web(443, false, true, "/docs/"), want: "https://foo.test.ts.net/docs/\n"},
+		{args: "-http share-link /api", sc: web(80, true, true, "/api"), want: "http://foo.test.ts.net/api\n"},
+		{args: "-no-https share-link", sc: web(443, true, true, "/"), want: "http://foo.test.ts.net:443/\n"},
+		{args: "share-link /missing", sc: web(443, false, true, "/"), wantErr: true},
+		{args: "share-link", sc: nil, wantErr: true},
+		{args: "-http share-link", sc: web(443, false, true, "/"), wantErr: true}, // nothing on port 80
+		{args: "share-link / /docs", sc: web(443, false, true, "/"), wantErr: true},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testStderr:  &stderr,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return tt.sc, nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error: %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if got := stdout.String(); got != tt.want {
+			t.Errorf("%q: printed %q; want %q", tt.args, got, tt.want)
+		}
+		if gotWarn := strings.Contains(stderr.String(), "ingress is off"); gotWarn != tt.wantWarn {
+			t.Errorf("%q: stderr = %q; want ingress warning: %v", tt.args, stderr.String(), tt.wantWarn)
+		}
+	}
+}
+
+func TestMountMatchOrder(t *testing.T) {
+	handlers := map[string]*ipn.HTTPHandler{}
+	for _, m := range []string{"/", "/api", "/api/", "/api/v2", "/api/v2/users", "/b", "/a/"} {
+		handlers[m] = &ipn.HTTPHandler{Text: m}
+	}
+	got := mountMatchOrder(handlers)
+	want := []string{"/api/v2/users", "/api/v2", "/a/", "/api/", "/api", "/b", "/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestServeShowConfigMatchOrder(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Text: "root"},
+				"/api":    {Proxy: "http://127.0.0.1:3000"},
+				"/api/v2": {Proxy: "http://127.0.0.1:3002"},
+			}},
+			"bar.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "only one"},
+			}},
+		},
+	}
+	var stdout, stderr bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  &stdout,
+		testStderr:  &stderr,
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return sc, nil
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("show-config")); err != nil {
+		t.Fatal(err)
+	}
+	var got ipn.ServeConfig
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("stdout is not valid JSON: %v", err)
+	}
+	const want = "# foo.test.ts.net:443 matches mount points in order: /api/v2, /api, /\n"
+	if stderr.String() != want {
+		t.Errorf("stderr:\n got: %q\nwant: %q", stderr.String(), want)
+	}
+}
+
+func TestReconcileMountPoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		have        []string // mount points before, including newMount
+		newMount    string
+		wantDeleted []string
+		wantLeft    []string
+	}{
+		{
+			name:     "no-collision",
+			have:     []string{"/", "/foo", "/bar/"},
+			newMount: "/foo",
+			wantLeft: []string{"/", "/bar/", "/foo"},
+		},
+		{
+			name:        "slash-replaces-bare",
+			have:        []string{"/foo", "/foo/"},
+			newMount:    "/foo/",
+			wantDeleted: []string{"/foo"},
+			wantLeft:    []string{"/foo/"},
+		},
+		{
+			name:        "bare-replaces-slash",
+			have:        []string{"/foo", "/foo/"},
+			newMount:    "/foo",
+			wantDeleted: []string{"/foo/"},
+			wantLeft:    []string{"/foo"},
+		},
+		{
+			name:        "multi-level",
+			have:        []string{"/a/b", "/a/b/", "/a"},
+			newMount:    "/a/b/",
+			wantDeleted: []string{"/a/b"},
+			wantLeft:    []string{"/a", "/a/b/"},
+		},
+		{
+			name:     "nested-kept",
+			have:     []string{"/a/", "/a/b", "/a/b/c/"},
+			newMount: "/a/",
+			wantLeft: []string{"/a/", "/a/b", "/a/b/c/"},
+		},
+		{
+			name:     "sibling-prefix-kept",
+			have:     []string{"/foo", "/foobar", "/foo-bar/"},
+			newMount: "/foo",
+			wantLeft: []string{"/foo", "/foo-bar/", "/foobar"},
+		},
+		{
+			name:     "root",
+			have:     []string{"/", "/x"},
+			newMount: "/",
+			wantLeft: []string{"/", "/x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := map[string]*ipn.HTTPHandler{}
+			for _, m := range tt.have {
+				handlers[m] = &ipn.HTTPHandler{Text: m}
+			}
+			deleted := reconcileMountPoints(handlers, tt.newMount)
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted = %q; want %q", deleted, tt.wantDeleted)
+			}
+			if left := sortedMounts(handlers); !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("left = %q; want %q", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestServeCompress(t *testing.T) {
+	var saved *ipn.ServeConfig
+	e := newSavingServeEnv(&saved)
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("-compress /big text hello")); err != nil {
+		t.Fatal(err)
+	}
+	if h := saved.Web["foo.test.ts.net:443"].Handlers["/big"]; !h.Compress {
+		t.Fatalf("Compress not set: %+v", h)
+	}
+
+	if out := checkShowConfigRoundTrip(t, saved); !strings.Contains(out, `"Compress": true`) {
+		t.Errorf("show-config output lacks Compress:\n%s", out)
+	}
+
+	// And it's omitted when off.
+	j, err := json.Marshal(&ipn.HTTPHandler{Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "Compress") {
+		t.Errorf("Compress not omitted when false: %s", j)
+	}
+}
+
+func TestServeCacheMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	var saved *ipn.ServeConfig
+	for _, age := range []int{3600, 0} {
+		saved = nil
+		args := []string{"-cache-max-age", strconv.Itoa(age), "/static", "path", dir}
+		if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+		h := saved.Web["foo.test.ts.net:443"].Handlers["/static/"]
+		if h.CacheMaxAge == nil || *h.CacheMaxAge != age {
+			t.Fatalf("-cache-max-age %d: got handler %s", age, asJSON(h))
+		}
+		checkShowConfigRoundTrip(t, saved) // including zero
+	}
+
+	// It's unset by default, and the field is omitted.
+	saved = nil
+	if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), []string{"/static", "path", dir}); err != nil {
+		t.Fatal(err)
+	}
+	if j := asJSON(saved); strings.Contains(j, `"CacheMaxAge"`) {
+		t.Errorf("CacheMaxAge not omitted when unset: %s", j)
+	}
+
+	for _, args := range []string{"-cache-max-age -1 /static path " + dir, "-cache-max-age 1h /static path " + dir, "-cache-max-age 60 / text hi"} {
+		if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), cmd(args)); err == nil {
+			t.Errorf("%q: got no error", args)
+		}
+	}
+}
+
+func TestServeFollowRedirects(t *testing.T) {
+	var saved *ipn.ServeConfig
+	yes, no := true, false
+	for _, tt := range []struct {
+		flag string
+		want *bool
+	}{
+		{"-follow-redirects", &yes},
+		{"-follow-redirects=true", &yes},
+		{"-follow-redirects=false", &no},
+		{"", nil},
+	} {
+		saved = nil
+		args := append(strings.Fields(tt.flag), "/", "proxy", "https+insecure://localhost:8443")
+		if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+		h := saved.Web["foo.test.ts.net:443"].Handlers["/"]
+		if !reflect.DeepEqual(h.FollowRedirects, tt.want) {
+			t.Errorf("%q: got handler %s", tt.flag, asJSON(h))
+		}
+		if tt.want == nil && strings.Contains(asJSON(saved), `"FollowRedirects"`) {
+			t.Errorf("FollowRedirects not omitted when unset: %s", asJSON(saved))
+		}
+		checkShowConfigRoundTrip(t, saved) // including false
+	}
+	if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), cmd("-follow-redirects / text hi")); err == nil {
+		t.Error("-follow-redirects with a text handler: got no error")
+	}
+}
+
+func TestServeSPA(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(file, []byte("<html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var saved *ipn.ServeConfig
+	if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), cmd("-spa /app path "+dir)); err != nil {
+		t.Fatal(err)
+	}
+	if h := saved.Web["foo.test.ts.net:443"].Handlers["/app/"]; !h.SPAFallback {
+		t.Fatalf("-spa: got handler %s", asJSON(h))
+	}
+	checkShowConfigRoundTrip(t, saved)
+
+	// It's off by default, and the field is omitted.
+	saved = nil
+	if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), cmd("/app path "+dir)); err != nil {
+		t.Fatal(err)
+	}
+	if j := asJSON(saved); strings.Contains(j, `"SPAFallback"`) {
+		t.Errorf("SPAFallback not omitted when unset: %s", j)
+	}
+
+	for _, args := range []string{"-spa /app path " + file, "-spa / text hi", "-spa / proxy 3000"} {
+		if err := newServeCommand(newSavingServeEnv(&saved)).ParseAndRun(context.Background(), cmd(args)); err == nil {
+			t.Errorf("%q: got no error", args)
+		}
+	}
+}
+
+func TestServeSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "nonexistent.sock")
+	e := &serveEnv{testFlagOut: new(bytes.Buffer), testStdout: new(bytes.Buffer)}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("-socket "+sock+" show-config")); err == nil {
+		t.Fatal("show-config against a missing socket succeeded")
+	}
+	lc := e.localClient()
+	if lc == &localClient {
+		t.Fatal("-socket didn't get its own LocalClient")
+	}
+	if lc.Socket != sock || !lc.UseSocketOnly {
+		t.Errorf("LocalClient{Socket: %q, UseSocketOnly: %v}; want %q, true", lc.Socket, lc.UseSocketOnly, sock)
+	}
+	if e2 := new(serveEnv); e2.localClient() != &localClient {
+		t.Error("without -socket, want the default LocalClient")
+	}
+}
+
+func TestServeIngressHostPortMatchesWeb(t *testing.T) {
+	// A self name that net.JoinHostPort brackets, as for an IPv6 literal,
+	// catches a HostPort built by plain string concatenation.
+	const dnsName = "fd7a:115c:a1e0::1"
+	var sc *ipn.ServeConfig
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return sc, nil
+		},
+		testSetServeConfig: func(_ context.Context, c *ipn.ServeConfig) error {
+			sc = c
+			return nil
+		},
+		testGetLocalClientStatus: func(context.Context) (*ipnstate.Status, error) {
+			return &ipnstate.Status{
+				BackendState: ipn.Running.String(),
+				Self:         &ipnstate.PeerStatus{DNSName: dnsName + "."},
+			}, nil
+		},
+	}
+	for _, args := range []string{"/ proxy 3000", "ingress on"} {
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%s: %v", args, err)
+		}
+	}
+	const hp = "[" + dnsName + "]:443"
+	if _, ok := sc.Web[hp]; !ok {
+		t.Errorf("Web keys = %v; want %q", sc.Web, hp)
+	}
+	if !sc.AllowIngress[hp] || len(sc.AllowIngress) != 1 {
+		t.Errorf("AllowIngress = %v; want only %q", sc.AllowIngress, hp)
+	}
+}
+
+func TestServeTCPShow(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			5432: {TCPForward: "127.0.0.1:5432"},
+			8443: {TCPForward: "127.0.0.1:8443", TerminateTLS: "foo.test.ts.net"},
+			22:   {TCPForward: "10.0.0.2:22"},
+		},
+	}
+	for _, args := range []string{"tcp", "tcp show"} {
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return sc, nil
+			},
+		}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%s: %v", args, err)
+		}
+		const want = "" +
+			"PORT  FORWARD         TLS\n" +
+			"22    10.0.0.2:22     passthrough\n" +
+			"5432  127.0.0.1:5432  passthrough\n" +
+			"8443  127.0.0.1:8443  terminated (foo.test.ts.net)\n"
+		if got := stdout.String(); got != want {
+			t.Errorf("%s:\n got:\n%s\nwant:\n%s", args, got, want)
+		}
+	}
+}
+
+func TestServeReplaceConfirm(t *testing.T) {
+	cur := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hi"},
+			}},
+		},
+	}
+	tests := []struct {
+		args     string
+		terminal bool
+		answer   string
+		wantSave bool
+		wantErr  bool
+	}{
+		{args: "/ proxy 3000", terminal: true, answer: "y\n", wantSave: true},
+		{args: "/ proxy 3000", terminal: true, answer: "yes\n", wantSave: true},
+		{args: "/ proxy 3000", terminal: true, answer: "n\n", wantErr: true},
+		{args: "/ proxy 3000", terminal: true, answer: "\n", wantErr: true},
+		{args: "/ proxy 3000", terminal: true, answer: "", wantErr: true},
+		{args: "-force / proxy 3000", terminal: true, wantSave: true},
+		{args: "/ proxy 3000", terminal: false, wantSave: true},
+		{args: "/foo proxy 3000", terminal: true, wantSave: true}, // new mount; no prompt
+		{args: "/ text hi", terminal: true},                       // unchanged; no prompt
+	}
+	for _, tt := range tests {
+		var stderr bytes.Buffer
+		var saved *ipn.ServeConfig
+		e := newSavingServeEnv(&saved)
+		e.testStderr = &stderr
+		e.testStdin = strings.NewReader(tt.answer)
+		e.testStdinIsTerminal = tt.terminal
+		e.testGetServeConfig = func(context.Context) (*ipn.ServeConfig, error) {
+			return cur, nil
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q, answer %q: err = %v; want error: %v", tt.args, tt.answer, err, tt.wantErr)
+		}
+		if (saved != nil) != tt.wantSave {
+			t.Errorf("%q, answer %q: saved = %v; want %v", tt.args, tt.answer, saved != nil, tt.wantSave)
+		}
+		wantPrompt := tt.terminal && tt.args == "/ proxy 3000"
+		const prompt = "/ is already serving text; overwrite with proxy? [y/N] "
+		if got := stderr.String() == prompt; got != wantPrompt {
+			t.Errorf("%q, answer %q: stderr = %q; want prompt: %v", tt.args, tt.answer, stderr.String(), wantPrompt)
+		}
+	}
+}
+
+func TestServeCloneFrom(t *testing.T) {
+	dir := t.TempDir()
+	peerConfig := func(path string) *ipn.ServeConfig {
+		return &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"old.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":      {Proxy: "http://127.0.0.1:3000"},
+					"/files": {Path: path},
+				}},
+			},
+			AllowIngress: map[ipn.HostPort]bool{"old.test.ts.net:443": true},
+		}
+	}
+	status := func(context.Context) (*ipnstate.Status, error) {
+		return &ipnstate.Status{
+			BackendState: ipn.Running.String(),
+			Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net."},
+			Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+				key.NewNode().Public(): {DNSName: "old.test.ts.net.", HostName: "old-machine"},
+				key.NewNode().Public(): {DNSName: "other.test.ts.net.", HostName: "other"},
+			},
+		}, nil
+	}
+	tests := []struct {
+		name    string
+		args    string
+		cur     *ipn.ServeConfig
+		peer    *ipn.ServeConfig
+		want    *ipn.ServeConfig
+		wantErr bool
+	}{
+		{
+			name: "dns-name",
+			args: "clone-from old.test.ts.net",
+			peer: peerConfig(dir),
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/":      {Proxy: "http://127.0.0.1:3000"},
+						"/files": {Path: dir},
+					}},
+				},
+				AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+			},
+		},
+		{
+			name: "host-name",
+			args: "clone-from old-machine",
+			peer: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432", TerminateTLS: "old.test.ts.net"}},
+			},
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432", TerminateTLS: "foo.test.ts.net"}},
+			},
+		},
+		{
+			name:    "missing-path",
+			args:    "clone-from old",
+			peer:    peerConfig(filepath.Join(dir, "does-not-exist")),
+			wantErr: true,
+		},
+		{
+			name:    "local-config-not-empty",
+			args:    "clone-from old",
+			cur:     &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:22"}}},
+			peer:    peerConfig(dir),
+			wantErr: true,
+		},
+		{
+			name: "force",
+			args: "clone-from -force old",
+			cur:  &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:22"}}},
+			peer: &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}}},
+			want: &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}}},
+		},
+		{
+			name:    "unknown-peer",
+			args:    "clone-from nope",
+			peer:    peerConfig(dir),
+			wantErr: true,
+		},
+		{
+			name:    "peer-without-config",
+			args:    "clone-from old",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved *ipn.ServeConfig
+			e := newSavingServeEnv(&saved)
+			e.testGetServeConfig = func(context.Context) (*ipn.ServeConfig, error) {
+				return tt.cur, nil
+			}
+			e.testGetPeerServeConfig = func(_ context.Context, peer string) (*ipn.ServeConfig, error) {
+				if peer != "old.test.ts.net" {
+					t.Errorf("fetched config of %q; want old.test.ts.net", peer)
+				}
+				return tt.peer, nil
+			}
+			e.testGetLocalClientStatus = status
+			err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error: %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(saved, tt.want) {
+				t.Errorf("saved:\n%s\nwant:\n%s", asJSON(saved), asJSON(tt.want))
+			}
+		})
+	}
+}
+
+func TestServeCloneFromBasicAuth(t *testing.T) {
+	// As sent by the peer's tailscaled, with the hash left out.
+	peer := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"old.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":      {Text: "hi"},
+				"/admin": {Proxy: "http://127.0.0.1:3000", BasicAuthUser: "admin"},
+			}},
+		},
+	}
+	run := func(args string) (saved *ipn.ServeConfig, stdout string, err error) {
+		var out bytes.Buffer
+		e := newSavingServeEnv(&saved)
+		e.testStdout = &out
+		e.testGetPeerServeConfig = func(context.Context, string) (*ipn.ServeConfig, error) {
+			return peer, nil
+		}
+		e.testGetLocalClientStatus = func(context.Context) (*ipnstate.Status, error) {
+			return &ipnstate.Status{
+				BackendState: ipn.Running.String(),
+				Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net."},
+				Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+					key.NewNode().Public(): {DNSName: "old.test.ts.net.", HostName: "old"},
+				},
+			}, nil
+		}
+		err = newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		return saved, out.String(), err
+	}
+
+	saved, out, err := run("clone-from old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := saved.Web["foo.test.ts.net:443"].Handlers["/admin"]
+	if h.BasicAuthUser != "admin" || h.BasicAuthHash == "" {
+		t.Fatalf("got handler %s; want user admin with a new hash", asJSON(h))
+	}
+	if want := `New password for user "admin" at foo.test.ts.net:443/admin`; !strings.Contains(out, want) {
+		t.Errorf("output %q lacks %q", out, want)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	pass := lines[len(lines)-1]
+	if err := bcrypt.CompareHashAndPassword([]byte(h.BasicAuthHash), []byte(pass)); err != nil {
+		t.Errorf("printed password doesn't match stored hash: %v", err)
+	}
+	if got := peer.Web["old.test.ts.net:443"].Handlers["/admin"].BasicAuthHash; got != "" {
+		t.Error("peer config was mutated")
+	}
+
+	// A password that's never saved isn't printed.
+	if _, out, err := run("-dry-run-diff clone-from old"); err != nil || strings.Contains(out, "New password") {
+		t.Errorf("-dry-run-diff: err = %v, output %q; want no password", err, out)
+	}
+}
+
+func TestServeDoctor(t *testing.T) {
+	td := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	openPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	run := func(sc *ipn.ServeConfig) (string, error) {
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return sc, nil
+			},
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), []string{"doctor"})
+		return stdout.String(), err
+	}
+
+	healthy := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:" + openPort},
+				"/docs": {Path: td},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	for _, sc := range []*ipn.ServeConfig{nil, healthy} {
+		out, err := run(sc)
+		if err != nil || out != "No problems found.\n" {
+			t.Errorf("healthy config: got (%q, %v); want no problems", out, err)
+		}
+	}
+
+	broken := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {HTTPS: true, TCPForward: "127.0.0.1:5432"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:" + closedPort},
+				"/docs": {Path: filepath.Join(td, "gone")},
+			}},
+			"foo.test.ts.net:10000": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hi"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:8080": true},
+	}
+	out, err := run(broken)
+	if err == nil || err.Error() != "found 5 problems" {
+		t.Errorf("broken config: err = %v; want 5 problems", err)
+	}
+	for _, want := range []string{
+		"port 8443 is used by both web handlers and a TCP forward to 127.0.0.1:5432",
+		"foo.test.ts.net:443/: nothing is accepting connections on 127.0.0.1:" + closedPort,
+		"foo.test.ts.net:443/docs: path " + filepath.Join(td, "gone") + " doesn't exist",
+		"web handlers for foo.test.ts.net:10000 are unreachable",
+		"ingress is on for foo.test.ts.net:8080, but nothing is served there",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q; got:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(out, "\n  hint: "); n != 5 {
+		t.Errorf("got %d hints; want 5:\n%s", n, out)
+	}
+}
+
+func TestServeExitCodes(t *testing.T) {
+	td := t.TempDir()
+	badJSON := filepath.Join(td, "bad.json")
+	if err := os.WriteFile(badJSON, []byte(`{"TCP": {"0": {"HTTPS": true}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dialErr := fmt.Errorf("getting serve config: %w", &net.OpError{Op: "dial", Net: "unix", Err: os.ErrNotExist})
+	tests := []struct {
+		args   string
+		getErr error // from getServeConfig
+		want   int
+	}{
+		{args: "/ proxy 3000", want: 0},
+		{args: "/ proxy 0", want: serveExitInvalid},
+		{args: "/ bogus 3000", want: serveExitInvalid},        // flag.ErrHelp
+		{args: "-hsts -1 / text hi", want: serveExitInvalid},  // bad flag value
+		{args: "tcp 70000", want: serveExitInvalid},           // flag.ErrHelp in a subcommand
+		{args: "apply -f " + badJSON, want: serveExitInvalid}, // invalid config
+		{args: "/ proxy 3000", getErr: dialErr, want: serveExitNoDaemon},
+		{args: "show-config", getErr: dialErr, want: serveExitNoDaemon},
+		{args: "/ proxy 3000", getErr: errors.New("boom"), want: 1},
+		{args: "-must-change tcp off 5432", want: serveExitNoChange},
+		{args: "show-config", want: serveExitNoConfig},
+		{args: "list", want: serveExitNoConfig},
+		{args: "status", want: serveExitNoConfig},
+	}
+	for _, tt := range tests {
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return nil, daemonError(tt.getErr)
+			},
+			testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+		if got := ExitCode(err); got != tt.want {
+			t.Errorf("%q (getErr %v): exit code %d (err %v); want %d", tt.args, tt.getErr, got, err, tt.want)
+		}
+	}
+}
+
+func TestServeNoConfig(t *testing.T) {
+	for _, args := range []string{"show-config", "show-config -mount /", "list", "status", "status -format wide"} {
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return nil, nil
+			},
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		if !errors.Is(err, errNoServeConfig) {
+			t.Errorf("%q: err = %v; want %v", args, err, errNoServeConfig)
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("%q: printed %q; want nothing", args, stdout.String())
+		}
+	}
+
+	// A real error is not mistaken for a missing config.
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  new(bytes.Buffer),
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return nil, errors.New("boom")
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("show-config")); err == nil || errors.Is(err, errNoServeConfig) {
+		t.Errorf("show-config with a failing LocalAPI: err = %v; want a non-sentinel error", err)
+	}
+}
+
+func TestServeOnChange(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script")
+	}
+	td := t.TempDir()
+	got := filepath.Join(td, "got.json")
+	script := func(name, body string) string {
+		t.Helper()
+		p := filepath.Join(td, name)
+		if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	record := script("record", "cat > "+got)
+	fail := script("fail", "echo oops >&2; exit 3")
+	slow := script("slow", "exec sleep 10")
+
+	tests := []struct {
+		name      string
+		args      string
+		wantSaved bool
+		wantWarn  string // in stderr; empty means no warning
+		wantStdin bool   // got holds the saved config
+	}{
+		{name: "record", args: "-on-change " + record + " / text hi", wantSaved: true, wantStdin: true},
+		{name: "fail", args: "-on-change " + fail + " / text hi", wantSaved: true, wantWarn: "exit status 3"},
+		{name: "timeout", args: "-on-change " + slow + " -on-change-timeout 100ms / text hi", wantSaved: true, wantWarn: "timed out after 100ms"},
+		{name: "not-run-without-change", args: "-on-change " + fail + " tcp off 5432"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(got)
+			var stderr bytes.Buffer
+			var saved *ipn.ServeConfig
+			e := newSavingServeEnv(&saved)
+			e.testStderr = &stderr
+			if err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args)); err != nil {
+				t.Fatalf("got error %v; want success, as hook failures are only warnings", err)
+			}
+			if (saved != nil) != tt.wantSaved {
+				t.Fatalf("saved = %v; want %v", saved != nil, tt.wantSaved)
+			}
+			if tt.wantWarn == "" {
+				if strings.Contains(stderr.String(), "Warning") {
+					t.Errorf("unexpected warning: %q", stderr.String())
+				}
+			} else if !strings.Contains(stderr.String(), tt.wantWarn) {
+				t.Errorf("stderr = %q; want warning containing %q", stderr.String(), tt.wantWarn)
+			}
+			if !tt.wantStdin {
+				return
+			}
+			j, err := os.ReadFile(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sc ipn.ServeConfig
+			if err := json.Unmarshal(j, &sc); err != nil {
+				t.Fatalf("hook stdin isn't a serve config: %v\n%s", err, j)
+			}
+			if !reflect.DeepEqual(&sc, saved) {
+				t.Errorf("hook got config %s; want the saved one", j)
+			}
+		})
+	}
+
+}
+
+func TestServeValidate(t *testing.T) {
+	td := t.TempDir()
+	tests := []struct {
+		name      string
+		file      string // base name, so the format follows the extension
+		contents  string
+		wantLines []string // problem lines printed
+		wantErr   string
+	}{
+		{
+			name:     "valid",
+			file:     "ok.json",
+			contents: `{"TCP": {"443": {"HTTPS": true}}, "Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Proxy": "http://127.0.0.1:3000"}}}}}`,
+		},
+		{
+			name:     "valid-yaml",
+			file:     "ok.yaml",
+			contents: "TCP:\n  443:\n    HTTPS: true\n",
+		},
+		{
+			name:     "unknown-field",
+			file:     "unknown.json",
+			contents: `{"TCP": {"443": {"HTTPS": true, "Bogus": 1}}}`,
+			wantErr:  `unknown field "Bogus"`,
+		},
+		{
+			name:     "one-problem",
+			file:     "one.json",
+			contents: `{"UDP": {"53": {"UDPForward": "127.0.0.1:0"}}}`,
+			wantLines: []string{
+				`- UDP[53]: invalid UDPForward port "0"`,
+			},
+			wantErr: "found 1 problem",
+		},
+		{
+			name: "several-problems",
+			file: "bad.json",
+			contents: `{
+				"TCP": {"0": {"HTTPS": true}, "22": {"TCPForward": "nope"}},
+				"Web": {"foo.test.ts.net:443": {"Handlers": {
+					"/a/../b": {"Text": "hi"},
+					"/api": {"Proxy": "ftp://127.0.0.1:21"},
+					"/both": {"Text": "hi", "Path": "/tmp"}
+				}}}
+			}`,
+			wantLines: []string{
+				"- TCP: port 0 is invalid",
+				`- TCP[22]: invalid TCPForward "nope"`,
+				`- Web["foo.test.ts.net:443"]: invalid mount point "/a/../b"`,
+				`- Web["foo.test.ts.net:443"]["/api"]: invalid Proxy`,
+				`- Web["foo.test.ts.net:443"]["/both"]: exactly one of Path, Proxy, Text, Redirect, or Files must be set`,
+			},
+			wantErr: "found 5 problems",
+		},
+		{
+			name: "named-files",
+			file: "files.json",
+			contents: `{"Web": {"foo.test.ts.net:443": {"Handlers": {
+				"/dl": {"Files": {"a.zip": "/x/a.zip"}},
+				"/rel/": {"Files": {"a.zip": "x/a.zip"}},
+				"/slash/": {"Files": {"a/b.zip": "/x/b.zip"}}
+			}}}}`,
+			wantLines: []string{
+				`- Web["foo.test.ts.net:443"]["/dl"]: Files requires a mount point ending in "/"`,
+				`- Web["foo.test.ts.net:443"]["/rel/"]: Files["a.zip"]: "x/a.zip" is not an absolute path`,
+				`- Web["foo.test.ts.net:443"]["/slash/"]: Files: invalid file name "a/b.zip"`,
+			},
+			wantErr: "found 3 problems",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(td, tt.file)
+			if err := os.WriteFile(p, []byte(tt.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var stdout bytes.Buffer
+			e := &serveEnv{
+				testFlagOut: new(bytes.Buffer),
+				testStdout:  &stdout,
+				testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+					t.Fatal("validate contacted tailscaled")
+					return nil, nil
+				},
+				testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+					t.Fatal("validate saved a config")
+					return nil
+				},
+			}
+			err := newServeCommand(e).ParseAndRun(context.Background(), []string{"validate", "-f", p})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := stdout.String(); got != p+": no problems found\n" {
+					t.Errorf("stdout = %q", got)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v; want containing %q", err, tt.wantErr)
+			}
+			if got := ExitCode(err); got != serveExitInvalid {
+				t.Errorf("exit code = %d; want %d", got, serveExitInvalid)
+			}
+			lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+			if len(tt.wantLines) == 0 {
+				lines = nil
+			}
+			if len(lines) != len(tt.wantLines) {
+				t.Fatalf("got problems:\n%s\nwant %d", stdout.String(), len(tt.wantLines))
+			}
+			for i, want := range tt.wantLines {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("problem %d = %q; want prefix %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeExpectTailnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		tailnet   string // of the fake status; empty means unknown
+		args      string
+		wantSaved bool
+		wantErr   string
+	}{
+		{name: "no-flag", tailnet: "example.com", args: "/ text hi", wantSaved: true},
+		{name: "match", tailnet: "example.com", args: "-expect-tailnet example.com / text hi", wantSaved: true},
+		{name: "mismatch", tailnet: "other.org", args: "-expect-tailnet example.com / text hi", wantErr: `on tailnet "other.org", not "example.com"`},
+		{name: "unknown", args: "-expect-tailnet example.com / text hi", wantErr: "current tailnet is unknown"},
+		{name: "tcp-mismatch", tailnet: "other.org", args: "-expect-tailnet example.com tcp 5432", wantErr: `not "example.com"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			var saved bool
+			e := &serveEnv{
+				testFlagOut: new(bytes.Buffer),
+				testStdout:  new(bytes.Buffer),
+				testStderr:  &stderr,
+				testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+					return nil, nil
+				},
+				testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+					saved = true
+					return nil
+				},
+				testGetLocalClientStatus: func(ctx context.Context) (*ipnstate.Status, error) {
+					st, _ := fakeRunningStatus(ctx)
+					if tt.tailnet != "" {
+						st.CurrentTailnet = &ipnstate.TailnetStatus{Name: tt.tailnet}
+					}
+					return st, nil
+				},
+			}
+			err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v; want containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if saved != tt.wantSaved {
+				t.Errorf("saved = %v; want %v", saved, tt.wantSaved)
+			}
+			wantNote := fmt.Sprintf("Changing the serve config for tailnet %q.\n", tt.tailnet)
+			if got := stderr.String(); tt.wantSaved && !strings.Contains(got, wantNote) {
+				t.Errorf("stderr = %q; want %q", got, wantNote)
+			}
+		})
+	}
+}
+
+func TestServeShowConfigSecrets(t *testing.T) {
+	const hash = "$2a$10$abcdefghijklmnopqrstuv"
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/admin": {Proxy: "http://127.0.0.1:3000", BasicAuthUser: "admin", BasicAuthHash: hash},
+			}},
+		},
+	}
+	show := func(args ...string) string {
+		t.Helper()
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut:        new(bytes.Buffer),
+			testStdout:         &stdout,
+			testStderr:         new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) { return sc, nil },
+		}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), append([]string{"show-config"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+
+	out := show()
+	if strings.Contains(out, hash) || !strings.Contains(out, `"BasicAuthHash": "`+redactedSecret+`"`) {
+		t.Errorf("default output doesn't redact BasicAuthHash:\n%s", out)
+	}
+	if !strings.Contains(out, `"BasicAuthUser": "admin"`) {
+		t.Errorf("BasicAuthUser should not be redacted:\n%s", out)
+	}
+	if out := show("-mount", "/admin"); strings.Contains(out, hash) {
+		t.Errorf("-mount output doesn't redact BasicAuthHash:\n%s", out)
+	}
+	if out := show("-show-secrets"); !strings.Contains(out, hash) {
+		t.Errorf("-show-secrets output is missing BasicAuthHash:\n%s", out)
+	}
+	if got := sc.Web["foo.test.ts.net:443"].Handlers["/admin"].BasicAuthHash; got != hash {
+		t.Errorf("redacting modified the config: BasicAuthHash = %q", got)
+	}
+	if strings.Contains(asJSON(sc), hash) {
+		t.Error("asJSON doesn't redact BasicAuthHash")
+	}
+
+	// A redacted config can't be applied by mistake.
+	if _, err := decodeServeConfig(strings.NewReader(out)); err == nil || !strings.Contains(err.Error(), "redacted") {
+		t.Errorf("decoding redacted config: err = %v; want it rejected", err)
+	}
+}
+
+func TestDiffServeConfigs(t *testing.T) {
+	web := func(handlers map[string]*ipn.HTTPHandler) map[ipn.HostPort]*ipn.WebServerConfig {
+		return map[ipn.HostPort]*ipn.WebServerConfig{"foo.test.ts.net:443": {Handlers: handlers}}
+	}
+	base := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: web(map[string]*ipn.HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}}),
+	}
+	tests := []struct {
+		name string
+		a, b *ipn.ServeConfig
+		want []string
+	}{
+		{name: "nil", want: nil},
+		{name: "empty-vs-nil", a: new(ipn.ServeConfig), want: nil},
+		{name: "same", a: base, b: base.Clone(), want: nil},
+		{
+			name: "from-nil",
+			b:    base,
+			want: []string{
+				"+ web foo.test.ts.net:443/: proxy http://127.0.0.1:3000",
+				"+ tcp 443: HTTPS",
+			},
+		},
+		{
+			name: "client-cert",
+			a:    base,
+			b: &ipn.ServeConfig{
+				TCP: base.TCP,
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{"foo.test.ts.net:443": {
+					Handlers:          base.Web["foo.test.ts.net:443"].Handlers,
+					RequireClientCert: true,
+				}},
+			},
+			want: []string{"~ web foo.test.ts.net:443: RequireClientCert: false -> true"},
+		},
+		{
+			name: "web-changes",
+			a:    base,
+			b: &ipn.ServeConfig{
+				TCP: base.TCP,
+				Web: web(map[string]*ipn.HTTPHandler{
+					"/":     {Proxy: "http://127.0.0.1:3001"},
+					"/docs": {Text: "hi", StatusCode: 201},
+				}),
+			},
+			want: []string{
+				`~ web foo.test.ts.net:443/: Proxy: "http://127.0.0.1:3000" -> "http://127.0.0.1:3001"`,
+				`+ web foo.test.ts.net:443/docs: text "hi"`,
+			},
+		},
+		{
+			name: "web-removed",
+			a:    base,
+			b:    &ipn.ServeConfig{TCP: base.TCP},
+			want: []string{"- web foo.test.ts.net:443/: proxy http://127.0.0.1:3000"},
+		},
+		{
+			name: "tcp-changes",
+			a: &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{
+				22:   {TCPForward: "127.0.0.1:22"},
+				5432: {TCPForward: "127.0.0.1:5432"},
+			}},
+			b: &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{
+				22:   {TCPForward: "127.0.0.1:2222"},
+				8443: {TCPForward: "127.0.0.1:8443", TerminateTLS: "foo.test.ts.net"},
+			}},
+			want: []string{
+				`~ tcp 22: TCPForward: "127.0.0.1:22" -> "127.0.0.1:2222"`,
+				"- tcp 5432: forward to 127.0.0.1:5432",
+				"+ tcp 8443: forward to 127.0.0.1:8443, terminating TLS for foo.test.ts.net",
+			},
+		},
+		{
+			name: "ingress-changes",
+			a: &ipn.ServeConfig{AllowIngress: map[ipn.HostPort]bool{
+				"foo.test.ts.net:443": true,
+				"foo.test.ts.net:80":  false, // same as unset
+			}},
+			b: &ipn.ServeConfig{AllowIngress: map[ipn.HostPort]bool{
+				"foo.test.ts.net:8443": true,
+			}},
+			want: []string{
+				"- ingress foo.test.ts.net:443",
+				"+ ingress foo.test.ts.net:8443",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffServeConfigs(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestServeDryRunDiff(t *testing.T) {
+	cur := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "hi"}}},
+		},
+	}
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"-dry-run-diff /api proxy 3000", "+ web foo.test.ts.net:443/api: proxy http://127.0.0.1:3000\nDry run; not saving.\n"},
+		{"-dry-run-diff -force / text bye", "~ web foo.test.ts.net:443/: Text: \"hi\" -> \"bye\"\nDry run; not saving.\n"},
+		{"-dry-run-diff / text hi", "No changes.\n"},
+		{"-dry-run-diff ingress on", "+ ingress foo.test.ts.net:443\nDry run; not saving.\n"},
+	}
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  &stdout,
+			testStderr:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return cur.Clone(), nil // like tailscaled, a new copy each time
+			},
+			testSetServeConfig: func(_ context.Context, sc *ipn.ServeConfig) error {
+				t.Errorf("%q: saved %s", tt.args, asJSON(sc))
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		if err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args)); err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		if got := stdout.String(); got != tt.want {
+			t.Errorf("%q: got %q; want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// tcp goes through the same path.
+	var stdout bytes.Buffer
+	e := &serveEnv{
+		testFlagOut:              new(bytes.Buffer),
+		testStdout:               &stdout,
+		testGetServeConfig:       func(context.Context) (*ipn.ServeConfig, error) { return nil, nil },
+		testSetServeConfig:       func(context.Context, *ipn.ServeConfig) error { t.Error("tcp saved"); return nil },
+		testGetLocalClientStatus: fakeRunningStatus,
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("-dry-run-diff tcp 5432")); err != nil {
+		t.Fatal(err)
+	}
+	if want := "+ tcp 443: forward to 127.0.0.1:5432\nDry run; not saving.\n"; stdout.String() != want {
+		t.Errorf("tcp: got %q; want %q", stdout.String(), want)
+	}
+}
+
+func TestServeBackupRestore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "backups")
+	orig := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000", BasicAuthUser: "admin", BasicAuthHash: "$2a$10$abcdefghijklmnopqrstuv"},
+			}},
+		},
+		AllowIngress: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}
+	cur := orig
+	var saves int
+	newEnv := func(stdout io.Writer) *serveEnv {
+		return &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  stdout,
+			testStderr:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return cur.Clone(), nil
+			},
+			testSetServeConfig: func(_ context.Context, sc *ipn.ServeConfig) error {
+				saves++
+				cur = sc
+				return nil
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+			testNow: func() time.Time {
+				return time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+			},
+		}
+	}
+	run := func(args string) (string, error) {
+		var stdout bytes.Buffer
+		err := newServeCommand(newEnv(&stdout)).ParseAndRun(context.Background(), cmd(args))
+		return stdout.String(), err
+	}
+
+	out, err := run("backup " + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "serve-20230405T060708Z.json")
+	if out != backup+"\n" {
+		t.Errorf("backup printed %q; want %q", out, backup+"\n")
+	}
+	if runtime.GOOS != "windows" {
+		if fi, err := os.Stat(backup); err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != 0600 {
+			t.Errorf("backup mode = %v; want 0600", fi.Mode().Perm())
+		}
+	}
+	// A second backup in the same second must not overwrite the first.
+	if _, err := run("backup " + dir); err == nil {
+		t.Error("second backup with the same timestamp succeeded")
+	}
+
+	cur = &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}}}
+	out, err = run("restore -dry-run " + backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saves != 0 {
+		t.Errorf("restore -dry-run saved the config")
+	}
+	if !strings.HasSuffix(out, "Dry run; not saving.\n") || !strings.Contains(out, "+ web foo.test.ts.net:443/") {
+		t.Errorf("restore -dry-run printed:\n%s", out)
+	}
+
+	if _, err := run("restore " + backup); err != nil {
+		t.Fatal(err)
+	}
+	if saves != 1 {
+		t.Errorf("restore saved %d times; want 1", saves)
+	}
+	if !reflect.DeepEqual(cur, orig) {
+		t.Errorf("restored config:\n%s\nwant:\n%s", asJSON(cur), asJSON(orig))
+	}
+
+	// Restore validates the file.
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"TCP": {"0": {"HTTPS": true}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("restore " + bad); ExitCode(err) != serveExitInvalid {
+		t.Errorf("restore of an invalid file: err = %v; want exit status %d", err, serveExitInvalid)
+	}
+	if saves != 1 {
+		t.Errorf("restore of an invalid file saved the config")
+	}
+
+	cur = nil
+	if _, err := run("backup " + dir); !errors.Is(err, errNoServeConfig) {
+		t.Errorf("backup with no config: err = %v; want %v", err, errNoServeConfig)
+	}
+}
+
+func TestServeAllowOffline(t *testing.T) {
+	stopped := func(context.Context) (*ipnstate.Status, error) {
+		return &ipnstate.Status{
+			BackendState: ipn.Stopped.String(),
+			Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net."},
+		}, nil
+	}
+	neverLoggedIn := func(context.Context) (*ipnstate.Status, error) {
+		return &ipnstate.Status{BackendState: ipn.NeedsLogin.String()}, nil
+	}
+	tests := []struct {
+		args    string
+		status  func(context.Context) (*ipnstate.Status, error)
+		want    *ipn.ServeConfig
+		wantErr bool
+	}{
+		{
+			args:   "-allow-offline / proxy 3000",
+			status: stopped,
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/": {Proxy: "http://127.0.0.1:3000"},
+					}},
+				},
+			},
+		},
+		{
+			// TCP forwards don't need the node's name.
+			args:   "-allow-offline tcp 5432",
+			status: neverLoggedIn,
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}},
+			},
+		},
+		{
+			args:    "-allow-offline / proxy 3000",
+			status:  neverLoggedIn,
+			wantErr: true,
+		},
+		{
+			args:    "-allow-offline tcp -terminate-tls 5432",
+			status:  neverLoggedIn,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		var saved *ipn.ServeConfig
+		e := newSavingServeEnv(&saved)
+		e.testGetLocalClientStatus = tt.status
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(tt.args))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error: %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(saved, tt.want) {
+			t.Errorf("%q: saved %s; want %s", tt.args, asJSON(saved), asJSON(tt.want))
+		}
+	}
+}
+
+func TestServeNotRunning(t *testing.T) {
+	for _, args := range []string{"/ proxy 3000", "share-link", "tcp -terminate-tls 5432", "clone-from old"} {
+		saved := false
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testStderr:  new(bytes.Buffer),
+			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+				return &ipn.ServeConfig{
+					TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+					Web: map[ipn.HostPort]*ipn.WebServerConfig{
+						"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": {Text: "hi"}}},
+					},
+				}, nil
+			},
+			testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+				saved = true
+				return nil
+			},
+			testGetLocalClientStatus: func(context.Context) (*ipnstate.Status, error) {
+				return &ipnstate.Status{
+					BackendState: ipn.Stopped.String(),
+					Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net."},
+				}, nil
+			},
+		}
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		var nre notRunningError
+		if !errors.As(err, &nre) {
+			t.Errorf("%q: err = %v; want a notRunningError", args, err)
+			continue
+		}
+		if nre.description != "Tailscale is stopped." {
+			t.Errorf("%q: description = %q", args, nre.description)
+		}
+		if ExitCode(err) != 1 {
+			t.Errorf("%q: exit code %d; want 1", args, ExitCode(err))
+		}
+		if saved {
+			t.Errorf("%q: saved a config", args)
+		}
+	}
+}
+
+func TestServeLabel(t *testing.T) {
+	var saved *ipn.ServeConfig
+	newEnv := func(stdout io.Writer) *serveEnv {
+		e := newSavingServeEnv(&saved)
+		e.testStdout = stdout
+		return e
+	}
+	run := func(stdout io.Writer, args ...string) {
+		t.Helper()
+		if err := newServeCommand(newEnv(stdout)).ParseAndRun(context.Background(), args); err != nil {
+			t.Fatalf("%q: %v", args, err)
+		}
+	}
+	// The web handlers use port 80 so that the TCP forward can use 443.
+	run(new(bytes.Buffer), "-http", "-label", "admin UI", "/admin", "proxy", "3000")
+	run(new(bytes.Buffer), "-http", "/", "text", "hi")
+	run(new(bytes.Buffer), "tcp", "-label", "postgres", "5432")
+
+	if got := saved.Web["foo.test.ts.net:80"].Handlers["/admin"].Comment; got != "admin UI" {
+		t.Errorf("web Comment = %q; want %q", got, "admin UI")
+	}
+	if got := saved.TCP[443].Comment; got != "postgres" {
+		t.Errorf("TCP Comment = %q; want %q", got, "postgres")
+	}
+	if strings.Count(asJSON(saved), `"Comment"`) != 2 {
+		t.Errorf("Comment not omitted when unset: %s", asJSON(saved))
+	}
+
+	var stdout bytes.Buffer
+	run(&stdout, "show-config")
+	got, err := decodeServeConfig(&stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, saved) {
+		t.Errorf("round trip changed config:\n got: %s\nwant: %s", asJSON(got), asJSON(saved))
+	}
+
+	stdout.Reset()
+	run(&stdout, "list")
+	const want = "" +
+		"http\tfoo.test.ts.net:80\t/\ttext\t\"hi\"\n" +
+		"http\tfoo.test.ts.net:80\t/admin\tproxy\thttp://127.0.0.1:3000\tlabel=\"admin UI\"\n" +
+		"tcp\t443\tforward\t127.0.0.1:5432\tlabel=\"postgres\"\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("list got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestServeConfigVersion(t *testing.T) {
+	if len(serveConfigMigrations) != ipn.ServeConfigVersion {
+		t.Fatalf("%d serve config migrations for version %d; want one per version", len(serveConfigMigrations), ipn.ServeConfigVersion)
+	}
+	var saved *ipn.ServeConfig
+	newEnv := func(stdin string) *serveEnv {
+		e := newSavingServeEnv(&saved)
+		e.testStdin = strings.NewReader(stdin)
+		return e
+	}
+
+	// An unversioned config, as written before versioning, with proxy
+	// targets in the short forms that version 1 no longer stores.
+	const old = `{
+		"TCP": {"443": {"HTTPS": true}},
+		"Web": {"foo.test.ts.net:443": {"Handlers": {
+			"/": {"Proxy": "3000", "ExtraProxies": ["localhost:3001"]},
+			"/h2c": {"Proxy": "h2c://localhost:50051"}
+		}}}
+	}`
+	for _, args := range []string{"apply -f -", "set-raw"} {
+		saved = nil
+		if err := newServeCommand(newEnv(old)).ParseAndRun(context.Background(), cmd(args)); err != nil {
+			t.Fatalf("%s: %v", args, err)
+		}
+		want := &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000", ExtraProxies: []string{"http://127.0.0.1:3001"}},
+					"/h2c": {Proxy: "h2c://localhost:50051"},
+				}},
+			},
+		}
+		if !reflect.DeepEqual(saved, want) {
+			t.Errorf("%s: got %s; want %s", args, asJSON(saved), asJSON(want))
+		}
+	}
+
+	// Migrating leaves configs already in the current format alone.
+	saved = nil
+	current := `{"Version": 1, "TCP": {"443": {"HTTPS": true}}, "Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Proxy": "http://127.0.0.1:3000"}}}}}`
+	if err := newServeCommand(newEnv(current)).ParseAndRun(context.Background(), cmd("apply -f -")); err != nil {
+		t.Fatal(err)
+	}
+	if h := saved.Web["foo.test.ts.net:443"].Handlers["/"]; saved.Version != 1 || h.Proxy != "http://127.0.0.1:3000" {
+		t.Errorf("version 1 config: got %s", asJSON(saved))
+	}
+
+	// Configs from a newer version are rejected before their unknown
+	// fields are.
+	saved = nil
+	newer := fmt.Sprintf(`{"Version": %d, "SomeFutureField": true}`, ipn.ServeConfigVersion+1)
+	err := newServeCommand(newEnv(newer)).ParseAndRun(context.Background(), cmd("apply -f -"))
+	if err == nil || !strings.Contains(err.Error(), "is newer than the newest this version of tailscale supports") {
+		t.Errorf("newer config: got error %v", err)
+	}
+	if ExitCode(err) != serveExitInvalid {
+		t.Errorf("newer config: exit code %d; want %d", ExitCode(err), serveExitInvalid)
+	}
+	if saved != nil {
+		t.Errorf("newer config was saved: %s", asJSON(saved))
+	}
+}
+
+func TestServeOutputURL(t *testing.T) {
+	var saved *ipn.ServeConfig
+	run := func(args string) (stdout string, err error) {
+		var out bytes.Buffer
+		e := newSavingServeEnv(&saved)
+		e.testStdout = &out
+		err = newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		return out.String(), err
+	}
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		args string
+		want string
+	}{
+		{"-output-url / proxy 3000", "https://foo.test.ts.net/\n"},
+		{"-output-url /docs path " + dir, "https://foo.test.ts.net/docs/\n"},
+		{"-output-url /docs path " + dir, "https://foo.test.ts.net/docs/\n"}, // unchanged
+		{"-output-url -http /a /b text hi", "http://foo.test.ts.net/a\nhttp://foo.test.ts.net/b\n"},
+		{"-output-url set /x text hi /y proxy 3000", "https://foo.test.ts.net/x\nhttps://foo.test.ts.net/y\n"},
+		{"/ proxy 3001", ""},
+	} {
+		got, err := run(tt.args)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.args, err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: stdout = %q; want %q", tt.args, got, tt.want)
+		}
+	}
+	if _, err := run("-output-url -dry-run-diff / proxy 3000"); ExitCode(err) != serveExitInvalid {
+		t.Errorf("-output-url with -dry-run-diff: got %v; want exit status %d", err, serveExitInvalid)
+	}
+}
+
+func TestServeAllowRoot(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	for _, d := range []string{filepath.Join(root, "public"), filepath.Join(other, "secret")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "public", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(other, "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A link inside the root to a directory outside of it.
+	if err := os.Symlink(filepath.Join(other, "secret"), filepath.Join(root, "link")); err != nil {
+		t.Skipf("can't make symlinks: %v", err)
+	}
+
+	var saved *ipn.ServeConfig
+	run := func(args string) error {
+		saved = nil
+		e := newSavingServeEnv(&saved)
+		return newServeCommand(e).ParseAndRun(context.Background(), cmd("-allow-root "+root+" "+args))
+	}
+
+	for _, args := range []string{
+		"/ path " + filepath.Join(root, "public"),
+		"/ path " + root,
+		"/a path " + filepath.Join(root, "public", "a.txt"),
+		"/f/ path a.txt=" + filepath.Join(root, "public", "a.txt"),
+	} {
+		if err := run(args); err != nil {
+			t.Errorf("%q: %v", args, err)
+		} else if saved == nil {
+			t.Errorf("%q: not saved", args)
+		}
+	}
+	for _, tt := range []struct{ args, wantErr string }{
+		{"/ path " + other, "outside of -allow-root"},
+		{"/ path " + filepath.Join(root, "public", "..", ".."), "outside of -allow-root"},
+		{"/ path " + filepath.Join(root, "link"), "resolves to"},
+		{"/f/ path b.txt=" + filepath.Join(other, "b.txt"), "outside of -allow-root"},
+	} {
+		err := run(tt.args)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got error %v; want one containing %q", tt.args, err, tt.wantErr)
+		}
+		if saved != nil {
+			t.Errorf("%q: saved %s", tt.args, asJSON(saved))
+		}
+	}
+}
 
-	// And now run the steps above.
-	var current *ipn.ServeConfig
-	for i, st := range steps {
-		if st.reset {
-			t.Logf("Executing step #%d, line %v: [reset]", i, st.line)
-			current = nil
+func TestServePortEnv(t *testing.T) {
+	var saved *ipn.ServeConfig
+	run := func(args string) error {
+		saved = nil
+		e := newSavingServeEnv(&saved)
+		return newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+	}
+	web := func(port uint16, plain bool) *ipn.ServeConfig {
+		return &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{port: {HTTPS: !plain, HTTP: plain}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				webHostPort("foo.test.ts.net", port): {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hi"},
+				}},
+			},
 		}
-		if st.command == nil {
-			continue
+	}
+	tests := []struct {
+		env  string
+		args string
+		want *ipn.ServeConfig
+	}{
+		{"", "/ text hi", web(443, false)},
+		{"8443", "/ text hi", web(8443, false)},
+		{"8443", "-port 9443 / text hi", web(9443, false)}, // the flag wins
+		{"8443", "-http / text hi", web(80, true)},
+		{"", "-port 8080 -http / text hi", web(8080, true)},
+	}
+	for _, tt := range tests {
+		t.Setenv(servePortEnv, tt.env)
+		if err := run(tt.args); err != nil {
+			t.Fatalf("%s=%s %q: %v", servePortEnv, tt.env, tt.args, err)
 		}
-		t.Logf("Executing step #%d, line %v: %q ... ", i, st.line, st.command)
+		if !reflect.DeepEqual(saved, tt.want) {
+			t.Errorf("%s=%s %q: got %s; want %s", servePortEnv, tt.env, tt.args, asJSON(saved), asJSON(tt.want))
+		}
+	}
 
-		var stdout bytes.Buffer
-		var flagOut bytes.Buffer
-		var newState *ipn.ServeConfig
+	t.Setenv(servePortEnv, "nope")
+	if err := run("/ text hi"); ExitCode(err) != serveExitInvalid || !strings.Contains(err.Error(), servePortEnv) {
+		t.Errorf("invalid %s: got %v; want an invalid-argument error naming it", servePortEnv, err)
+	}
+	t.Setenv(servePortEnv, "")
+	if err := run("-port 70000 / text hi"); ExitCode(err) != serveExitInvalid {
+		t.Errorf("-port 70000: got %v; want exit status %d", err, serveExitInvalid)
+	}
+}
+
+func TestServeVerbose(t *testing.T) {
+	var saved *ipn.ServeConfig
+	var setErr error
+	run := func(args string) (stderr string, err error) {
+		var buf bytes.Buffer
 		e := &serveEnv{
-			testFlagOut: &flagOut,
-			testStdout:  &stdout,
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testStderr:  &buf,
 			testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
-				return current, nil
+				return saved, nil
 			},
-			testSetServeConfig: func(_ context.Context, c *ipn.ServeConfig) error {
-				newState = c
+			testSetServeConfig: func(_ context.Context, sc *ipn.ServeConfig) error {
+				if setErr != nil {
+					return setErr
+				}
+				saved = sc
 				return nil
 			},
+			testGetLocalClientStatus: fakeRunningStatus,
 		}
-		cmd := newServeCommand(e)
-		err := cmd.ParseAndRun(context.Background(), st.command)
-		if flagOut.Len() > 0 {
-			t.Logf("flag package output: %q", flagOut.Bytes())
+		err = newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		return buf.String(), err
+	}
+	const newConfig = `{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Text":"hi"}}}}}`
+
+	got, err := run("-v / text hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"serve: fetched current serve config: none\n" +
+		"serve: validated new serve config\n" +
+		"serve: computed new serve config: " + newConfig + "\n" +
+		"serve: saved serve config\n"
+	if got != want {
+		t.Errorf("first change logged:\n%s\nwant:\n%s", got, want)
+	}
+
+	got, err = run("-v / text hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "" +
+		"serve: fetched current serve config: " + newConfig + "\n" +
+		"serve: validated new serve config\n" +
+		"serve: new serve config is the same as the current one; not saving\n"
+	if got != want {
+		t.Errorf("no-op logged:\n%s\nwant:\n%s", got, want)
+	}
+
+	setErr = errors.New("boom")
+	got, err = run("-v /x text hi")
+	if err != setErr {
+		t.Fatalf("got error %v; want %v", err, setErr)
+	}
+	if !strings.HasSuffix(got, "serve: saving serve config failed: boom\n") {
+		t.Errorf("failed save logged:\n%s", got)
+	}
+
+	// Without -v, nothing is logged.
+	setErr = nil
+	if got, err := run("/y text hi"); err != nil || got != "" {
+		t.Errorf("without -v: got stderr %q, error %v", got, err)
+	}
+}
+
+// fakeServeConfigAPI is a LocalAPI serve-config endpoint with ETags, as
+// served by tailscaled. If beforeSet is non-nil, it's called before each
+// POST is handled, to simulate a change made by another client.
+type fakeServeConfigAPI struct {
+	mu        sync.Mutex
+	sc        *ipn.ServeConfig
+	gen       int // bumped on each change; the ETag
+	sets      int // POSTs received
+	beforeSet func(*fakeServeConfigAPI)
+}
+
+func (f *fakeServeConfigAPI) etag() string { return strconv.Quote(strconv.Itoa(f.gen)) }
+
+func (f *fakeServeConfigAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/localapi/v0/serve-config" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Etag", f.etag())
+		json.NewEncoder(w).Encode(f.sc)
+	case "POST":
+		f.sets++
+		if f.beforeSet != nil {
+			f.beforeSet(f)
 		}
-		if err != nil {
-			if st.wantErr == nil {
-				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, err)
+		if m := r.Header.Get("If-Match"); m != "" && m != f.etag() {
+			http.Error(w, "serve config changed since it was read", http.StatusPreconditionFailed)
+			return
+		}
+		sc := new(ipn.ServeConfig)
+		if err := json.NewDecoder(r.Body).Decode(sc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.sc = sc
+		f.gen++
+	}
+}
+
+func TestServeConfigCompareAndSwap(t *testing.T) {
+	api := new(fakeServeConfigAPI)
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	run := func(args string) (stderr string, err error) {
+		var buf bytes.Buffer
+		e := &serveEnv{
+			testFlagOut: new(bytes.Buffer),
+			testStdout:  new(bytes.Buffer),
+			testStderr:  &buf,
+			lc: &tailscale.LocalClient{
+				Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "tcp", ts.Listener.Addr().String())
+				},
+			},
+			testGetLocalClientStatus: fakeRunningStatus,
+		}
+		err = newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		return buf.String(), err
+	}
+
+	// Another client adds /b between our read and our first save. The
+	// save fails, and the retry keeps both handlers.
+	api.beforeSet = func(f *fakeServeConfigAPI) {
+		f.beforeSet = nil
+		f.sc = &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/b": {Text: "b"},
+				}},
+			},
+		}
+		f.gen++
+	}
+	got, err := run("-v /a text a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.sets != 2 {
+		t.Errorf("got %d saves; want 2", api.sets)
+	}
+	if !strings.Contains(got, "serve: serve config changed while updating it; retrying\n") {
+		t.Errorf("retry not logged:\n%s", got)
+	}
+	handlers := api.sc.Web["foo.test.ts.net:443"].Handlers
+	if handlers["/a"] == nil || handlers["/b"] == nil {
+		t.Errorf("after retry, got handlers %v; want /a and /b", sortedKeys(handlers, nil))
+	}
+
+	// If the config keeps changing, the command gives up.
+	api.sets = 0
+	api.beforeSet = func(f *fakeServeConfigAPI) { f.gen++ }
+	_, err = run("/c text c")
+	if !errors.Is(err, tailscale.ErrServeConfigChanged) || ExitCode(err) != serveExitChanged {
+		t.Fatalf("got error %v (exit %d); want ErrServeConfigChanged (exit %d)", err, ExitCode(err), serveExitChanged)
+	}
+	if api.sets != maxServeConfigAttempts {
+		t.Errorf("got %d saves; want %d", api.sets, maxServeConfigAttempts)
+	}
+	if api.sc.Web["foo.test.ts.net:443"].Handlers["/c"] != nil {
+		t.Errorf("/c was saved despite the conflicts")
+	}
+}
+
+func TestServeStdinConfigNotRetried(t *testing.T) {
+	const in = `{"TCP": {"443": {"HTTPS": true}}, "Web": {"foo.test.ts.net:443": {"Handlers": {"/": {"Text": "hi"}}}}}`
+	for _, args := range []string{"apply -f -", "set-raw"} {
+		var saved *ipn.ServeConfig
+		var sets int
+		e := newSavingServeEnv(&saved)
+		e.testStdin = strings.NewReader(in)
+		e.testSetServeConfig = func(context.Context, *ipn.ServeConfig) error {
+			sets++
+			return fmt.Errorf("sending serve config: %w", tailscale.ErrServeConfigChanged)
+		}
+		// A rerun would find stdin already read, so the
+		// ErrServeConfigChanged from the first save must be the result.
+		err := newServeCommand(e).ParseAndRun(context.Background(), cmd(args))
+		if !errors.Is(err, tailscale.ErrServeConfigChanged) {
+			t.Errorf("%s: got error %v; want ErrServeConfigChanged", args, err)
+		}
+		if sets != 1 {
+			t.Errorf("%s: got %d saves; want 1", args, sets)
+		}
+	}
+}
+
+func TestServeShowConfigResolvePaths(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept.txt")
+	gone := filepath.Join(dir, "gone.txt")
+	for _, f := range []string{kept, gone} {
+		if err := os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":       {Proxy: "http://127.0.0.1:3000"},
+				"/docs":   {Path: dir, ExtraPaths: []string{filepath.Join(dir, "nope")}},
+				"/kept":   {Path: kept},
+				"/gone":   {Path: gone},
+				"/files/": {Files: map[string]string{"b.txt": gone, "a.txt": kept}},
+			}},
+		},
+	}
+	var stdout, stderr bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  &stdout,
+		testStderr:  &stderr,
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return sc, nil
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("show-config -resolve-paths")); err != nil {
+		t.Fatal(err)
+	}
+	var got ipn.ServeConfig
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("stdout isn't the JSON config: %v\n%s", err, stdout.Bytes())
+	}
+	want := "" +
+		"# foo.test.ts.net:443/docs path " + dir + " (exists)\n" +
+		"# foo.test.ts.net:443/docs path " + filepath.Join(dir, "nope") + " (MISSING)\n" +
+		"# foo.test.ts.net:443/files/a.txt path " + kept + " (exists)\n" +
+		"# foo.test.ts.net:443/files/b.txt path " + gone + " (MISSING)\n" +
+		"# foo.test.ts.net:443/gone path " + gone + " (MISSING)\n" +
+		"# foo.test.ts.net:443/kept path " + kept + " (exists)\n"
+	if !strings.HasSuffix(stderr.String(), want) {
+		t.Errorf("got stderr:\n%s\nwant it to end with:\n%s", stderr.String(), want)
+	}
+}
+
+func TestServeShowConfigNDJSON(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443:  {HTTPS: true},
+			8443: {HTTPS: true},
+			22:   {TCPForward: "127.0.0.1:22"},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/foo": {Text: "foo", BasicAuthUser: "u", BasicAuthHash: "secret"},
+			}},
+			"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/bar": {Text: "bar"},
+			}},
+		},
+	}
+	var stdout bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  &stdout,
+		testStderr:  new(bytes.Buffer),
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return sc, nil
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("show-config -ndjson")); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	var got []serveNDJSONLine
+	for i, line := range lines {
+		var l serveNDJSONLine
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("line %d doesn't parse on its own: %v\n%s", i+1, err, line)
+		}
+		got = append(got, l)
+	}
+	want := []serveNDJSONLine{
+		{HostPort: "foo.test.ts.net:443", Port: 443, Mount: "/", Handler: &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}},
+		{HostPort: "foo.test.ts.net:443", Port: 443, Mount: "/foo", Handler: &ipn.HTTPHandler{Text: "foo", BasicAuthUser: "u", BasicAuthHash: redactedSecret}},
+		{HostPort: "foo.test.ts.net:8443", Port: 8443, Mount: "/bar", Handler: &ipn.HTTPHandler{Text: "bar"}},
+		{Port: 22, TCP: &ipn.TCPPortHandler{TCPForward: "127.0.0.1:22"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines:\n%s\nwant:\n%s", asJSON(got), asJSON(want))
+	}
+}
+
+func TestServeTimeout(t *testing.T) {
+	hang := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	tests := []struct {
+		name     string
+		getSC    func(context.Context) (*ipn.ServeConfig, error)
+		status   func(context.Context) (*ipnstate.Status, error)
+		wantText string
+	}{
+		{
+			name: "get",
+			getSC: func(ctx context.Context) (*ipn.ServeConfig, error) {
+				return nil, hang(ctx)
+			},
+			status:   fakeRunningStatus,
+			wantText: "timed out after 10ms getting the serve config",
+		},
+		{
+			name: "status",
+			getSC: func(context.Context) (*ipn.ServeConfig, error) {
+				return nil, nil
+			},
+			status: func(ctx context.Context) (*ipnstate.Status, error) {
+				return nil, hang(ctx)
+			},
+			wantText: "timed out after 10ms getting this node's status",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &serveEnv{
+				testFlagOut:              new(bytes.Buffer),
+				testStdout:               new(bytes.Buffer),
+				testStderr:               new(bytes.Buffer),
+				testGetServeConfig:       tt.getSC,
+				testGetLocalClientStatus: tt.status,
+				testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+					t.Error("unexpected save")
+					return nil
+				},
 			}
-			if bad := st.wantErr(err); bad != "" {
-				t.Fatalf("step #%d, line %v: unexpected error: %v", i, st.line, bad)
+			err := newServeCommand(e).ParseAndRun(context.Background(), cmd("-timeout 10ms / text hi"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantText) {
+				t.Fatalf("got error %v; want one containing %q", err, tt.wantText)
 			}
-			continue
+			if got := ExitCode(err); got != serveExitNoDaemon {
+				t.Errorf("exit code %d; want %d", got, serveExitNoDaemon)
+			}
+		})
+	}
+
+	// The limit is per call: a slow save after a quick read times out.
+	e := &serveEnv{
+		testFlagOut:              new(bytes.Buffer),
+		testStdout:               new(bytes.Buffer),
+		testStderr:               new(bytes.Buffer),
+		testGetServeConfig:       func(context.Context) (*ipn.ServeConfig, error) { return nil, nil },
+		testGetLocalClientStatus: fakeRunningStatus,
+		testSetServeConfig: func(ctx context.Context, _ *ipn.ServeConfig) error {
+			return hang(ctx)
+		},
+	}
+	err := newServeCommand(e).ParseAndRun(context.Background(), cmd("-timeout 10ms / text hi"))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms saving the serve config") {
+		t.Fatalf("slow save: got error %v", err)
+	}
+}
+
+func TestAddWebHandler(t *testing.T) {
+	const hp = "foo.test.ts.net:443"
+	sc := new(ipn.ServeConfig)
+	if err := AddWebHandler(sc, hp, "docs/", &ipn.HTTPHandler{Path: "/srv/docs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddWebHandler(sc, hp, "/", &ipn.HTTPHandler{Proxy: "http://127.0.0.1:3000"}); err != nil {
+		t.Fatal(err)
+	}
+	// /docs replaces /docs/, as tailscaled would treat them as one.
+	if err := AddWebHandler(sc, hp, "/docs", &ipn.HTTPHandler{Text: "moved"}); err != nil {
+		t.Fatal(err)
+	}
+	// A port already serving plaintext HTTP keeps doing so.
+	sc.TCP[80] = &ipn.TCPPortHandler{HTTP: true}
+	if err := AddWebHandler(sc, "foo.test.ts.net:80", "/", &ipn.HTTPHandler{Text: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{
+			443: {HTTPS: true},
+			80:  {HTTP: true},
+		},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			hp: {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:3000"},
+				"/docs": {Text: "moved"},
+			}},
+			"foo.test.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "plain"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(sc, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", asJSON(sc), asJSON(want))
+	}
+	if err := ValidateServeConfig(sc); err != nil {
+		t.Errorf("ValidateServeConfig: %v", err)
+	}
+
+	sc.TCP[22] = &ipn.TCPPortHandler{TCPForward: "127.0.0.1:22"}
+	for _, tt := range []struct {
+		hp, mount string
+		h         *ipn.HTTPHandler
+	}{
+		{hp, "/x?y", &ipn.HTTPHandler{Text: "x"}},                // bad mount point
+		{hp, "/x/../y", &ipn.HTTPHandler{Text: "x"}},             // unclean mount point
+		{"foo.test.ts.net", "/", &ipn.HTTPHandler{}},             // no port
+		{"foo.test.ts.net:0", "/", &ipn.HTTPHandler{}},           // bad port
+		{"foo.test.ts.net:22", "/", &ipn.HTTPHandler{Text: "x"}}, // TCP forward
+		{hp, "/", nil},
+	} {
+		before := sc.Clone()
+		if err := AddWebHandler(sc, ipn.HostPort(tt.hp), tt.mount, tt.h); err == nil {
+			t.Errorf("AddWebHandler(%q, %q) succeeded; want error", tt.hp, tt.mount)
 		}
-		if st.wantErr != nil {
-			t.Fatalf("step #%d, line %v: got success (saved=%v), but wanted an error", i, st.line, newState != nil)
+		if !reflect.DeepEqual(sc, before) {
+			t.Errorf("AddWebHandler(%q, %q) changed the config on error", tt.hp, tt.mount)
 		}
-		if !reflect.DeepEqual(newState, st.want) {
-			t.Fatalf("[%d] %v: bad state. got:\n%s\n\nwant:\n%s\n",
-				i, st.command, asJSON(newState), asJSON(st.want))
+	}
+}
+
+func TestServeEdit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake editor is a shell script")
+	}
+	cur := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hi"},
+			}},
+		},
+	}
+	const edited = `{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Text":"edited"}}}}}`
+	edit := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "edited"},
+			}},
+		},
+	}
+
+	// run runs "serve edit" with an editor that, on its nth run, replaces
+	// the file with edits[n-1], or leaves it alone if there are no more.
+	run := func(t *testing.T, edits ...string) (saved *ipn.ServeConfig, runs int, stderr string, err error) {
+		dir := t.TempDir()
+		editor := filepath.Join(dir, "editor")
+		script := "#!/bin/sh\n" +
+			"n=$(cat \"$0.n\" 2>/dev/null || echo 0); n=$((n+1)); echo $n > \"$0.n\"\n" +
+			"[ -f \"$0.$n\" ] && cp \"$0.$n\" \"$1\"\n" +
+			"exit 0\n"
+		if err := os.WriteFile(editor, []byte(script), 0755); err != nil {
+			t.Fatal(err)
 		}
-		if newState != nil {
-			current = newState
+		for i, ed := range edits {
+			if err := os.WriteFile(fmt.Sprintf("%s.%d", editor, i+1), []byte(ed), 0644); err != nil {
+				t.Fatal(err)
+			}
 		}
+		t.Setenv("EDITOR", editor)
+		t.Setenv("TMPDIR", dir) // for the kept edits
+		var errBuf bytes.Buffer
+		e := newSavingServeEnv(&saved)
+		e.testStderr = &errBuf
+		e.testGetServeConfig = func(context.Context) (*ipn.ServeConfig, error) {
+			return cur, nil
+		}
+		err = newServeCommand(e).ParseAndRun(context.Background(), cmd("edit"))
+		if b, rerr := os.ReadFile(editor + ".n"); rerr == nil {
+			runs, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+		return saved, runs, errBuf.String(), err
 	}
+
+	t.Run("save", func(t *testing.T) {
+		saved, runs, _, err := run(t, edited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs != 1 || !reflect.DeepEqual(saved, edit) {
+			t.Errorf("after %d editor runs, saved %s; want %s", runs, asJSON(saved), edited)
+		}
+	})
+	t.Run("unchanged", func(t *testing.T) {
+		saved, _, stderr, err := run(t)
+		if err != nil || saved != nil {
+			t.Fatalf("got error %v, saved %v; want nothing saved", err, asJSON(saved))
+		}
+		if !strings.Contains(stderr, "no changes") {
+			t.Errorf("stderr doesn't say nothing changed:\n%s", stderr)
+		}
+	})
+	t.Run("empty", func(t *testing.T) {
+		saved, _, _, err := run(t, "\n")
+		if err != nil || saved != nil {
+			t.Fatalf("got error %v, saved %v; want nothing saved", err, asJSON(saved))
+		}
+	})
+	t.Run("reopen-after-parse-error", func(t *testing.T) {
+		saved, runs, stderr, err := run(t, `{"Web": `, edited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if runs != 2 || !reflect.DeepEqual(saved, edit) {
+			t.Errorf("after %d editor runs, saved %s; want 2 runs saving %s", runs, asJSON(saved), edited)
+		}
+		if !strings.Contains(stderr, "invalid JSON") || !strings.Contains(stderr, "Reopening the editor") {
+			t.Errorf("stderr doesn't explain the reopening:\n%s", stderr)
+		}
+	})
+	t.Run("parse-error-then-unchanged", func(t *testing.T) {
+		saved, runs, stderr, err := run(t, `{"Bogus": 1}`)
+		if err == nil || ExitCode(err) != serveExitInvalid || saved != nil {
+			t.Fatalf("got error %v (exit %d), saved %v; want invalid config error", err, ExitCode(err), asJSON(saved))
+		}
+		if runs != 2 {
+			t.Errorf("editor ran %d times; want 2", runs)
+		}
+		if !strings.Contains(stderr, "Your edits are in ") {
+			t.Errorf("stderr doesn't say where the edits are:\n%s", stderr)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		saved, runs, _, err := run(t, `{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Text":"a","Proxy":"http://127.0.0.1:3000"}}}}}`)
+		if err == nil || ExitCode(err) != serveExitInvalid || saved != nil {
+			t.Fatalf("got error %v (exit %d), saved %v; want invalid config error", err, ExitCode(err), asJSON(saved))
+		}
+		if runs != 1 {
+			t.Errorf("editor ran %d times; want 1", runs)
+		}
+	})
 }
 
-// exactError returns an error checker that wants exactly the provided want error.
-// If optName is non-empty, it's used in the error message.
-func exactErr(want error, optName ...string) func(error) string {
-	return func(got error) string {
-		if got == want {
-			return ""
+func TestExplainServePath(t *testing.T) {
+	handlers := map[string]*ipn.HTTPHandler{
+		"/":          {Text: "root"},
+		"/docs/":     {Path: "/srv/docs"},
+		"/api":       {Proxy: "http://127.0.0.1:3000"},
+		"/api/v2/":   {Proxy: "http://127.0.0.1:3002"},
+		"/both":      {Text: "no slash"},
+		"/both/":     {Text: "slash"},
+		"/exact/":    {Text: "exact"},
+		"/docs/old/": {Redirect: "/docs/"},
+	}
+	tests := []struct {
+		path      string
+		wantMount string
+		wantNotes []string
+	}{
+		{"/", "/", nil},
+		{"/docs/", "/docs/", nil},
+		{"/docs", "/docs/", []string{"/docs/ matches with a trailing slash added"}},
+		{"/docs/a/b.html", "/docs/", []string{"no mount point is /docs/a/b.html itself; /docs/ is its closest parent"}},
+		{"/docs/old", "/docs/old/", []string{"/docs/old/ matches with a trailing slash added"}},
+		{"/docs/old/x", "/docs/old/", []string{"no mount point is /docs/old/x itself; /docs/old/ is its closest parent"}},
+		{"/api/", "/api", []string{"/api matches with the trailing slash removed"}},
+		{"/api/v1/users", "/api", []string{"no mount point is /api/v1/users itself; /api is its closest parent"}},
+		{"/api/v2", "/api/v2/", []string{"/api/v2/ matches with a trailing slash added"}},
+		{"/api/v2/users", "/api/v2/", []string{"no mount point is /api/v2/users itself; /api/v2/ is its closest parent"}},
+		{"/both", "/both", nil},
+		{"/both/x", "/both/", []string{
+			"no mount point is /both/x itself; /both/ is its closest parent",
+			"/both is also a mount point, but /both/ is tried first",
+		}},
+		{"/x/../docs", "/docs/", []string{
+			"the path is cleaned to /docs before matching",
+			"/docs/ matches with a trailing slash added",
+		}},
+		{"/exact//", "/exact/", []string{"the path is cleaned to /exact before matching"}},
+		{"/other", "/", []string{"no mount point is /other itself; / is its closest parent"}},
+	}
+	for _, tt := range tests {
+		mount, notes := explainServePath(handlers, tt.path)
+		if mount != tt.wantMount || !reflect.DeepEqual(notes, tt.wantNotes) {
+			t.Errorf("explainServePath(%q) = %q, %q; want %q, %q", tt.path, mount, notes, tt.wantMount, tt.wantNotes)
 		}
-		if len(optName) > 0 {
-			return fmt.Sprintf("got error %v, want %v", got, optName[0])
+	}
+
+	delete(handlers, "/")
+	if mount, _ := explainServePath(handlers, "/other"); mount != "" {
+		t.Errorf("without /, /other is served by %q; want none", mount)
+	}
+}
+
+func TestServeExplain(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 8443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/docs/": {Path: "/srv/docs"},
+			}},
+			"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hi"},
+			}},
+		},
+	}
+	var stdout bytes.Buffer
+	e := &serveEnv{
+		testFlagOut: new(bytes.Buffer),
+		testStdout:  &stdout,
+		testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+			return sc, nil
+		},
+	}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("explain docs /x")); err != nil {
+		t.Fatal(err)
+	}
+	want := "" +
+		"foo.test.ts.net:443: /docs is served by /docs/ (path /srv/docs)\n" +
+		"  /docs/ matches with a trailing slash added\n" +
+		"foo.test.ts.net:8443: /docs is served by / (text \"hi\")\n" +
+		"  no mount point is /docs itself; / is its closest parent\n" +
+		"foo.test.ts.net:443: /x is not served (404 Not Found)\n" +
+		"foo.test.ts.net:8443: /x is served by / (text \"hi\")\n" +
+		"  no mount point is /x itself; / is its closest parent\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// zipFixture returns a zip archive of files, keyed by name.
+func zipFixture(t *testing.T, files map[string]string) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range sortedKeys(files, nil) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
 		}
-		return fmt.Sprintf("got error %v, want %v", got, want)
+		io.WriteString(w, files[name])
 	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
 }
 
-func cmd(s string) []string {
-	return strings.Fields(s)
+// tarGzFixture returns a gzipped tar archive of files, keyed by name.
+func tarGzFixture(t *testing.T, files map[string]string) string {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range sortedKeys(files, nil) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestArchiveFormat(t *testing.T) {
+	for p, want := range map[string]string{
+		"/srv/site.zip":    "zip",
+		"/srv/SITE.ZIP":    "zip",
+		"/srv/site.tar.gz": "tar.gz",
+		"/srv/site.tgz":    "tar.gz",
+		"/srv/site.tar":    "",
+		"/srv/site.gz":     "",
+		"/srv/zip":         "",
+	} {
+		if got := archiveFormat(p); got != want {
+			t.Errorf("archiveFormat(%q) = %q; want %q", p, got, want)
+		}
+	}
+}
+
+func TestServeProxyProtocolRoundTrip(t *testing.T) {
+	var saved *ipn.ServeConfig
+	e := newSavingServeEnv(&saved)
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("tcp -proxy-protocol 2 -terminate-tls=db.example.com 5432")); err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"ProxyProtocol":2`; !strings.Contains(string(j), want) {
+		t.Errorf("saved config %s doesn't contain %s", j, want)
+	}
+	got, err := decodeServeConfig(bytes.NewReader(j))
+	if err != nil {
+		t.Fatalf("decoding saved config: %v", err)
+	}
+	if !reflect.DeepEqual(got, saved) {
+		t.Errorf("round trip changed the config:\ngot  %s\nwant %s", asJSON(got), asJSON(saved))
+	}
+
+	for _, bad := range []string{
+		`{"TCP":{"443":{"TCPForward":"127.0.0.1:5432","ProxyProtocol":3}}}`,
+		`{"TCP":{"443":{"HTTPS":true,"ProxyProtocol":1}}}`,
+	} {
+		if _, err := decodeServeConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("decodeServeConfig(%s) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestServeIngressStatus(t *testing.T) {
+	const hp = "foo.test.ts.net:443"
+	served := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			hp: {Handlers: map[string]*ipn.HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}}},
+		},
+	}
+	withIngress := func(sc *ipn.ServeConfig, exp time.Time) *ipn.ServeConfig {
+		sc = sc.Clone()
+		sc.AllowIngress = map[ipn.HostPort]bool{hp: true}
+		if !exp.IsZero() {
+			sc.IngressExpiry = map[ipn.HostPort]time.Time{hp: exp}
+		}
+		return sc
+	}
+	granted := []string{tailcfg.CapabilityIngress}
+
+	tests := []struct {
+		name string
+		sc   *ipn.ServeConfig
+		caps []string
+		want []string
+	}{
+		{
+			name: "off",
+			sc:   served,
+			caps: granted,
+			want: []string{"Ingress is off for foo.test.ts.net:443."},
+		},
+		{
+			name: "no-config",
+			caps: granted,
+			want: []string{"Ingress is off for foo.test.ts.net:443."},
+		},
+		{
+			name: "active",
+			sc:   withIngress(served, time.Time{}),
+			caps: granted,
+			want: []string{"Ingress is active for foo.test.ts.net:443, at https://foo.test.ts.net/"},
+		},
+		{
+			name: "active-with-expiry",
+			sc:   withIngress(served, fakeNow.Add(time.Hour)),
+			caps: granted,
+			want: []string{"Ingress is active", "It expires at 2023-03-01T13:00:00Z."},
+		},
+		{
+			name: "no-capability",
+			sc:   withIngress(served, time.Time{}),
+			want: []string{"but not active:", "ingress capability"},
+		},
+		{
+			name: "expired",
+			sc:   withIngress(served, fakeNow.Add(-time.Hour)),
+			caps: granted,
+			want: []string{"but not active:", "it expired at 2023-03-01T11:00:00Z"},
+		},
+		{
+			name: "nothing-served",
+			sc:   withIngress(&ipn.ServeConfig{}, time.Time{}),
+			caps: granted,
+			want: []string{"but not active:", "nothing is served on foo.test.ts.net:443"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout bytes.Buffer
+			e := &serveEnv{
+				testFlagOut: new(bytes.Buffer),
+				testStdout:  &stdout,
+				testNow:     func() time.Time { return fakeNow },
+				testGetServeConfig: func(context.Context) (*ipn.ServeConfig, error) {
+					return tt.sc, nil
+				},
+				testSetServeConfig: func(context.Context, *ipn.ServeConfig) error {
+					t.Error("unexpected SetServeConfig")
+					return nil
+				},
+				testGetLocalClientStatus: func(context.Context) (*ipnstate.Status, error) {
+					return &ipnstate.Status{
+						BackendState: ipn.Running.String(),
+						Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net.", Capabilities: tt.caps},
+					}, nil
+				},
+			}
+			if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("ingress status")); err != nil {
+				t.Fatal(err)
+			}
+			got := stdout.String()
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("output %q doesn't contain %q", got, w)
+				}
+			}
+			if tt.name == "no-capability" && strings.Contains(got, "nothing is served") {
+				t.Errorf("output %q wrongly says nothing is served", got)
+			}
+		})
+	}
+
+	var stderr bytes.Buffer
+	e := &serveEnv{testFlagOut: new(bytes.Buffer), testStderr: &stderr}
+	if err := newServeCommand(e).ParseAndRun(context.Background(), cmd("ingress -expire 1h status")); err == nil {
+		t.Error("ingress -expire 1h status succeeded; want error")
+	}
+	if !strings.Contains(stderr.String(), "-expire must be") {
+		t.Errorf("stderr = %q; want the -expire usage error", stderr.String())
+	}
+}
+
+func TestRemoveWebHandler(t *testing.T) {
+	const hp = "foo.test.ts.net:443"
+	handlers := func(mounts ...string) *ipn.WebServerConfig {
+		wsc := &ipn.WebServerConfig{Handlers: map[string]*ipn.HTTPHandler{}}
+		for _, m := range mounts {
+			wsc.Handlers[m] = &ipn.HTTPHandler{Text: m}
+		}
+		return wsc
+	}
+	tests := []struct {
+		name    string
+		sc      *ipn.ServeConfig
+		mount   string
+		want    *ipn.ServeConfig
+		wantErr bool
+	}{
+		{
+			name:  "not-last",
+			sc:    &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}}, Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/", "/a")}},
+			mount: "a",
+			want:  &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}}, Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/")}},
+		},
+		{
+			name:  "web-only",
+			sc:    &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}}, Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/")}},
+			mount: "/",
+			want:  &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{}, Web: map[ipn.HostPort]*ipn.WebServerConfig{}},
+		},
+		{
+			name: "web-and-tcp",
+			sc: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}, 5432: {TCPForward: "127.0.0.1:5432"}},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/")},
+			},
+			mount: "/",
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{5432: {TCPForward: "127.0.0.1:5432"}},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{},
+			},
+		},
+		{
+			name:  "tcp-forward-on-port",
+			sc:    &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}}, Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/")}},
+			mount: "/",
+			want:  &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:5432"}}, Web: map[ipn.HostPort]*ipn.WebServerConfig{}},
+		},
+		{
+			name: "other-host-on-port",
+			sc: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/"), "bar.test.ts.net:443": handlers("/")},
+			},
+			mount: "/",
+			want: &ipn.ServeConfig{
+				TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{"bar.test.ts.net:443": handlers("/")},
+			},
+		},
+		{
+			name:    "missing",
+			sc:      &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}}, Web: map[ipn.HostPort]*ipn.WebServerConfig{hp: handlers("/")}},
+			mount:   "/a",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RemoveWebHandler(tt.sc, hp, tt.mount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got success, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.sc, tt.want) {
+				t.Errorf("got:\n%s\nwant:\n%s", asJSON(tt.sc), asJSON(tt.want))
+			}
+		})
+	}
+}
+
+// caFixture returns a PEM-encoded self-signed CA certificate.
+func caFixture(t *testing.T) string {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestServeClientCertRoundTrip(t *testing.T) {
+	caPEM := caFixture(t)
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {
+				Handlers:          map[string]*ipn.HTTPHandler{"/": {Text: "hi"}},
+				RequireClientCert: true,
+				ClientCAs:         caPEM,
+			},
+		},
+	}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeServeConfig(bytes.NewReader(j))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", j, err)
+	}
+	if !reflect.DeepEqual(got, sc) {
+		t.Errorf("round trip changed the config:\ngot  %s\nwant %s", asJSON(got), asJSON(sc))
+	}
+	if v := sc.View().Web().Get("foo.test.ts.net:443"); !v.RequireClientCert() || v.ClientCAs() != caPEM {
+		t.Errorf("view lost the client certificate fields")
+	}
+	if c := sc.Clone().Web["foo.test.ts.net:443"]; !c.RequireClientCert || c.ClientCAs != caPEM {
+		t.Errorf("clone lost the client certificate fields")
+	}
+
+	for _, bad := range []string{
+		`{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Text":"hi"}},"ClientCAs":` + strconv.Quote(caPEM) + `}}}`,
+		`{"TCP":{"443":{"HTTPS":true}},"Web":{"foo.test.ts.net:443":{"Handlers":{"/":{"Text":"hi"}},"RequireClientCert":true,"ClientCAs":"junk"}}}`,
+		`{"TCP":{"80":{"HTTP":true}},"Web":{"foo.test.ts.net:80":{"Handlers":{"/":{"Text":"hi"}},"RequireClientCert":true}}}`,
+	} {
+		if _, err := decodeServeConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("decodeServeConfig(%s) succeeded; want error", bad)
+		}
+	}
 }
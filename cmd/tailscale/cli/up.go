@@ -81,12 +81,14 @@ func acceptRouteDefault(goos string) bool {
 	}
 }
 
-var upFlagSet = newUpFlagSet(effectiveGOOS(), &upArgs)
+var upFlagSet = newUpFlagSet(effectiveGOOS(), &upArgs, "up")
 
 func inTest() bool { return flag.Lookup("test.v") != nil }
 
-func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
-	upf := newFlagSet("up")
+// newUpFlagSet returns the flags shared by "up" and "login", for the
+// command named cmd.
+func newUpFlagSet(goos string, upArgs *upArgsT, cmd string) *flag.FlagSet {
+	upf := newFlagSet(cmd)
 
 	upf.BoolVar(&upArgs.qr, "qr", false, "show QR code for login URLs")
 	upf.BoolVar(&upArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
@@ -936,7 +938,7 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 		return env.curExitNodeIP.String()
 	}
 
-	fs := newUpFlagSet(env.goos, new(upArgsT) /* dummy */)
+	fs := newUpFlagSet(env.goos, new(upArgsT) /* dummy */, "up")
 	fs.VisitAll(func(f *flag.Flag) {
 		if preflessFlag(f.Name) {
 			return
@@ -7,6 +7,8 @@
 package main // import "tailscale.com/cmd/tailscale"
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -21,7 +23,9 @@ func main() {
 		args = []string{"web", "-cgi"}
 	}
 	if err := cli.Run(args); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		if !errors.Is(err, flag.ErrHelp) { // else usage was already printed
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(cli.ExitCode(err))
 	}
 }
@@ -8,6 +8,7 @@
 
 import (
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -70,6 +71,12 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			dst.TCP[k] = v.Clone()
 		}
 	}
+	if dst.UDP != nil {
+		dst.UDP = map[uint16]*UDPPortHandler{}
+		for k, v := range src.UDP {
+			dst.UDP[k] = v.Clone()
+		}
+	}
 	if dst.Web != nil {
 		dst.Web = map[HostPort]*WebServerConfig{}
 		for k, v := range src.Web {
@@ -82,14 +89,24 @@ func (src *ServeConfig) Clone() *ServeConfig {
 			dst.AllowIngress[k] = v
 		}
 	}
+	if dst.IngressExpiry != nil {
+		dst.IngressExpiry = map[HostPort]time.Time{}
+		for k, v := range src.IngressExpiry {
+			dst.IngressExpiry[k] = v
+		}
+	}
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigCloneNeedsRegeneration = ServeConfig(struct {
-	TCP          map[uint16]*TCPPortHandler
-	Web          map[HostPort]*WebServerConfig
-	AllowIngress map[HostPort]bool
+	TCP              map[uint16]*TCPPortHandler
+	UDP              map[uint16]*UDPPortHandler
+	Web              map[HostPort]*WebServerConfig
+	AllowIngress     map[HostPort]bool
+	IngressExpiry    map[HostPort]time.Time
+	EncryptedSecrets bool
+	Version          int
 }{})
 
 // Clone makes a deep copy of TCPPortHandler.
@@ -105,9 +122,28 @@ func (src *TCPPortHandler) Clone() *TCPPortHandler {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerCloneNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS         bool
+	HTTP          bool
+	TCPForward    string
+	TerminateTLS  string
+	ProxyProtocol int
+	Comment       string
+}{})
+
+// Clone makes a deep copy of UDPPortHandler.
+// The result aliases no memory with the original.
+func (src *UDPPortHandler) Clone() *UDPPortHandler {
+	if src == nil {
+		return nil
+	}
+	dst := new(UDPPortHandler)
+	*dst = *src
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerCloneNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward string
 }{})
 
 // Clone makes a deep copy of HTTPHandler.
@@ -118,14 +154,57 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	dst.ExtraProxies = append(src.ExtraProxies[:0:0], src.ExtraProxies...)
+	if dst.BodyReplace != nil {
+		dst.BodyReplace = map[string]string{}
+		for k, v := range src.BodyReplace {
+			dst.BodyReplace[k] = v
+		}
+	}
+	dst.ExtraPaths = append(src.ExtraPaths[:0:0], src.ExtraPaths...)
+	if dst.CacheMaxAge != nil {
+		dst.CacheMaxAge = new(int)
+		*dst.CacheMaxAge = *src.CacheMaxAge
+	}
+	if dst.Files != nil {
+		dst.Files = map[string]string{}
+		for k, v := range src.Files {
+			dst.Files[k] = v
+		}
+	}
+	if dst.FollowRedirects != nil {
+		dst.FollowRedirects = new(bool)
+		*dst.FollowRedirects = *src.FollowRedirects
+	}
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	Files                 map[string]string
+	StatusCode            int
+	BasicAuthUser         string
+	BasicAuthHash         string
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+	MaintenanceWindow     string
+	RateLimit             string
+	ExtraProxies          []string
+	ExtraPaths            []string
+	Archive               string
+	StickySessions        string
+	BodyReplace           map[string]string
+	DecodeUpstream        bool
+	FollowRedirects       *bool
+	Compress              bool
+	MaxRequestBytes       int64
+	CacheMaxAge           *int
+	SPAFallback           bool
+	Comment               string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -147,5 +226,7 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _WebServerConfigCloneNeedsRegeneration = WebServerConfig(struct {
-	Handlers map[string]*HTTPHandler
+	Handlers          map[string]*HTTPHandler
+	RequireClientCert bool
+	ClientCAs         string
 }{})
@@ -10,6 +10,7 @@
 	"encoding/json"
 	"errors"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -17,7 +18,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,UDPPortHandler,HTTPHandler,WebServerConfig
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -170,6 +171,12 @@ func (v ServeConfigView) TCP() views.MapFn[uint16, *TCPPortHandler, TCPPortHandl
 	})
 }
 
+func (v ServeConfigView) UDP() views.MapFn[uint16, *UDPPortHandler, UDPPortHandlerView] {
+	return views.MapFnOf(v.ж.UDP, func(t *UDPPortHandler) UDPPortHandlerView {
+		return t.View()
+	})
+}
+
 func (v ServeConfigView) Web() views.MapFn[HostPort, *WebServerConfig, WebServerConfigView] {
 	return views.MapFnOf(v.ж.Web, func(t *WebServerConfig) WebServerConfigView {
 		return t.View()
@@ -180,11 +187,22 @@ func (v ServeConfigView) AllowIngress() views.Map[HostPort, bool] {
 	return views.MapOf(v.ж.AllowIngress)
 }
 
+func (v ServeConfigView) IngressExpiry() views.Map[HostPort, time.Time] {
+	return views.MapOf(v.ж.IngressExpiry)
+}
+
+func (v ServeConfigView) EncryptedSecrets() bool { return v.ж.EncryptedSecrets }
+func (v ServeConfigView) Version() int           { return v.ж.Version }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
-	TCP          map[uint16]*TCPPortHandler
-	Web          map[HostPort]*WebServerConfig
-	AllowIngress map[HostPort]bool
+	TCP              map[uint16]*TCPPortHandler
+	UDP              map[uint16]*UDPPortHandler
+	Web              map[HostPort]*WebServerConfig
+	AllowIngress     map[HostPort]bool
+	IngressExpiry    map[HostPort]time.Time
+	EncryptedSecrets bool
+	Version          int
 }{})
 
 // View returns a readonly view of TCPPortHandler.
@@ -233,14 +251,72 @@ func (v *TCPPortHandlerView) UnmarshalJSON(b []byte) error {
 }
 
 func (v TCPPortHandlerView) HTTPS() bool          { return v.ж.HTTPS }
+func (v TCPPortHandlerView) HTTP() bool           { return v.ж.HTTP }
 func (v TCPPortHandlerView) TCPForward() string   { return v.ж.TCPForward }
 func (v TCPPortHandlerView) TerminateTLS() string { return v.ж.TerminateTLS }
+func (v TCPPortHandlerView) ProxyProtocol() int   { return v.ж.ProxyProtocol }
+func (v TCPPortHandlerView) Comment() string      { return v.ж.Comment }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _TCPPortHandlerViewNeedsRegeneration = TCPPortHandler(struct {
-	HTTPS        bool
-	TCPForward   string
-	TerminateTLS string
+	HTTPS         bool
+	HTTP          bool
+	TCPForward    string
+	TerminateTLS  string
+	ProxyProtocol int
+	Comment       string
+}{})
+
+// View returns a readonly view of UDPPortHandler.
+func (p *UDPPortHandler) View() UDPPortHandlerView {
+	return UDPPortHandlerView{ж: p}
+}
+
+// UDPPortHandlerView provides a read-only view over UDPPortHandler.
+//
+// Its methods should only be called if `Valid()` returns true.
+type UDPPortHandlerView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *UDPPortHandler
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v UDPPortHandlerView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v UDPPortHandlerView) AsStruct() *UDPPortHandler {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v UDPPortHandlerView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *UDPPortHandlerView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x UDPPortHandler
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v UDPPortHandlerView) UDPForward() string { return v.ж.UDPForward }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _UDPPortHandlerViewNeedsRegeneration = UDPPortHandler(struct {
+	UDPForward string
 }{})
 
 // View returns a readonly view of HTTPHandler.
@@ -288,15 +364,79 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string     { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string    { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string     { return v.ж.Text }
+func (v HTTPHandlerView) Redirect() string { return v.ж.Redirect }
+func (v HTTPHandlerView) Files() views.Map[string, string] {
+	return views.MapOf(v.ж.Files)
+}
+func (v HTTPHandlerView) StatusCode() int                   { return v.ж.StatusCode }
+func (v HTTPHandlerView) BasicAuthUser() string             { return v.ж.BasicAuthUser }
+func (v HTTPHandlerView) BasicAuthHash() string             { return v.ж.BasicAuthHash }
+func (v HTTPHandlerView) HSTSMaxAge() int                   { return v.ж.HSTSMaxAge }
+func (v HTTPHandlerView) HSTSIncludeSubdomains() bool       { return v.ж.HSTSIncludeSubdomains }
+func (v HTTPHandlerView) MaintenanceWindow() string         { return v.ж.MaintenanceWindow }
+func (v HTTPHandlerView) RateLimit() string                 { return v.ж.RateLimit }
+func (v HTTPHandlerView) ExtraProxies() views.Slice[string] { return views.SliceOf(v.ж.ExtraProxies) }
+func (v HTTPHandlerView) ExtraPaths() views.Slice[string]   { return views.SliceOf(v.ж.ExtraPaths) }
+func (v HTTPHandlerView) Archive() string                   { return v.ж.Archive }
+func (v HTTPHandlerView) StickySessions() string            { return v.ж.StickySessions }
+
+func (v HTTPHandlerView) BodyReplace() views.Map[string, string] {
+	return views.MapOf(v.ж.BodyReplace)
+}
+
+func (v HTTPHandlerView) DecodeUpstream() bool { return v.ж.DecodeUpstream }
+
+func (v HTTPHandlerView) FollowRedirects() *bool {
+	if v.ж.FollowRedirects == nil {
+		return nil
+	}
+	x := *v.ж.FollowRedirects
+	return &x
+}
+
+func (v HTTPHandlerView) Compress() bool         { return v.ж.Compress }
+func (v HTTPHandlerView) MaxRequestBytes() int64 { return v.ж.MaxRequestBytes }
+
+func (v HTTPHandlerView) CacheMaxAge() *int {
+	if v.ж.CacheMaxAge == nil {
+		return nil
+	}
+	x := *v.ж.CacheMaxAge
+	return &x
+}
+
+func (v HTTPHandlerView) SPAFallback() bool { return v.ж.SPAFallback }
+func (v HTTPHandlerView) Comment() string   { return v.ж.Comment }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                  string
+	Proxy                 string
+	Text                  string
+	Redirect              string
+	Files                 map[string]string
+	StatusCode            int
+	BasicAuthUser         string
+	BasicAuthHash         string
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+	MaintenanceWindow     string
+	RateLimit             string
+	ExtraProxies          []string
+	ExtraPaths            []string
+	Archive               string
+	StickySessions        string
+	BodyReplace           map[string]string
+	DecodeUpstream        bool
+	FollowRedirects       *bool
+	Compress              bool
+	MaxRequestBytes       int64
+	CacheMaxAge           *int
+	SPAFallback           bool
+	Comment               string
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -350,7 +490,12 @@ func (v WebServerConfigView) Handlers() views.MapFn[string, *HTTPHandler, HTTPHa
 	})
 }
 
+func (v WebServerConfigView) RequireClientCert() bool { return v.ж.RequireClientCert }
+func (v WebServerConfigView) ClientCAs() string       { return v.ж.ClientCAs }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _WebServerConfigViewNeedsRegeneration = WebServerConfig(struct {
-	Handlers map[string]*HTTPHandler
+	Handlers          map[string]*HTTPHandler
+	RequireClientCert bool
+	ClientCAs         string
 }{})
@@ -4075,6 +4075,13 @@ func (b *LocalBackend) DeleteProfile(p ipn.ProfileID) error {
 	return b.resetForProfileChangeLockedOnEntry()
 }
 
+// RenameProfile sets the name of the profile with the given ID.
+func (b *LocalBackend) RenameProfile(p ipn.ProfileID, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pm.RenameProfile(p, name)
+}
+
 // CurrentProfile returns the current LoginProfile.
 // The value may be zero if the profile is not persisted.
 func (b *LocalBackend) CurrentProfile() ipn.LoginProfile {
@@ -576,6 +576,9 @@ func (h *peerAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case "/v0/ingress":
 		h.handleServeIngress(w, r)
 		return
+	case "/v0/serve-config":
+		h.handleServeServeConfig(w, r)
+		return
 	}
 	who := h.peerUser.DisplayName
 	fmt.Fprintf(w, `<html>
@@ -647,6 +650,28 @@ func (h *peerAPIHandler) handleServeIngress(w http.ResponseWriter, r *http.Reque
 	h.ps.b.HandleIngressTCPConn(h.peerNode, ipn.HostPort(target), srcAddr, getConn, sendRST)
 }
 
+// handleServeServeConfig returns this node's serve config, without its
+// secrets, for "tailscale serve clone-from" on another node owned by the
+// same user.
+func (h *peerAPIHandler) handleServeServeConfig(w http.ResponseWriter, r *http.Request) {
+	if !h.isSelf {
+		http.Error(w, "denied; not owned by the same user", http.StatusForbidden)
+		return
+	}
+	// Tagged nodes all share one user, so isSelf says nothing about
+	// whether they trust each other.
+	if len(h.peerNode.Tags) > 0 || (h.ps.selfNode != nil && len(h.ps.selfNode.Tags) > 0) {
+		http.Error(w, "denied; tagged nodes don't share serve configs", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(withoutServeSecrets(h.ps.b.ServeConfig()))
+}
+
 func (h *peerAPIHandler) handleServeInterfaces(w http.ResponseWriter, r *http.Request) {
 	if !h.canDebug() {
 		http.Error(w, "denied; no debug access", http.StatusForbidden)
@@ -6,6 +6,7 @@
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
@@ -630,3 +631,61 @@ func TestPeerAPIReplyToDNSQueries(t *testing.T) {
 		t.Errorf("unexpectedly IPv6 deny; wanted to be a DNS server")
 	}
 }
+
+func TestHandleServeServeConfig(t *testing.T) {
+	sc := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:3000", BasicAuthUser: "admin", BasicAuthHash: "$2a$10$secrethash"},
+			}},
+		},
+	}
+	tests := []struct {
+		name       string
+		isSelf     bool
+		selfTags   []string
+		peerTags   []string
+		wantStatus int
+	}{
+		{name: "same-user", isSelf: true, wantStatus: 200},
+		{name: "other-user", wantStatus: 403},
+		{name: "tagged-peer", isSelf: true, peerTags: []string{"tag:server"}, wantStatus: 403},
+		{name: "tagged-self", isSelf: true, selfTags: []string{"tag:server"}, wantStatus: 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logBuf tstest.MemLogger
+			ph := &peerAPIHandler{
+				isSelf:   tt.isSelf,
+				peerNode: &tailcfg.Node{ComputedName: "some-peer-name", Tags: tt.peerTags},
+				ps: &peerAPIServer{
+					b:        &LocalBackend{logf: logBuf.Logf, serveConfig: sc.View()},
+					selfNode: &tailcfg.Node{Tags: tt.selfTags},
+				},
+			}
+			rr := httptest.NewRecorder()
+			ph.ServeHTTP(rr, httptest.NewRequest("GET", "/v0/serve-config", nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+			var got *ipn.ServeConfig
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			h := got.Web["foo.test.ts.net:443"].Handlers["/"]
+			if h.BasicAuthHash != "" {
+				t.Errorf("BasicAuthHash %q sent to peer", h.BasicAuthHash)
+			}
+			if h.BasicAuthUser != "admin" {
+				t.Errorf("BasicAuthUser = %q; want admin", h.BasicAuthUser)
+			}
+			if sc.Web["foo.test.ts.net:443"].Handlers["/"].BasicAuthHash == "" {
+				t.Error("local serve config was mutated")
+			}
+		})
+	}
+}
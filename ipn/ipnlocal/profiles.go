@@ -287,6 +287,24 @@ func (pm *profileManager) DeleteProfile(id ipn.ProfileID) error {
 	return pm.writeKnownProfiles()
 }
 
+// RenameProfile sets the name of the profile with the given id. It
+// returns errProfileNotFound if the profile does not exist, and an error
+// if the name is empty or another profile already has it.
+func (pm *profileManager) RenameProfile(id ipn.ProfileID, name string) error {
+	kp, ok := pm.knownProfiles[id]
+	if !ok {
+		return errProfileNotFound
+	}
+	if name == "" {
+		return errors.New("profile name must not be empty")
+	}
+	if p := pm.findProfileByName(name); p != nil && p.ID != id {
+		return fmt.Errorf("a profile named %q already exists", name)
+	}
+	kp.Name = name
+	return pm.writeKnownProfiles()
+}
+
 func (pm *profileManager) writeKnownProfiles() error {
 	b, err := json.Marshal(pm.knownProfiles)
 	if err != nil {
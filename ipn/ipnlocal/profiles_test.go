@@ -121,6 +121,56 @@ func TestProfileManagement(t *testing.T) {
 
 // TestProfileManagementWindows tests going into and out of Unattended mode on
 // Windows.
+func TestRenameProfile(t *testing.T) {
+	store := new(mem.Store)
+	pm, err := newProfileManagerWithGOOS(store, logger.Discard, "", "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(loginName string) ipn.ProfileID {
+		t.Helper()
+		pm.NewProfile()
+		p := pm.CurrentPrefs().AsStruct()
+		p.Persist = &persist.Persist{
+			LoginName: loginName,
+		}
+		if err := pm.SetPrefs(p.View()); err != nil {
+			t.Fatal(err)
+		}
+		return pm.CurrentProfile().ID
+	}
+	work := login("user@work.example.com")
+	login("user@home.example.com")
+
+	if err := pm.RenameProfile(work, "work"); err != nil {
+		t.Fatal(err)
+	}
+	if p := pm.findProfileByName("work"); p == nil || p.ID != work {
+		t.Fatalf("findProfileByName(work) = %v; want profile %q", p, work)
+	}
+	if err := pm.RenameProfile(work, "work"); err != nil {
+		t.Errorf("renaming to own name: %v", err)
+	}
+	if err := pm.RenameProfile(work, "user@home.example.com"); err == nil {
+		t.Error("renaming to an existing profile's name succeeded")
+	}
+	if err := pm.RenameProfile(work, ""); err == nil {
+		t.Error("renaming to an empty name succeeded")
+	}
+	if err := pm.RenameProfile("nope", "x"); err != errProfileNotFound {
+		t.Errorf("renaming unknown profile: got %v; want %v", err, errProfileNotFound)
+	}
+
+	// The new name must survive a restart.
+	pm, err = newProfileManagerWithGOOS(store, logger.Discard, "", "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := pm.findProfileByName("work"); p == nil || p.ID != work {
+		t.Fatalf("after reload, findProfileByName(work) = %v; want profile %q", p, work)
+	}
+}
+
 func TestProfileManagementWindows(t *testing.T) {
 	store := new(mem.Store)
 
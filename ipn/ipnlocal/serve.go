@@ -5,11 +5,21 @@
 package ipnlocal
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"net"
 	"net/http"
@@ -19,11 +29,13 @@
 	"os"
 	"path"
 	pathpkg "path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/exp/slices"
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
@@ -31,10 +43,27 @@
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
 	"tailscale.com/util/mak"
 	"tailscale.com/util/strs"
 )
 
+// ErrServeConfigChanged is returned by SetServeConfig when the current
+// serve config no longer has the ETag the caller expected.
+var ErrServeConfigChanged = errors.New("serve config changed since it was read")
+
+// ServeConfigETag returns the ETag of the serve config v, as sent to
+// LocalAPI clients so they can later ask SetServeConfig to only replace
+// that version of the config.
+func ServeConfigETag(v ipn.ServeConfigView) (string, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("encoding serve config: %w", err)
+	}
+	sum := sha256.Sum256(j)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
 // serveHTTPContextKey is the context.Value key for a *serveHTTPContext.
 type serveHTTPContextKey struct{}
 
@@ -184,10 +213,24 @@ func (b *LocalBackend) updateServeTCPPortNetMapAddrListenersLocked(ports []uint1
 }
 
 // SetServeConfig establishes or replaces the current serve config.
-func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig) error {
+//
+// If etag is non-empty, the config is only replaced if the current one
+// has that ETag (see ServeConfigETag); otherwise ErrServeConfigChanged is
+// returned.
+func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig, etag string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if etag != "" {
+		cur, err := ServeConfigETag(b.serveConfig)
+		if err != nil {
+			return err
+		}
+		if cur != etag {
+			return ErrServeConfigChanged
+		}
+	}
+
 	nm := b.netMap
 	if nm == nil {
 		return errors.New("netMap is nil")
@@ -223,6 +266,78 @@ func (b *LocalBackend) ServeConfig() ipn.ServeConfigView {
 	return b.serveConfig
 }
 
+// PeerServeConfig fetches the serve config of the peer whose MagicDNS
+// name is name, over the peer's PeerAPI. Peers only share their config
+// with untagged nodes owned by the same user, and leave out its secrets
+// (see withoutServeSecrets). It returns (nil, nil) if the peer has no
+// serve config.
+func (b *LocalBackend) PeerServeConfig(ctx context.Context, name string) (*ipn.ServeConfig, error) {
+	b.mu.Lock()
+	nm := b.netMap
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, errors.New("not connected to the tailnet")
+	}
+	name = strings.TrimSuffix(name, ".")
+	var peer *tailcfg.Node
+	for _, p := range nm.Peers {
+		if strings.TrimSuffix(p.Name, ".") == name {
+			peer = p
+			break
+		}
+	}
+	if peer == nil {
+		return nil, fmt.Errorf("no peer named %q", name)
+	}
+	base := peerAPIBase(nm, peer)
+	if base == "" {
+		return nil, fmt.Errorf("peer %q has no PeerAPI", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/v0/serve-config", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := (&http.Client{Transport: b.Dialer().PeerAPITransport()}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer %q: %s: %s", name, res.Status, strings.TrimSpace(string(body)))
+	}
+	var sc *ipn.ServeConfig // JSON null if the peer has no config
+	if err := json.Unmarshal(body, &sc); err != nil {
+		return nil, fmt.Errorf("peer %q: %w", name, err)
+	}
+	return sc, nil
+}
+
+// withoutServeSecrets returns a copy of sc with the secret fields of its
+// handlers cleared, for sharing with peers. It clears the fields that the
+// CLI's redactServeConfig redacts; a handler's BasicAuthUser stays, so the
+// receiver can tell that it needs a new password.
+func withoutServeSecrets(sc ipn.ServeConfigView) *ipn.ServeConfig {
+	if !sc.Valid() {
+		return nil
+	}
+	c := sc.AsStruct()
+	for _, wsc := range c.Web {
+		if wsc == nil {
+			continue
+		}
+		for _, h := range wsc.Handlers {
+			if h != nil {
+				h.BasicAuthHash = ""
+			}
+		}
+	}
+	return c
+}
+
 func (b *LocalBackend) HandleIngressTCPConn(ingressPeer *tailcfg.Node, target ipn.HostPort, srcAddr netip.AddrPort, getConn func() (net.Conn, bool), sendRST func()) {
 	b.mu.Lock()
 	sc := b.serveConfig
@@ -239,6 +354,11 @@ func (b *LocalBackend) HandleIngressTCPConn(ingressPeer *tailcfg.Node, target ip
 		sendRST()
 		return
 	}
+	if exp, ok := sc.IngressExpiry().GetOk(target); ok && !time.Now().Before(exp) {
+		b.logf("localbackend: got ingress conn for %q, whose ingress expired at %v; rejecting", target, exp)
+		sendRST()
+		return
+	}
 
 	_, port, err := net.SplitHostPort(string(target))
 	if err != nil {
@@ -275,16 +395,13 @@ func (b *LocalBackend) HandleInterceptedTCPConn(dport uint16, srcAddr netip.Addr
 		return
 	}
 
-	if tcph.HTTPS() {
+	if tcph.HTTPS() || tcph.HTTP() {
 		conn, ok := getConn()
 		if !ok {
 			b.logf("localbackend: getConn didn't complete from %v to port %v", srcAddr, dport)
 			return
 		}
 		hs := &http.Server{
-			TLSConfig: &tls.Config{
-				GetCertificate: b.getTLSServeCertForPort(dport),
-			},
 			Handler: http.HandlerFunc(b.serveWebHandler),
 			BaseContext: func(_ net.Listener) context.Context {
 				return context.WithValue(context.Background(), serveHTTPContextKey{}, &serveHTTPContext{
@@ -293,6 +410,18 @@ func (b *LocalBackend) HandleInterceptedTCPConn(dport uint16, srcAddr netip.Addr
 				})
 			},
 		}
+		if tcph.HTTP() {
+			hs.Serve(netutil.NewOneConnListener(conn, nil))
+			return
+		}
+		hs.TLSConfig = &tls.Config{
+			GetCertificate: b.getTLSServeCertForPort(dport),
+			// Set here, rather than left for ServeTLS to add to its own
+			// copy, so that client-auth configs derived from this one
+			// keep offering HTTP/2.
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		hs.TLSConfig.GetConfigForClient = b.getTLSServeClientAuthForPort(dport, hs.TLSConfig)
 		hs.ServeTLS(netutil.NewOneConnListener(conn, nil), "", "")
 		return
 	}
@@ -315,6 +444,14 @@ func (b *LocalBackend) HandleInterceptedTCPConn(dport uint16, srcAddr netip.Addr
 		defer conn.Close()
 		defer backConn.Close()
 
+		if v := tcph.ProxyProtocol(); v != 0 {
+			dst, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+			if _, err := backConn.Write(proxyProtocolHeader(v, srcAddr, dst)); err != nil {
+				b.logf("localbackend: failed to send PROXY header to %s for port %v (from %v): %v", backDst, dport, srcAddr, err)
+				return
+			}
+		}
+
 		if sni := tcph.TerminateTLS(); sni != "" {
 			conn = tls.Server(conn, &tls.Config{
 				GetCertificate: func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
@@ -353,19 +490,64 @@ func (b *LocalBackend) HandleInterceptedTCPConn(dport uint16, srcAddr netip.Addr
 	sendRST()
 }
 
-func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
-	var z ipn.HTTPHandlerView // zero value
+// proxyProtocolSig starts each PROXY protocol v2 header.
+const proxyProtocolSig = "\r\n\r\n\x00\r\nQUIT\n"
 
-	if r.TLS == nil {
-		return z, "", false
+// proxyProtocolHeader returns the PROXY protocol header of the given
+// version (1 or 2) for a TCP connection from src to dst. If the addresses
+// aren't both valid and of the same family, the header says the
+// connection's addresses are unknown.
+func proxyProtocolHeader(version int, src, dst netip.AddrPort) []byte {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	known := src.IsValid() && dst.IsValid() && srcIP.Is4() == dstIP.Is4()
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP4"
+		if srcIP.Is6() {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port(), dst.Port()))
 	}
+	hdr := []byte(proxyProtocolSig)
+	hdr = append(hdr, 0x21) // version 2, PROXY command
+	if !known {
+		return append(hdr, 0x00, 0, 0) // AF_UNSPEC, no addresses
+	}
+	var addrs []byte
+	if srcIP.Is4() {
+		hdr = append(hdr, 0x11) // TCP over IPv4
+		s, d := srcIP.As4(), dstIP.As4()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	} else {
+		hdr = append(hdr, 0x21) // TCP over IPv6
+		s, d := srcIP.As16(), dstIP.As16()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView, at string, ok bool) {
+	var z ipn.HTTPHandlerView // zero value
 
 	sctx, ok := r.Context().Value(serveHTTPContextKey{}).(*serveHTTPContext)
 	if !ok {
 		b.logf("[unexpected] localbackend: no serveHTTPContext in request")
 		return z, "", false
 	}
-	wsc, ok := b.webServerConfig(r.TLS.ServerName, sctx.DestPort)
+	// HTTPS ports only serve TLS, so a request without TLS came in on a
+	// plaintext HTTP port and is matched by its Host header instead.
+	serverName := r.Host
+	if r.TLS != nil {
+		serverName = r.TLS.ServerName
+	} else if host, _, err := net.SplitHostPort(serverName); err == nil {
+		serverName = host
+	}
+	wsc, ok := b.webServerConfig(serverName, sctx.DestPort)
 	if !ok {
 		return z, "", false
 	}
@@ -395,31 +577,87 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if r.TLS != nil {
+		setHSTS(w.Header(), h)
+	}
+	if !checkBasicAuth(w, r, h) {
+		return
+	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		io.WriteString(w, s)
 		return
 	}
+	if target := h.Redirect(); target != "" {
+		code := h.StatusCode()
+		if code == 0 {
+			code = http.StatusFound
+		}
+		http.Redirect(w, r, target, code)
+		return
+	}
 	if v := h.Path(); v != "" {
+		if age := h.CacheMaxAge(); age != nil {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(*age))
+		}
+		if format := h.Archive(); format != "" {
+			serveArchive(w, r, v, format, mountPoint)
+			return
+		}
+		if extra := h.ExtraPaths(); extra.Len() > 0 {
+			v = overlayDir(extra.AppendTo([]string{v}), r.URL.Path, mountPoint)
+		}
+		if h.SPAFallback() {
+			if index, ok := spaIndex(v, r.URL.Path, mountPoint); ok {
+				http.ServeFile(w, r, index)
+				return
+			}
+		}
 		b.serveFileOrDirectory(w, r, v, mountPoint)
 		return
 	}
+	if files := h.Files(); files.Len() > 0 {
+		if age := h.CacheMaxAge(); age != nil {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(*age))
+		}
+		serveNamedFiles(w, r, files, mountPoint)
+		return
+	}
 	if v := h.Proxy(); v != "" {
 		// TODO(bradfitz): this is a lot of setup per HTTP request. We should
 		// build the whole http.Handler with all the muxing and child handlers
 		// only on start/config change. But this works for now (2022-11-09).
 		targetURL, insecure := expandProxyArg(v)
+		h2c := strings.HasPrefix(v, "h2c://")
+		if h2c && newH2CTransport == nil {
+			http.Error(w, "h2c proxies are not supported on this platform", http.StatusBadGateway)
+			return
+		}
 		u, err := url.Parse(targetURL)
 		if err != nil {
 			http.Error(w, "bad proxy config", http.StatusInternalServerError)
 			return
 		}
+		if n := h.MaxRequestBytes(); n > 0 {
+			if r.ContentLength > n {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+		}
 		rp := httputil.NewSingleHostReverseProxy(u)
-		rp.Transport = &http.Transport{
-			DialContext: b.dialer.SystemDial,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: insecure,
-			},
+		if h2c {
+			rp.Transport = newH2CTransport(b.dialer.SystemDial)
+		} else {
+			rp.Transport = &http.Transport{
+				DialContext: b.dialer.SystemDial,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: insecure,
+				},
+			}
+		}
+		if follow := h.FollowRedirects(); follow != nil && *follow {
+			rp.Transport = followRedirectsTransport{rp.Transport}
 		}
 		rp.ServeHTTP(w, r)
 		return
@@ -428,6 +666,113 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "empty handler", 500)
 }
 
+// maxProxyRedirects is the most redirects that followRedirectsTransport
+// follows for one request.
+const maxProxyRedirects = 10
+
+// followRedirectsTransport is an http.RoundTripper that follows redirects
+// for GET and HEAD requests, as long as they stay on the same backend, for
+// handlers with FollowRedirects set. Other redirects are returned as is.
+type followRedirectsTransport struct {
+	rt http.RoundTripper
+}
+
+func (t followRedirectsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		res, err := t.rt.RoundTrip(req)
+		if err != nil || i == maxProxyRedirects || req.Method != "GET" && req.Method != "HEAD" {
+			return res, err
+		}
+		switch res.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return res, nil
+		}
+		loc, err := req.URL.Parse(res.Header.Get("Location"))
+		if err != nil || res.Header.Get("Location") == "" || loc.Scheme != req.URL.Scheme || loc.Host != req.URL.Host {
+			return res, nil
+		}
+		res.Body.Close()
+		req = req.Clone(req.Context())
+		req.URL = loc
+	}
+}
+
+// overlayDir returns the first of dirs that has the file or directory
+// that urlPath names under mountPoint, or dirs[0] if none of them do.
+func overlayDir(dirs []string, urlPath, mountPoint string) string {
+	rel := pathpkg.Clean("/" + strings.TrimPrefix(urlPath, strings.TrimSuffix(mountPoint, "/")))
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err == nil {
+			return dir
+		}
+	}
+	return dirs[0]
+}
+
+// spaIndex returns dir's index.html if the file that urlPath names under
+// mountPoint doesn't exist, for a single-page app to route in the browser.
+// It returns false if the file exists or dir has no index.html.
+func spaIndex(dir, urlPath, mountPoint string) (string, bool) {
+	rel := pathpkg.Clean("/" + strings.TrimPrefix(urlPath, strings.TrimSuffix(mountPoint, "/")))
+	if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+		return "", false
+	}
+	index := filepath.Join(dir, "index.html")
+	if fi, err := os.Stat(index); err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return index, true
+}
+
+// serveNamedFiles serves files, a map of file name to file path, as a
+// virtual directory at mountPoint. The mount point itself lists the names.
+func serveNamedFiles(w http.ResponseWriter, r *http.Request, files views.Map[string, string], mountPoint string) {
+	dir := strings.TrimSuffix(mountPoint, "/")
+	rel, ok := strs.CutPrefix(r.URL.Path, dir)
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case rel == "":
+		http.Redirect(w, r, dir+"/", http.StatusFound)
+	case rel == "/":
+		var names []string
+		files.Range(func(name, _ string) bool {
+			names = append(names, name)
+			return true
+		})
+		slices.Sort(names)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<pre>\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(url.PathEscape(name)), html.EscapeString(name))
+		}
+		io.WriteString(w, "</pre>\n")
+	default:
+		file, ok := files.GetOk(rel[1:])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			http.Error(w, "not a file", 500)
+			return
+		}
+		http.ServeContent(w, r, rel[1:], fi.ModTime(), f)
+	}
+}
+
 func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Request, fileOrDir, mountPoint string) {
 	fi, err := os.Stat(fileOrDir)
 	if err != nil {
@@ -471,6 +816,90 @@ func (b *LocalBackend) serveFileOrDirectory(w http.ResponseWriter, r *http.Reque
 	}, r)
 }
 
+// serveArchive serves the request from the contents of the archive file in
+// the given format ("zip" or "tar.gz"), as if they were a directory mounted
+// at mountPoint. The archive is opened for each request, so that it can be
+// replaced without restarting serve.
+func serveArchive(w http.ResponseWriter, r *http.Request, archive, format, mountPoint string) {
+	if len(r.URL.Path) < len(mountPoint) && r.URL.Path+"/" == mountPoint {
+		http.Redirect(w, r, mountPoint, http.StatusFound)
+		return
+	}
+	switch format {
+	case "zip":
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer zr.Close()
+		var fs http.Handler = http.FileServer(http.FS(zr))
+		if mountPoint != "/" {
+			fs = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), fs)
+		}
+		fs.ServeHTTP(&fixLocationHeaderResponseWriter{
+			ResponseWriter: w,
+			mountPoint:     mountPoint,
+		}, r)
+	case "tar.gz":
+		serveTarGz(w, r, archive, mountPoint)
+	default:
+		http.Error(w, "unknown archive format", 500)
+	}
+}
+
+// maxTarFileSize is the largest file serveTarGz will serve. Files are read
+// into memory to serve them, as tar archives can't be seeked into.
+const maxTarFileSize = 64 << 20
+
+// serveTarGz serves the file the request is for from the gzipped tar
+// archive, mounted at mountPoint. It scans the archive for the file, and
+// serves a directory's index.html for requests ending in a slash.
+func serveTarGz(w http.ResponseWriter, r *http.Request, archive, mountPoint string) {
+	rel := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(mountPoint, "/"))
+	name := strings.TrimPrefix(path.Clean("/"+rel), "/")
+	if name == "" || strings.HasSuffix(rel, "/") {
+		name = path.Join(name, "index.html")
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Clean("/"+hdr.Name) != "/"+name {
+			continue
+		}
+		if hdr.Size > maxTarFileSize {
+			http.Error(w, "file too large to serve from a tar archive", 500)
+			return
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		http.ServeContent(w, r, path.Base(name), hdr.ModTime, bytes.NewReader(b))
+		return
+	}
+}
+
 // fixLocationHeaderResponseWriter is an http.ResponseWriter wrapper that, upon
 // flushing HTTP headers, prefixes any Location header with the mount point.
 type fixLocationHeaderResponseWriter struct {
@@ -502,6 +931,7 @@ func (w *fixLocationHeaderResponseWriter) Write(p []byte) (int, error) {
 // * host:port ("localhost:8080")
 // * full URL ("http://localhost:8080", in which case it's returned unchanged)
 // * insecure TLS ("https+insecure://127.0.0.1:4430")
+// * cleartext HTTP/2 ("h2c://127.0.0.1:50051"), returned as http://
 func expandProxyArg(s string) (targetURL string, insecureSkipVerify bool) {
 	if s == "" {
 		return "", false
@@ -512,12 +942,20 @@ func expandProxyArg(s string) (targetURL string, insecureSkipVerify bool) {
 	if rest, ok := strs.CutPrefix(s, "https+insecure://"); ok {
 		return "https://" + rest, true
 	}
+	if rest, ok := strs.CutPrefix(s, "h2c://"); ok {
+		return "http://" + rest, false
+	}
 	if allNumeric(s) {
 		return "http://127.0.0.1:" + s, false
 	}
 	return "http://" + s, false
 }
 
+// newH2CTransport is non-nil on platforms that support proxying to h2c
+// ("cleartext" HTTP/2) backends. It returns a transport that dials with
+// dial and speaks HTTP/2 without TLS.
+var newH2CTransport func(dial func(ctx context.Context, network, addr string) (net.Conn, error)) http.RoundTripper
+
 func allNumeric(s string) bool {
 	for i := 0; i < len(s); i++ {
 		if s[i] < '0' || s[i] > '9' {
@@ -539,6 +977,70 @@ func (b *LocalBackend) webServerConfig(sniName string, port uint16) (c ipn.WebSe
 	return b.serveConfig.Web().GetOk(key)
 }
 
+// setHSTS sets the Strict-Transport-Security header in hdr if h asks for
+// one. It must only be used for responses sent over TLS.
+func setHSTS(hdr http.Header, h ipn.HTTPHandlerView) {
+	age := h.HSTSMaxAge()
+	if age <= 0 {
+		return
+	}
+	v := "max-age=" + strconv.Itoa(age)
+	if h.HSTSIncludeSubdomains() {
+		v += "; includeSubDomains"
+	}
+	hdr.Set("Strict-Transport-Security", v)
+}
+
+// checkBasicAuth reports whether r may be served by h. If h requires HTTP
+// basic authentication and r doesn't have the right credentials, it
+// writes a 401 response asking for them and returns false.
+func checkBasicAuth(w http.ResponseWriter, r *http.Request, h ipn.HTTPHandlerView) bool {
+	wantUser, hash := h.BasicAuthUser(), h.BasicAuthHash()
+	if wantUser == "" && hash == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if ok && subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1 &&
+		bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="tailscale serve", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// getTLSServeClientAuthForPort returns a tls.Config.GetConfigForClient
+// func for base, the config of port, that requires client certificates
+// for the web servers with RequireClientCert set, and leaves base alone
+// for the rest.
+func (b *LocalBackend) getTLSServeClientAuthForPort(port uint16, base *tls.Config) func(hi *tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hi *tls.ClientHelloInfo) (*tls.Config, error) {
+		wsc, ok := b.webServerConfig(hi.ServerName, port)
+		if !ok || !wsc.RequireClientCert() {
+			return nil, nil
+		}
+		return clientAuthTLSConfig(base, wsc.ClientCAs())
+	}
+}
+
+// clientAuthTLSConfig returns a copy of the TLS server config base that
+// requires a client certificate: one that chains to a CA in caPEM, or any
+// one if caPEM is empty.
+func clientAuthTLSConfig(base *tls.Config, caPEM string) (*tls.Config, error) {
+	conf := base.Clone()
+	conf.GetConfigForClient = nil
+	conf.ClientAuth = tls.RequireAnyClientCert
+	if caPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, errors.New("no valid certificates in ClientCAs")
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
 func (b *LocalBackend) getTLSServeCertForPort(port uint16) func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		if hi == nil || hi.ServerName == "" {
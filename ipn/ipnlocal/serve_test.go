@@ -5,18 +5,43 @@
 package ipnlocal
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
+	"tailscale.com/wgengine"
 )
 
 func TestExpandProxyArg(t *testing.T) {
@@ -35,6 +60,7 @@ type res struct {
 		{"http://foo.com", res{"http://foo.com", false}},
 		{"https://foo.com", res{"https://foo.com", false}},
 		{"https+insecure://10.2.3.4", res{"https://10.2.3.4", true}},
+		{"h2c://127.0.0.1:50051", res{"http://127.0.0.1:50051", false}},
 	}
 	for _, tt := range tests {
 		target, insecure := expandProxyArg(tt.in)
@@ -61,9 +87,26 @@ func TestGetServeHandler(t *testing.T) {
 		},
 	}
 
+	conf2 := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			serverName + ":443": {
+				Handlers: map[string]*ipn.HTTPHandler{
+					"/api":    {},
+					"/api/v2": {},
+				},
+			},
+			serverName + ":80": {
+				Handlers: map[string]*ipn.HTTPHandler{
+					"/plain": {},
+				},
+			},
+		},
+	}
+
 	tests := []struct {
 		name string
 		port uint16 // or 443 is zero
+		http bool   // plaintext request, matched by Host header
 		path string // http.Request.URL.Path
 		conf *ipn.ServeConfig
 		want string // mountPoint
@@ -122,6 +165,38 @@ func TestGetServeHandler(t *testing.T) {
 			path: "/foo",
 			want: "/foo/",
 		},
+		{
+			name: "nested-outer",
+			conf: conf2,
+			path: "/api/v1/users",
+			want: "/api",
+		},
+		{
+			name: "nested-inner",
+			conf: conf2,
+			path: "/api/v2/users",
+			want: "/api/v2",
+		},
+		{
+			name: "nested-not-segment-prefix",
+			conf: conf2,
+			path: "/api/v20",
+			want: "/api",
+		},
+		{
+			name: "nested-no-root",
+			conf: conf2,
+			path: "/other",
+			want: "",
+		},
+		{
+			name: "http",
+			conf: conf2,
+			port: 80,
+			http: true,
+			path: "/plain/x",
+			want: "/plain",
+		},
 		{
 			name: "dot-dots",
 			conf: conf1,
@@ -141,6 +216,10 @@ func TestGetServeHandler(t *testing.T) {
 				},
 				TLS: &tls.ConnectionState{ServerName: serverName},
 			}
+			if tt.http {
+				req.TLS = nil
+				req.Host = serverName + ":80"
+			}
 			port := tt.port
 			if port == 0 {
 				port = 443
@@ -163,6 +242,108 @@ func TestGetServeHandler(t *testing.T) {
 	}
 }
 
+func TestServeHTTPPort(t *testing.T) {
+	b := &LocalBackend{
+		serveConfig: (&ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "plain", HSTSMaxAge: 300},
+				}},
+				"other.ts.net:80": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "other"},
+				}},
+			},
+		}).View(),
+		logf: t.Logf,
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	getConn := func() (net.Conn, bool) { return server, true }
+	sendRST := func() { panic("unexpected RST") }
+	go b.HandleInterceptedTCPConn(80, netip.MustParseAddrPort("100.64.0.2:51234"), getConn, sendRST)
+
+	// Without TLS there's no SNI, so each request on the one
+	// connection is matched by its Host header alone.
+	br := bufio.NewReader(client)
+	tests := []struct {
+		host     string
+		wantCode int
+		wantBody string
+	}{
+		{"example.ts.net", 200, "plain"},
+		{"other.ts.net:80", 200, "other"},
+		{"nope.ts.net", 404, ""},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "http://"+tt.host+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.Write(client); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.wantCode {
+			t.Errorf("Host %s: status = %d; want %d", tt.host, res.StatusCode, tt.wantCode)
+		}
+		if tt.wantBody != "" && string(body) != tt.wantBody {
+			t.Errorf("Host %s: body = %q; want %q", tt.host, body, tt.wantBody)
+		}
+		if hsts := res.Header.Get("Strict-Transport-Security"); hsts != "" {
+			t.Errorf("Host %s: plaintext response has Strict-Transport-Security %q", tt.host, hsts)
+		}
+	}
+}
+
+func TestHandleIngressTCPConnExpiry(t *testing.T) {
+	b := &LocalBackend{
+		serveConfig: (&ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{80: {HTTP: true}},
+			AllowIngress: map[ipn.HostPort]bool{
+				"expired.ts.net:80": true,
+				"later.ts.net:80":   true,
+				"forever.ts.net:80": true,
+			},
+			IngressExpiry: map[ipn.HostPort]time.Time{
+				"expired.ts.net:80": time.Now().Add(-time.Minute),
+				"later.ts.net:80":   time.Now().Add(time.Hour),
+			},
+		}).View(),
+		logf: t.Logf,
+	}
+	tests := []struct {
+		target  ipn.HostPort
+		wantRST bool
+	}{
+		{"expired.ts.net:80", true},
+		{"later.ts.net:80", false},
+		{"forever.ts.net:80", false},
+	}
+	for _, tt := range tests {
+		var gotConn, gotRST bool
+		// A failed getConn ends HandleInterceptedTCPConn before it
+		// serves anything, once it has shown the conn was forwarded.
+		getConn := func() (net.Conn, bool) { gotConn = true; return nil, false }
+		sendRST := func() { gotRST = true }
+		b.HandleIngressTCPConn(nil, tt.target, netip.MustParseAddrPort("100.64.0.2:51234"), getConn, sendRST)
+		if gotRST != tt.wantRST {
+			t.Errorf("%s: sent RST = %v; want %v", tt.target, gotRST, tt.wantRST)
+		}
+		if gotConn == tt.wantRST {
+			t.Errorf("%s: forwarded = %v; want %v", tt.target, gotConn, !tt.wantRST)
+		}
+	}
+}
+
 func TestServeFileOrDirectory(t *testing.T) {
 	td := t.TempDir()
 	writeFile := func(suffix, contents string) {
@@ -252,3 +433,440 @@ func TestServeFileOrDirectory(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&ipn.HTTPHandler{Text: "hi", BasicAuthUser: "alice", BasicAuthHash: string(hash)}).View()
+	tests := []struct {
+		name       string
+		h          ipn.HTTPHandlerView
+		user, pass string // "" user means no credentials
+		want       bool
+	}{
+		{name: "no-auth", h: (&ipn.HTTPHandler{Text: "hi"}).View(), want: true},
+		{name: "no-credentials", h: h},
+		{name: "right", h: h, user: "alice", pass: "hunter2", want: true},
+		{name: "wrong-password", h: h, user: "alice", pass: "hunter3"},
+		{name: "wrong-user", h: h, user: "bob", pass: "hunter2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "https://foo.test.ts.net/", nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			if got := checkBasicAuth(w, r, tt.h); got != tt.want {
+				t.Fatalf("checkBasicAuth = %v; want %v", got, tt.want)
+			}
+			if tt.want {
+				return
+			}
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d; want 401", w.Code)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestSetHSTS(t *testing.T) {
+	tests := []struct {
+		h    ipn.HTTPHandler
+		want string
+	}{
+		{h: ipn.HTTPHandler{Text: "hi"}, want: ""},
+		{h: ipn.HTTPHandler{Text: "hi", HSTSMaxAge: 300}, want: "max-age=300"},
+		{h: ipn.HTTPHandler{Text: "hi", HSTSMaxAge: 31536000, HSTSIncludeSubdomains: true}, want: "max-age=31536000; includeSubDomains"},
+	}
+	for _, tt := range tests {
+		hdr := http.Header{}
+		setHSTS(hdr, tt.h.View())
+		if got := hdr.Get("Strict-Transport-Security"); got != tt.want {
+			t.Errorf("HSTSMaxAge=%d, HSTSIncludeSubdomains=%v: got %q; want %q", tt.h.HSTSMaxAge, tt.h.HSTSIncludeSubdomains, got, tt.want)
+		}
+	}
+}
+
+func TestFollowRedirectsTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new?x=1", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/away":
+			http.Redirect(w, r, "https://example.com/", http.StatusFound)
+		default:
+			fmt.Fprintf(w, "at %s", r.URL.RequestURI())
+		}
+	}))
+	defer backend.Close()
+	rt := followRedirectsTransport{http.DefaultTransport}
+	tests := []struct {
+		method, path string
+		wantCode     int
+		wantBody     string
+	}{
+		{"GET", "/old", 200, "at /new?x=1"},
+		{"HEAD", "/old", 200, ""},
+		{"POST", "/old", 302, ""},
+		{"GET", "/away", 302, ""},
+		{"GET", "/loop", 302, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, backend.URL+tt.path, nil)
+		req.RequestURI = ""
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.wantCode {
+			t.Errorf("%s %s: status = %d; want %d", tt.method, tt.path, res.StatusCode, tt.wantCode)
+		}
+		if tt.wantBody != "" && string(body) != tt.wantBody {
+			t.Errorf("%s %s: body = %q; want %q", tt.method, tt.path, body, tt.wantBody)
+		}
+	}
+}
+
+func TestSPAIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"index.html", "app.js"} {
+		if err := os.WriteFile(filepath.Join(dir, f), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "assets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(dir, "index.html")
+	tests := []struct {
+		req, mount string
+		want       string // "" for no fallback
+	}{
+		{"/app.js", "/", ""},
+		{"/assets/", "/", ""},
+		{"/", "/", ""},
+		{"/users/42", "/", index},
+		{"/missing.js", "/", index},
+		{"/app/users/42", "/app/", index},
+		{"/app/app.js", "/app/", ""},
+		{"/app/../../etc/passwd", "/app/", index},
+	}
+	for _, tt := range tests {
+		got, ok := spaIndex(dir, tt.req, tt.mount)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("spaIndex(%q, %q) = %q, %v; want %q", tt.req, tt.mount, got, ok, tt.want)
+		}
+	}
+	if _, ok := spaIndex(filepath.Join(dir, "assets"), "/missing", "/"); ok {
+		t.Error("spaIndex fell back in a directory without index.html")
+	}
+}
+
+func TestServeNamedFiles(t *testing.T) {
+	td := t.TempDir()
+	a, b := filepath.Join(td, "a.zip"), filepath.Join(td, "other.bin")
+	for _, f := range []string{a, b} {
+		if err := os.WriteFile(f, []byte("contents of "+filepath.Base(f)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := views.MapOf(map[string]string{
+		"a.zip":   a,
+		"b.zip":   b,
+		"gone.gz": filepath.Join(td, "missing"),
+	})
+	tests := []struct {
+		req      string
+		wantCode int
+		wantBody string
+	}{
+		{"/downloads", 302, ""},
+		{"/downloads/", 200, `<a href="b.zip">b.zip</a>`},
+		{"/downloads/a.zip", 200, "contents of a.zip"},
+		{"/downloads/b.zip", 200, "contents of other.bin"},
+		{"/downloads/other.bin", 404, ""},
+		{"/downloads/gone.gz", 404, ""},
+		{"/downloads/sub/a.zip", 404, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		serveNamedFiles(rec, httptest.NewRequest("GET", tt.req, nil), files, "/downloads/")
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d; want %d", tt.req, rec.Code, tt.wantCode)
+		}
+		if !strings.Contains(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s: body = %q; want it to contain %q", tt.req, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestOverlayDir(t *testing.T) {
+	top, bottom := t.TempDir(), t.TempDir()
+	for _, f := range []string{
+		filepath.Join(top, "index.html"),
+		filepath.Join(bottom, "index.html"),
+		filepath.Join(bottom, "style.css"),
+	} {
+		if err := os.WriteFile(f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs := []string{top, bottom}
+	tests := []struct {
+		req, mount string
+		want       string
+	}{
+		{"/index.html", "/", top},
+		{"/style.css", "/", bottom},
+		{"/missing", "/", top},
+		{"/site/style.css", "/site/", bottom},
+		{"/site/../style.css", "/site/", bottom},
+		{"/site/index.html", "/site/", top},
+	}
+	for _, tt := range tests {
+		if got := overlayDir(dirs, tt.req, tt.mount); got != tt.want {
+			t.Errorf("overlayDir(%q, %q) = %q; want %q", tt.req, tt.mount, got, tt.want)
+		}
+	}
+}
+
+func TestServeArchive(t *testing.T) {
+	td := t.TempDir()
+	files := map[string]string{
+		"index.html":      "home page",
+		"css/site.css":    "body {}",
+		"docs/index.html": "docs page",
+	}
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, name := range []string{"index.html", "css/site.css", "docs/index.html"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, files[name])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tgzBuf bytes.Buffer
+	gw := gzip.NewWriter(&tgzBuf)
+	tw := tar.NewWriter(gw)
+	for _, name := range []string{"index.html", "css/site.css", "docs/index.html"} {
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archives := map[string]string{
+		"zip":    filepath.Join(td, "site.zip"),
+		"tar.gz": filepath.Join(td, "site.tar.gz"),
+	}
+	if err := os.WriteFile(archives["zip"], zipBuf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archives["tar.gz"], tgzBuf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req      string
+		mount    string
+		wantCode int
+		wantBody string
+	}{
+		{"/", "/", 200, "home page"},
+		{"/css/site.css", "/", 200, "body {}"},
+		{"/docs/", "/", 200, "docs page"},
+		{"/missing.html", "/", 404, ""},
+		{"/../../etc/passwd", "/", 404, ""},
+		{"/site", "/site/", 302, ""},
+		{"/site/", "/site/", 200, "home page"},
+		{"/site/css/site.css", "/site/", 200, "body {}"},
+		{"/site/docs/", "/site/", 200, "docs page"},
+		{"/site/missing.html", "/site/", 404, ""},
+	}
+	for _, format := range []string{"zip", "tar.gz"} {
+		for _, tt := range tests {
+			rec := httptest.NewRecorder()
+			serveArchive(rec, httptest.NewRequest("GET", tt.req, nil), archives[format], format, tt.mount)
+			if rec.Code != tt.wantCode {
+				t.Errorf("%s %s (mount %s): status = %d; want %d", format, tt.req, tt.mount, rec.Code, tt.wantCode)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("%s %s (mount %s): body = %q; want it to contain %q", format, tt.req, tt.mount, rec.Body.String(), tt.wantBody)
+			}
+		}
+	}
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	v4src := netip.MustParseAddrPort("100.64.1.2:45678")
+	v4dst := netip.MustParseAddrPort("100.100.1.1:443")
+	v6src := netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:45678")
+	v6dst := netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:443")
+	const sig = "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		name     string
+		version  int
+		src, dst netip.AddrPort
+		want     string
+	}{
+		{"v1-ipv4", 1, v4src, v4dst, "PROXY TCP4 100.64.1.2 100.100.1.1 45678 443\r\n"},
+		{"v1-ipv6", 1, v6src, v6dst, "PROXY TCP6 fd7a:115c:a1e0::2 fd7a:115c:a1e0::1 45678 443\r\n"},
+		{"v1-4in6", 1, netip.MustParseAddrPort("[::ffff:100.64.1.2]:45678"), v4dst, "PROXY TCP4 100.64.1.2 100.100.1.1 45678 443\r\n"},
+		{"v1-mixed", 1, v4src, v6dst, "PROXY UNKNOWN\r\n"},
+		{"v1-no-dst", 1, v4src, netip.AddrPort{}, "PROXY UNKNOWN\r\n"},
+		{"v2-ipv4", 2, v4src, v4dst, sig + "\x21\x11\x00\x0c" +
+			"\x64\x40\x01\x02" + "\x64\x64\x01\x01" + "\xb2\x6e" + "\x01\xbb"},
+		{"v2-ipv6", 2, v6src, v6dst, sig + "\x21\x21\x00\x24" +
+			"\xfd\x7a\x11\x5c\xa1\xe0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\xfd\x7a\x11\x5c\xa1\xe0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\xb2\x6e" + "\x01\xbb"},
+		{"v2-mixed", 2, v4src, v6dst, sig + "\x21\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(proxyProtocolHeader(tt.version, tt.src, tt.dst)); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientAuthTLSConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	base := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) { return nil, nil }
+
+	conf, err := clientAuthTLSConfig(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ClientAuth != tls.RequireAnyClientCert || conf.ClientCAs != nil || conf.GetCertificate == nil {
+		t.Errorf("without CAs: got ClientAuth %v, ClientCAs %v", conf.ClientAuth, conf.ClientCAs)
+	}
+	if !reflect.DeepEqual(conf.NextProtos, base.NextProtos) {
+		t.Errorf("NextProtos = %q; want %q from the base config", conf.NextProtos, base.NextProtos)
+	}
+	if conf.GetConfigForClient != nil {
+		t.Error("GetConfigForClient was copied from the base config")
+	}
+	if base.ClientAuth != tls.NoClientCert {
+		t.Error("base config was modified")
+	}
+
+	conf, err = clientAuthTLSConfig(base, caPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ClientAuth != tls.RequireAndVerifyClientCert || conf.ClientCAs == nil {
+		t.Errorf("with CAs: got ClientAuth %v, ClientCAs %v", conf.ClientAuth, conf.ClientCAs)
+	}
+
+	// A client without a certificate is turned away.
+	sc, cc := net.Pipe()
+	defer sc.Close()
+	defer cc.Close()
+	errc := make(chan error, 1)
+	go func() { errc <- tls.Server(sc, conf).Handshake() }()
+	client := tls.Client(cc, &tls.Config{InsecureSkipVerify: true})
+	client.Handshake()
+	io.ReadAll(client) // TLS 1.3 reports the rejection after the handshake
+	if err := <-errc; err == nil {
+		t.Error("handshake without a client certificate succeeded")
+	}
+
+	if _, err := clientAuthTLSConfig(base, "not PEM"); err == nil {
+		t.Error("clientAuthTLSConfig with invalid PEM succeeded")
+	}
+}
+
+func TestSetServeConfigETag(t *testing.T) {
+	logf := tstest.WhileTestRunningLogger(t)
+	e, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(e.Close)
+	b, err := NewLocalBackend(logf, "logid", new(mem.Store), "", nil, e, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	b.netMap = &netmap.NetworkMap{SelfNode: &tailcfg.Node{Name: "foo.test.ts.net."}}
+
+	etag := func() string {
+		t.Helper()
+		tag, err := ServeConfigETag(b.ServeConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag
+	}
+	a := &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:22"}}}
+	if err := b.SetServeConfig(a, ""); err != nil {
+		t.Fatal(err)
+	}
+	tagA := etag()
+
+	// A matching ETag saves.
+	c := &ipn.ServeConfig{TCP: map[uint16]*ipn.TCPPortHandler{443: {TCPForward: "127.0.0.1:2222"}}}
+	if err := b.SetServeConfig(c, tagA); err != nil {
+		t.Fatalf("SetServeConfig with current ETag: %v", err)
+	}
+	if got := b.ServeConfig().AsStruct(); !reflect.DeepEqual(got, c) {
+		t.Fatalf("after matching save, got %+v; want %+v", got, c)
+	}
+	if etag() == tagA {
+		t.Fatal("ETag unchanged after the config changed")
+	}
+
+	// tagA is stale now, so saving with it changes nothing.
+	if err := b.SetServeConfig(a, tagA); !errors.Is(err, ErrServeConfigChanged) {
+		t.Fatalf("SetServeConfig with stale ETag: got %v; want ErrServeConfigChanged", err)
+	}
+	if got := b.ServeConfig().AsStruct(); !reflect.DeepEqual(got, c) {
+		t.Errorf("after stale save, got %+v; want %+v", got, c)
+	}
+}
@@ -76,6 +76,7 @@
 	"prefs":                   (*Handler).servePrefs,
 	"pprof":                   (*Handler).servePprof,
 	"serve-config":            (*Handler).serveServeConfig,
+	"serve-config-peer":       (*Handler).serveServeConfigPeer,
 	"set-dns":                 (*Handler).serveSetDNS,
 	"set-expiry-sooner":       (*Handler).serveSetExpirySooner,
 	"status":                  (*Handler).serveStatus,
@@ -471,6 +472,12 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		config := h.b.ServeConfig()
+		etag, err := ipnlocal.ServeConfigETag(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Etag", etag)
 		json.NewEncoder(w).Encode(config)
 	case "POST":
 		configIn := new(ipn.ServeConfig)
@@ -482,7 +489,11 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 			})
 			return
 		}
-		err := h.b.SetServeConfig(configIn)
+		err := h.b.SetServeConfig(configIn, r.Header.Get("If-Match"))
+		if errors.Is(err, ipnlocal.ErrServeConfigChanged) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
 		if err != nil {
 			json.NewEncoder(w).Encode(struct {
 				Error error
@@ -495,6 +506,31 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveServeConfigPeer returns the serve config of the peer named by the
+// "peer" query parameter, as fetched from that peer's PeerAPI.
+func (h *Handler) serveServeConfigPeer(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "serve config denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	peer := r.FormValue("peer")
+	if peer == "" {
+		http.Error(w, "missing 'peer' parameter", http.StatusBadRequest)
+		return
+	}
+	sc, err := h.b.PeerServeConfig(r.Context(), peer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sc)
+}
+
 func (h *Handler) serveCheckIPForwarding(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitRead {
 		http.Error(w, "IP forwarding check access denied", http.StatusForbidden)
@@ -1109,6 +1145,7 @@ func (h *Handler) serveTKADisable(w http.ResponseWriter, r *http.Request) {
 //   - GET /profiles/current: current profile (JSON-ecoded ipn.LoginProfile)
 //   - GET /profiles/<id>: output profile (JSON-ecoded ipn.LoginProfile)
 //   - POST /profiles/<id>: switch to profile (no response)
+//   - PATCH /profiles/<id>?name=<name>: rename profile (no response)
 //   - DELETE /profiles/<id>: delete profile (no response)
 func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
@@ -1172,6 +1209,13 @@ func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		err := h.b.RenameProfile(profileID, r.FormValue("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	case http.MethodDelete:
 		err := h.b.DeleteProfile(profileID)
 		if err != nil {
@@ -1180,7 +1224,7 @@ func (h *Handler) serveProfiles(w http.ResponseWriter, r *http.Request) {
 		}
 		w.WriteHeader(http.StatusNoContent)
 	default:
-		http.Error(w, "use POST or DELETE", http.StatusMethodNotAllowed)
+		http.Error(w, "use POST, PATCH, or DELETE", http.StatusMethodNotAllowed)
 	}
 }
 
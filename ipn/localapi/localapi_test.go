@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package localapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/tstest"
+	"tailscale.com/wgengine"
+)
+
+func TestServeConfigETag(t *testing.T) {
+	logf := tstest.WhileTestRunningLogger(t)
+	e, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatalf("NewFakeUserspaceEngine: %v", err)
+	}
+	t.Cleanup(e.Close)
+	b, err := ipnlocal.NewLocalBackend(logf, "logid", new(mem.Store), "", nil, e, 0)
+	if err != nil {
+		t.Fatalf("NewLocalBackend: %v", err)
+	}
+	h := NewHandler(b, logf, "logid")
+	h.PermitRead, h.PermitWrite = true, true
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/localapi/v0/serve-config", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET: status %d: %s", rr.Code, rr.Body)
+	}
+	etag := rr.Header().Get("Etag")
+	if want, err := ipnlocal.ServeConfigETag(b.ServeConfig()); err != nil || etag != want {
+		t.Fatalf("GET: Etag %q; want %q (err %v)", etag, want, err)
+	}
+
+	post := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/localapi/v0/serve-config", strings.NewReader(`{"TCP": {"443": {"TCPForward": "127.0.0.1:22"}}}`))
+		req.Header.Set("If-Match", ifMatch)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := post(`"stale"`); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("POST with stale If-Match: status %d; want %d", rr.Code, http.StatusPreconditionFailed)
+	}
+	// The ETag from GET passes the If-Match check. The save itself then
+	// fails, as this backend has no netmap, which SetServeConfig needs;
+	// that error is reported in the body of a 200 response.
+	if rr := post(etag); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"Error"`) {
+		t.Errorf("POST with If-Match from GET: status %d: %s; want 200 with the save's error", rr.Code, rr.Body)
+	}
+}
@@ -8,6 +8,7 @@
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 // ErrStateNotExist is returned by StateStore.ReadState when the
@@ -104,6 +105,10 @@ type ServeConfig struct {
 	// the Tailscale IP addresses. (not subnet routers, etc)
 	TCP map[uint16]*TCPPortHandler `json:",omitempty"`
 
+	// UDP are the UDP port numbers that tailscaled should forward for the
+	// Tailscale IP addresses, keyed like TCP.
+	UDP map[uint16]*UDPPortHandler `json:",omitempty"`
+
 	// Web maps from "$SNI_NAME:$PORT" to a set of HTTP handlers
 	// keyed by mount point ("/", "/foo", etc)
 	Web map[HostPort]*WebServerConfig `json:",omitempty"`
@@ -111,6 +116,48 @@ type ServeConfig struct {
 	// AllowIngress is the set of SNI:port values for which ingress
 	// traffic is allowed, from trusted ingress peers.
 	AllowIngress map[HostPort]bool `json:",omitempty"`
+
+	// IngressExpiry optionally maps SNI:port values in AllowIngress to
+	// the time at which ingress stops being allowed. Entries without an
+	// expiry are allowed until removed from AllowIngress.
+	IngressExpiry map[HostPort]time.Time `json:",omitempty"`
+
+	// EncryptedSecrets, if true, asks tailscaled to encrypt the secret
+	// fields of handlers (such as HTTPHandler.BasicAuthHash) when storing
+	// this config.
+	EncryptedSecrets bool `json:",omitempty"`
+
+	// Version is the version of the format the config is in, or 0 if it
+	// predates versioning. See ServeConfigVersion.
+	Version int `json:",omitempty"`
+}
+
+// ServeConfigVersion is the current version of the ServeConfig format.
+// Configs with an older Version are migrated when read by the CLI, and
+// configs with a newer one are rejected rather than misread.
+//
+// Version 1 stores HTTPHandler.Proxy targets as URLs, where unversioned
+// configs may also use a bare port or host:port.
+const ServeConfigVersion = 1
+
+// IsTCPForwardingOnPort reports whether sc forwards raw TCP connections
+// on port. It's safe to call on a nil ServeConfig.
+func (sc *ServeConfig) IsTCPForwardingOnPort(port uint16) bool {
+	if sc == nil {
+		return false
+	}
+	th, ok := sc.TCP[port]
+	return ok && th != nil && th.TCPForward != ""
+}
+
+// IsServingWebOnPort reports whether sc serves HTTP or HTTPS web handlers on
+// port. It's safe to call on a nil ServeConfig.
+func (sc *ServeConfig) IsServingWebOnPort(port uint16) bool {
+	if sc == nil {
+		return false
+	}
+	th, ok := sc.TCP[port]
+	return ok && th != nil && (th.HTTPS || th.HTTP)
 }
 
 // HostPort is an SNI name and port number, joined by a colon.
@@ -119,7 +166,21 @@ type ServeConfig struct {
 
 // WebServerConfig describes a web server's configuration.
 type WebServerConfig struct {
+	// Handlers maps mount points to their handlers. A request is served
+	// by the handler whose mount point equals the request path, or else
+	// by the one with the longest mount point that is a parent directory
+	// of the path. Given both "/foo/" and "/foo", a request for "/foo"
+	// goes to "/foo" and requests below it go to "/foo/".
 	Handlers map[string]*HTTPHandler
+
+	// RequireClientCert, if true, means that TLS clients must present a
+	// certificate to be served. It's not valid for plaintext HTTP ports.
+	RequireClientCert bool `json:",omitempty"`
+
+	// ClientCAs, if non-empty, is one or more PEM-encoded CA certificates
+	// that client certificates must chain to. If empty, any certificate is
+	// accepted. It's only used with RequireClientCert.
+	ClientCAs string `json:",omitempty"`
 }
 
 // TCPPortHandler describes what to do when handling a TCP
@@ -128,14 +189,20 @@ type TCPPortHandler struct {
 	// HTTPS, if true, means that tailscaled should handle this connection as an
 	// HTTPS request as configured by ServeConfig.Web.
 	//
-	// It is mutually exclusive with TCPForward.
+	// It is mutually exclusive with HTTP and TCPForward.
 	HTTPS bool `json:",omitempty"`
 
+	// HTTP, if true, means that tailscaled should handle this connection as a
+	// plaintext HTTP request as configured by ServeConfig.Web, without TLS.
+	//
+	// It is mutually exclusive with HTTPS and TCPForward.
+	HTTP bool `json:",omitempty"`
+
 	// TCPForward is the IP:port to forward TCP connections to.
 	// Whether or not TLS is terminated by tailscaled depends on
 	// TerminateTLS.
 	//
-	// It is mutually exclusive with HTTPS.
+	// It is mutually exclusive with HTTPS and HTTP.
 	TCPForward string `json:",omitempty"`
 
 	// TerminateTLS, if non-empty, means that tailscaled should terminate the
@@ -143,6 +210,22 @@ type TCPPortHandler struct {
 	// SNI name with this value. It is only used if TCPForward is non-empty.
 	// (the HTTPS mode uses ServeConfig.Web)
 	TerminateTLS string `json:",omitempty"`
+
+	// ProxyProtocol, if non-zero, is the version (1 or 2) of the PROXY
+	// protocol header that tailscaled sends to TCPForward at the start of
+	// each connection, to tell the backend the client's address. It is
+	// only used if TCPForward is non-empty.
+	ProxyProtocol int `json:",omitempty"`
+
+	// Comment is an optional human-readable label describing what the
+	// port is for. It has no effect on how connections are handled.
+	Comment string `json:",omitempty"`
+}
+
+// UDPPortHandler describes what to do when handling a UDP datagram.
+type UDPPortHandler struct {
+	// UDPForward is the IP:port to forward UDP datagrams to.
+	UDPForward string `json:",omitempty"`
 }
 
 // HTTPHandler is either a path or a proxy to serve.
@@ -150,10 +233,110 @@ type HTTPHandler struct {
 	// Exactly one of the following may be set.
 
 	Path  string `json:",omitempty"` // absolute path to directory or file to serve
-	Proxy string `json:",omitempty"` // http://localhost:3000/, localhost:3030, 3030
+	Proxy string `json:",omitempty"` // http://localhost:3000/, localhost:3030, 3030, h2c://localhost:50051
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
+	// Redirect is a URL, or an absolute path on the same host, to redirect
+	// requests to.
+	Redirect string `json:",omitempty"`
+
+	// Files, if non-empty, serves a virtual directory at a mount point
+	// ending in "/". Each key is a file name (without any "/") served
+	// under the mount point and each value the absolute path of the
+	// regular file to serve for it.
+	Files map[string]string `json:",omitempty"`
+
+	// StatusCode, if non-zero, is the HTTP status code sent with Text, or
+	// the redirect status (301, 302, 307, or 308) for Redirect. It
+	// defaults to 200 OK for Text and 302 Found for Redirect.
+	StatusCode int `json:",omitempty"`
+
+	// BasicAuthUser and BasicAuthHash, if non-empty, require HTTP basic
+	// authentication for requests to this handler. BasicAuthHash is the
+	// bcrypt hash of the password.
+	BasicAuthUser string `json:",omitempty"`
+	BasicAuthHash string `json:",omitempty"`
+
+	// HSTSMaxAge, if positive, is the max-age in seconds of the
+	// Strict-Transport-Security header sent with responses over HTTPS.
+	// HSTSIncludeSubdomains adds includeSubDomains to that header.
+	HSTSMaxAge            int  `json:",omitempty"`
+	HSTSIncludeSubdomains bool `json:",omitempty"`
+
+	// MaintenanceWindow, if non-empty, is a weekly window in the node's
+	// local time, like "Sat 02:00-04:00", during which the handler
+	// responds with 503 Service Unavailable instead of serving.
+	// An end time earlier than the start time spans midnight.
+	MaintenanceWindow string `json:",omitempty"`
+
+	// RateLimit, if non-empty, limits the requests the Proxy or Path
+	// handler serves to a number per second, minute, or hour, like
+	// "10/s", "600/m", or "5000/h". Requests over the limit get 429 Too
+	// Many Requests.
+	RateLimit string `json:",omitempty"`
+
+	// ExtraProxies are additional backends, in the same form as Proxy,
+	// to balance requests across along with Proxy.
+	ExtraProxies []string `json:",omitempty"`
+
+	// ExtraPaths are additional directories, in the same form as Path,
+	// layered beneath Path: a request is served from the first of Path
+	// and ExtraPaths that has the requested file. Path must be a
+	// directory to use them.
+	ExtraPaths []string `json:",omitempty"`
+
+	// Archive, if non-empty, means Path is an archive whose contents are
+	// served as a directory tree, rather than a file to serve as is. It's
+	// the archive's format: "zip" or "tar.gz". A request for a directory
+	// in the archive gets its index.html; zip archives also list
+	// directories without one.
+	Archive string `json:",omitempty"`
+
+	// StickySessions, if non-empty, pins each client to one of the
+	// Proxy and ExtraProxies backends. It's either "cookie" (pinned by
+	// a cookie set on the first response) or "ip" (pinned by client IP).
+	// It's only used if ExtraProxies is non-empty.
+	StickySessions string `json:",omitempty"`
+
+	// BodyReplace, if non-empty, maps strings to replace in Proxy response
+	// bodies to their replacements. Replacements are applied in no
+	// particular order.
+	BodyReplace map[string]string `json:",omitempty"`
+
+	// DecodeUpstream, if true, means that gzip-encoded Proxy responses are
+	// decompressed before BodyReplace is applied and recompressed after.
+	DecodeUpstream bool `json:",omitempty"`
+
+	// FollowRedirects, if non-nil, says whether redirects from Proxy to
+	// the same backend are followed by the proxy itself (true) rather
+	// than passed on to the client (false, the default). Only GET and
+	// HEAD requests are followed.
+	FollowRedirects *bool `json:",omitempty"`
+
+	// Compress, if true, means that responses are gzip-compressed for
+	// clients that accept it, unless they're already compressed.
+	Compress bool `json:",omitempty"`
+
+	// MaxRequestBytes, if positive, is the largest request body in bytes
+	// that's passed on to Proxy. Requests with larger bodies get 413
+	// Request Entity Too Large.
+	MaxRequestBytes int64 `json:",omitempty"`
+
+	// CacheMaxAge, if non-nil, is the max-age in seconds of the
+	// Cache-Control header sent with Path responses. Zero asks clients
+	// to revalidate every time.
+	CacheMaxAge *int `json:",omitempty"`
+
+	// SPAFallback, if true, means that requests for files that don't
+	// exist under Path get Path's index.html instead, for single-page
+	// apps that route in the browser. Path must be a directory.
+	SPAFallback bool `json:",omitempty"`
+
+	// Comment is an optional human-readable label describing what the
+	// handler is for. It has no effect on how requests are served.
+	Comment string `json:",omitempty"`
+
 	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
 	// temporary ones? Error codes? Redirects?
 }
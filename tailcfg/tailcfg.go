@@ -1660,6 +1660,10 @@ type Oauth2Token struct {
 	CapabilitySSHRuleIn          = "https://tailscale.com/cap/ssh-rule-in"           // some SSH rule reach this node
 	CapabilityDataPlaneAuditLogs = "https://tailscale.com/cap/data-plane-audit-logs" // feature enabled
 
+	// CapabilityServeEncryptedSecrets means the node can store the secret
+	// fields of its serve config encrypted (ipn.ServeConfig.EncryptedSecrets).
+	CapabilityServeEncryptedSecrets = "https://tailscale.com/cap/serve-encrypted-secrets"
+
 	// Inter-node capabilities as specified in the MapResponse.PacketFilter[].CapGrants.
 
 	// CapabilityFileSharingTarget grants the current node the ability to send